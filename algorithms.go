@@ -42,6 +42,13 @@ func round(f float64, places int) float64 {
 	return math.Floor(f*shift+0.5) / shift
 }
 
+// sorted returns a sorted copy of a, leaving the caller's slice untouched.
+func sorted(a []float64) []float64 {
+	s := append([]float64(nil), a...)
+	sort.Float64s(s)
+	return s
+}
+
 // KS performs a Kolmogorov-Smirnov test for the two datasets, and returns the
 // p-value for the null hypothesis that the two sets come from the same distribution.
 func ks(data1, data2 []float64) float64 {
@@ -52,8 +59,8 @@ func ks(data1, data2 []float64) float64 {
 	var d float64
 	var fn1, fn2 float64
 
-	sort.Float64s(data1)
-	sort.Float64s(data2)
+	data1 = sorted(data1)
+	data2 = sorted(data2)
 
 	j1, j2 := 0, 0
 	for j1 < n1 && j2 < n2 {
@@ -135,7 +142,7 @@ func median(a []float64) float64 {
 		return 0.0
 	}
 	var median float64
-	sort.Float64s(a)
+	a = sorted(a)
 	lhs := (Len - 1) / 2
 	rhs := Len / 2
 	if lhs == rhs {
@@ -173,7 +180,8 @@ func cov(a, b []float64) float64 {
 }
 
 // LinearRegressionLSE least squares linear regression
-// BUG(Adam Drake): Assumptions for using linear regression are not checked.  See http://people.duke.edu/~rnau/testing.htm
+// Assumptions for using linear regression are not checked here; see fitTrend
+// for the diagnostics.  See http://people.duke.edu/~rnau/testing.htm
 // OLS slope is defined as covariance(x, y)/variance(x) and intercept as mean(y)-slope*mean(x)
 func linearRegressionLSE(ts Measurements) (float64, float64) {
 	times := ts.timestamps()
@@ -213,7 +221,7 @@ func histogram(series []float64, bins int) ([]int, []float64) {
 	if l == 0 {
 		return hist, binEdges
 	}
-	sort.Float64s(series)
+	series = sorted(series)
 	w := (series[l-1] - series[0]) / float64(bins)
 	for i := 0; i < bins; i++ {
 		binEdges = append(binEdges, w*float64(i)+series[0])
@@ -240,8 +248,8 @@ func histogram(series []float64, bins int) ([]int, []float64) {
 
 // KS2Samp
 func kS2Samp(data1, data2 []float64) (float64, float64) {
-	sort.Float64s(data1)
-	sort.Float64s(data2)
+	data1 = sorted(data1)
+	data2 = sorted(data2)
 	n1 := len(data1)
 	n2 := len(data2)
 	var dataAll []float64
@@ -349,6 +357,10 @@ func tailAvg(ts []float64) float64 {
 // A timeseries is anomalous if the deviation of its latest datapoint with
 // respect to the median is X times larger than the median of deviations.
 func medianAbsoluteDeviation(ts []float64) bool {
+	if len(ts) == 0 {
+		return false
+	}
+	latest := ts[len(ts)-1]
 	med := median(ts)
 	var normalized []float64
 	for _, val := range ts {
@@ -358,7 +370,7 @@ func medianAbsoluteDeviation(ts []float64) bool {
 	if medianDeviation == 0 {
 		return false
 	}
-	testStatistic := normalized[len(normalized)-1] / medianDeviation
+	testStatistic := math.Abs(latest-med) / medianDeviation
 	if testStatistic > 6 {
 		return true
 	}
@@ -420,6 +432,9 @@ func simpleStddevFromMovingAverage(ts []float64) bool {
 // deviation of the moving average. This is better for finding anomalies with
 // respect to the short term trends.
 func stddevFromMovingAverage(ts []float64) bool {
+	if len(ts) == 0 {
+		return false
+	}
 	expAverage := ewma(ts, 50)
 	stdDev := ewmStd(ts, 50)
 	return math.Abs(ts[len(ts)-1]-expAverage[len(expAverage)-1]) > (3 * stdDev[len(stdDev)-1])
@@ -429,59 +444,35 @@ func stddevFromMovingAverage(ts []float64) bool {
 // A timeseries is anomalous if the value of the next datapoint in the
 // series is farther than a standard deviation out in cumulative terms
 // / after subtracting the mean from each data point.
-//BUG(Adam Drake): Handle case where len(ts) == 0
 func meanSubtractionCumulation(ts []float64) bool {
-	mean := mean(ts[:len(ts)-1])
-	for i, val := range ts {
-		ts[i] = val - mean
+	if len(ts) < 2 {
+		return false
 	}
+	mean := mean(ts[:len(ts)-1])
 	stdDev := std(ts[:len(ts)-1])
-	return math.Abs(ts[len(ts)-1]) > 3*stdDev
+	return math.Abs(ts[len(ts)-1]-mean) > 3*stdDev
 }
 
 // LeastSquares function
 // A timeseries is anomalous if the average of the last three datapoints
 // on a projected least squares model is greater than three sigma.
+// The line is fitted with trendMethod and, with trendChecks, the test
+// abstains when its residuals are autocorrelated or heteroscedastic.
 func leastSquares(ts Measurements) bool {
-	m, c := linearRegressionLSE(ts)
-	var errs []float64
-	for _, val := range ts {
-		projected := m*float64(val.timestamp) + c
-		errs = append(errs, val.value-projected)
+	if len(ts) < 3 {
+		return false
 	}
-	l := len(errs)
-	if l < 3 {
+	fit := fitTrend(ts, trendMethod)
+	if trendChecks && !fit.wellSpecified() {
 		return false
 	}
-	stdDev := std(errs)
+	errs := fit.Residuals
+	l := len(errs)
+	stdDev := fit.Scale
 	t := (errs[l-1] + errs[l-2] + errs[l-3]) / 3
 	return math.Abs(t) > stdDev*3 && math.Trunc(stdDev) != 0 && math.Trunc(t) != 0
 }
 
-// HistogramBins function
-// A timeseries is anomalous if the average of the last three datapoints falls
-// into a histogram bin with less than 20 other datapoints (you'll need to tweak
-// that number depending on your data)
-// Returns: the size of the bin which contains the tailAvg. Smaller bin size
-// means more anomalous.
-func histogramBins(timeseries Measurements) bool {
-	series := timeseries.values()
-	t := tailAvg(series)
-	hist, bins := histogram(series, 15)
-	for i, v := range hist {
-		if v <= 20 {
-			if i == 0 {
-				if t <= bins[0] {
-					return true
-				}
-			} else if t > bins[i] && t < bins[i+1] {
-				return true
-			}
-		}
-	}
-	return false
-}
-
 // KsTest function
 // A timeseries is anomalous if 2 sample Kolmogorov-Smirnov test indicates
 // that data distribution for last 10 minutes is different from last hour.
@@ -518,15 +509,18 @@ func ksTest(timeseries Measurements) bool {
 
 // IsAnomalouslyAnomalous function
 // This method runs a meta-analysis on the metric to determine whether the
-// metric has a past history of triggering. TODO: weight intervals based on datapoint
+// metric has a past history of triggering. triggerHistory holds the start of
+// each past episode and newTrigger starts a new one, which is anomalous
+// unless there are at least metaMinIntervals intervals between earlier
+// episodes and the interval since the last is within metaSigma standard
+// deviations of their mean, that is unless the metric triggers on a regular
+// cadence.
+// TODO: weight intervals based on datapoint
 func isAnomalouslyAnomalous(triggerHistory Measurements, newTrigger Measurement) (bool, Measurements) {
 	if len(triggerHistory) == 0 {
 		triggerHistory = append(triggerHistory, newTrigger)
 		return true, triggerHistory
 	}
-	if (newTrigger.value == triggerHistory[len(triggerHistory)-1].value) && (newTrigger.timestamp-triggerHistory[len(triggerHistory)-1].timestamp <= 300) {
-		return false, triggerHistory
-	}
 	triggerHistory = append(triggerHistory, newTrigger)
 	triggerTimes := triggerHistory.timestamps()
 	var intervals []float64
@@ -535,7 +529,11 @@ func isAnomalouslyAnomalous(triggerHistory Measurements, newTrigger Measurement)
 			intervals = append(intervals, float64(triggerTimes[i+1]-triggerTimes[i]))
 		}
 	}
-	mean := mean(intervals)
-	stdDev := std(intervals)
-	return math.Abs(intervals[len(intervals)-1]-mean) > 3*stdDev, triggerHistory
+	past := intervals[:len(intervals)-1]
+	if len(past) < metaMinIntervals {
+		return true, triggerHistory
+	}
+	mean := mean(past)
+	stdDev := std(past)
+	return math.Abs(intervals[len(intervals)-1]-mean) > metaSigma*stdDev, triggerHistory
 }
@@ -43,6 +43,10 @@ func TestMedian(t *testing.T) {
 	if median(series) != 5.05 {
 		t.Fatal("wrong median", median(series))
 	}
+	unsorted := []float64{3, 1, 2}
+	if median(unsorted) != 2 || unsorted[0] != 3 {
+		t.Fatal("median() should not reorder its argument but left", unsorted)
+	}
 	emptySlice := []float64{}
 	if median(emptySlice) != 0.0 {
 		t.Fatal("median of [0.0] should be 0 but was", median(emptySlice))
@@ -178,6 +182,10 @@ func TestMedianAbsoluteDeviation(t *testing.T) {
 	if medianAbsoluteDeviation(anomSeries) != true {
 		t.Fatal("medianAbsoluteDeviation() returned false for bad series")
 	}
+	earlierAnomSeries := []float64{0.6652356971378492, 2.828082160729557, 500.5759349867985595, 6.4885349866234066, 8.323505050316992, 4.235336161652312, 2.6864488789516905, 9.315871316707883, 6.196127077653522, 1.0475738614605756, 3.6130700415059644, 8.580966992844761, 9.787803840922486, 7.319726729729728, 4.492799589097807}
+	if medianAbsoluteDeviation(earlierAnomSeries) != false {
+		t.Fatal("medianAbsoluteDeviation() returned true for a series whose latest datapoint is normal")
+	}
 	if medianAbsoluteDeviation([]float64{}) != false || medianAbsoluteDeviation([]float64{0.0}) != false {
 		t.Fatal("medianAbsoluteDeviation() was incorrect for empty or slice with only 0.0 calculation")
 	}
@@ -231,7 +239,41 @@ func TestLeastSquares(t *testing.T) {
 	if leastSquares(measurementsNorm) != false {
 		t.Fatal("should be false")
 	}
+	// A single outlier this large inflates the scale of an ordinary least
+	// squares fit enough to hide itself; a robust fit is needed to catch it.
+	if leastSquares(measurementsAnom) != false {
+		t.Fatal("should be false with the default ols trend")
+	}
+	defer func(method string) { trendMethod = method }(trendMethod)
+	trendMethod = trendHuber
 	if leastSquares(measurementsAnom) != true {
 		t.Fatal("should be true")
 	}
 }
+
+func TestIsAnomalouslyAnomalous(t *testing.T) {
+	var history Measurements
+	var anomalous bool
+	// A metric firing every three hours like clockwork.
+	for i := 0; i < 6; i++ {
+		anomalous, history = isAnomalouslyAnomalous(history, Measurement{float64(i), int64(i*10800 + i%2*60)})
+		if i <= metaMinIntervals && !anomalous {
+			t.Fatal("isAnomalouslyAnomalous() should let triggers through until a cadence is known but suppressed trigger", i)
+		}
+	}
+	if anomalous {
+		t.Fatal("isAnomalouslyAnomalous() should suppress a trigger on the usual cadence")
+	}
+	anomalous, history = isAnomalouslyAnomalous(history, Measurement{10, 5*10800 + 1800})
+	if !anomalous || len(history) != 7 {
+		t.Fatal("isAnomalouslyAnomalous() should let an off-cadence trigger through")
+	}
+}
+
+func TestEmptySeries(t *testing.T) {
+	for _, ts := range [][]float64{nil, {1}} {
+		if stddevFromMovingAverage(ts) || meanSubtractionCumulation(ts) {
+			t.Fatal("the algorithms should not flag a series of", len(ts), "datapoints")
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fullDuration is the length of history, in seconds, that the analyzer
+// expects each series to hold.
+const fullDuration = 86400
+
+// configuredSeasonalPeriod is the length, in seconds, of the seasonal cycle
+// assumed by the seasonal algorithms. When zero it is detected per metric.
+var configuredSeasonalPeriod int64
+
+// Anomaly describes a metric whose latest datapoint was flagged by the
+// analyzer, along with the times its behaviour changed over the last
+// fullDuration seconds.
+type Anomaly struct {
+	Metric       string   `json:"metric"`
+	Value        float64  `json:"value"`
+	Timestamp    int64    `json:"timestamp"`
+	Algorithms   []string `json:"algorithms"`
+	ChangePoints []int64  `json:"changePoints,omitempty"`
+	Group        string   `json:"group,omitempty"` // metric group whose members it differs from
+}
+
+type algorithm struct {
+	name string
+	// detect is given the series and its seasonality, decomposed once per
+	// pass and without a cycle when the series has none.
+	detect func(ts Measurements, s *seasonality) bool
+	// stream, when set, gives the same verdict from the metric's streaming
+	// state in constant time, and is used in place of detect when the state
+	// is available.
+	stream func(*streamSnapshot) bool
+	// seasonal marks the algorithms that allow for the seasonal cycle, whose
+	// regular peaks the others take for anomalies.
+	seasonal bool
+}
+
+// algorithms are the detectors the analyzer runs against every series.
+var algorithms = []algorithm{
+	{"firstHourAverage", func(ts Measurements, _ *seasonality) bool { return firstHourAverage(ts, fullDuration) }, nil, false},
+	{"meanSubtractionCumulation", func(ts Measurements, _ *seasonality) bool { return meanSubtractionCumulation(ts.values()) }, func(s *streamSnapshot) bool { return streamingMeanSubtractionCumulation(s.stats) }, false},
+	{"simpleStddevFromMovingAverage", func(ts Measurements, _ *seasonality) bool { return simpleStddevFromMovingAverage(ts.values()) }, func(s *streamSnapshot) bool { return streamingSimpleStddevFromMovingAverage(s.stats) }, false},
+	{"stddevFromMovingAverage", func(ts Measurements, _ *seasonality) bool { return stddevFromMovingAverage(ts.values()) }, func(s *streamSnapshot) bool { return streamingStddevFromMovingAverage(s.stats) }, false},
+	{"leastSquares", func(ts Measurements, _ *seasonality) bool { return leastSquares(lastDuration(ts, fullDuration)) }, nil, false},
+	{"percentileRank", func(ts Measurements, _ *seasonality) bool { return percentileRank(ts) }, streamingPercentileRank, false},
+	{"ksTest", func(ts Measurements, _ *seasonality) bool { return ksTest(ts) }, nil, false},
+	{"medianAbsoluteDeviation", func(ts Measurements, _ *seasonality) bool { return medianAbsoluteDeviation(ts.values()) }, func(s *streamSnapshot) bool { return streamingMedianAbsoluteDeviation(s.stats) }, false},
+	{"stlMedianAbsoluteDeviation", stlMedianAbsoluteDeviation, nil, true},
+	{"stlStddev", stlStddev, nil, true},
+	{"holtWintersDeviation", holtWintersDeviation, nil, true},
+	{"seasonalHybridESD", seasonalHybridESDLatest, nil, true},
+	{"cusum", func(ts Measurements, s *seasonality) bool {
+		return recentShift(ts, cusum(ts, s, cusumDrift, cusumThreshold))
+	}, nil, true},
+	{"pageHinkley", func(ts Measurements, s *seasonality) bool {
+		return recentShift(ts, pageHinkley(ts, s, pageHinkleyDelta, pageHinkleyThreshold))
+	}, nil, true},
+	{"isolationForest", isolationForestLatest, nil, true},
+	{"spectralResidual", func(ts Measurements, _ *seasonality) bool { return spectralResidualLatest(ts) }, nil, false},
+	{"arimaDeviation", func(ts Measurements, _ *seasonality) bool { return arimaDeviation(ts) }, nil, false},
+	{"mannKendallTrend", mannKendallTrend, nil, true},
+}
+
+// parseMeasurement parses a datapoint as stored by handleMetric, "value,timestamp".
+func parseMeasurement(s string) (Measurement, error) {
+	parts := strings.SplitN(s, ",", 2)
+	if len(parts) != 2 {
+		return Measurement{}, fmt.Errorf("bad datapoint %q", s)
+	}
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return Measurement{}, err
+	}
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Measurement{}, err
+	}
+	return Measurement{value, timestamp}, nil
+}
+
+// fetchMeasurements returns the stored series for a metric, skipping any
+// datapoints that cannot be parsed.
+func fetchMeasurements(client redis.UniversalClient, name string) (Measurements, error) {
+	raw, err := client.LRange(ctx, metricKey(name), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	ts := make(Measurements, 0, len(raw))
+	for _, s := range raw {
+		m, err := parseMeasurement(s)
+		if err != nil {
+			continue
+		}
+		ts = append(ts, m)
+	}
+	return ts, nil
+}
+
+// analyzer periodically runs the algorithms over the metrics selected by
+// query and flags those on which at least consensus algorithms agree, or
+// whose latest datapoint breaks one of the boundaries. With metaAnalysis,
+// metrics on which the algorithms agree in episodes starting on a regular
+// cadence are not flagged by them; broken boundaries are always flagged.
+type analyzer struct {
+	client     redis.UniversalClient
+	index      *metricIndex
+	query      metricQuery
+	consensus  int
+	streams    *streamStore
+	periods    *metricPeriods
+	groups     []metricGroup
+	boundaries boundaryRules
+	triggers   triggerHistory
+	logger     *log.Logger
+
+	mu        sync.RWMutex
+	anomalies []Anomaly
+	skipped   []skippedMetric
+}
+
+// analyzeSeries runs every algorithm over ts, whose seasonal cycle is period
+// seconds long, or over the metric's streaming state s when it has one, and
+// returns the names of those that flagged it. ts is decomposed once for all
+// of them. When ts has a cycle the algorithms that do not allow for it take
+// its regular peaks for anomalies, so their votes only count when one of
+// the seasonal algorithms flags ts too.
+func analyzeSeries(ts Measurements, period int64, s *streamSnapshot) []string {
+	season := decompose(ts, period)
+	confirmed := season.period == 0
+	var triggered []string
+	for _, alg := range algorithms {
+		var flagged bool
+		if s != nil && alg.stream != nil {
+			flagged = alg.stream(s)
+		} else {
+			flagged = alg.detect(ts, season)
+		}
+		if flagged {
+			triggered = append(triggered, alg.name)
+			confirmed = confirmed || alg.seasonal
+		}
+	}
+	if !confirmed {
+		return nil
+	}
+	return triggered
+}
+
+// analyzeMetric returns the anomaly in the named metric, if any, and the
+// reason the algorithms were not run over it when its data is not fit for
+// analysis. The boundaries are checked either way.
+func (a *analyzer) analyzeMetric(name string) (*Anomaly, string, error) {
+	ts, err := fetchMeasurements(a.client, name)
+	if err != nil {
+		return nil, "", err
+	}
+	ts, reason := checkQuality(ts)
+	if len(ts) == 0 {
+		return nil, reason, nil
+	}
+	var triggered []string
+	if reason == "" {
+		period, err := a.periods.period(name, ts, configuredSeasonalPeriod)
+		if err != nil {
+			return nil, "", err
+		}
+		triggered = analyzeSeries(ts, period, a.streams.get(name, ts))
+	}
+	broken := a.boundaries.check(name, ts)
+	if len(triggered) < a.consensus && len(broken) == 0 {
+		return nil, reason, nil
+	}
+	last := ts[len(ts)-1]
+	if len(triggered) < a.consensus {
+		triggered = nil
+	} else if metaAnalysis {
+		anomalous, err := a.triggers.record(name, last)
+		if err != nil {
+			return nil, "", err
+		}
+		if !anomalous {
+			triggered = nil
+		}
+	}
+	triggered = append(triggered, broken...)
+	if len(triggered) == 0 {
+		return nil, reason, nil
+	}
+	return &Anomaly{
+		Metric:       name,
+		Value:        last.value,
+		Timestamp:    last.timestamp,
+		Algorithms:   triggered,
+		ChangePoints: changePoints(lastDuration(ts, fullDuration), fastChangePoints),
+	}, reason, nil
+}
+
+// analyze runs one pass over every selected metric, returning the anomalies
+// found and the metrics whose data was not fit for analysis.
+func (a *analyzer) analyze() ([]Anomaly, []skippedMetric, error) {
+	names, err := a.index.query(a.query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	work := make(chan string)
+	var mu sync.Mutex
+	var anomalies []Anomaly
+	var skipped []skippedMetric
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				anomaly, reason, err := a.analyzeMetric(name)
+				if err != nil {
+					a.logger.Println("analysis of", name, "failed:", err)
+					continue
+				}
+				mu.Lock()
+				if anomaly != nil {
+					anomalies = append(anomalies, *anomaly)
+				}
+				if reason != "" {
+					skipped = append(skipped, skippedMetric{Metric: name, Reason: reason})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, name := range names {
+		work <- name
+	}
+	close(work)
+	wg.Wait()
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].Metric < skipped[j].Metric })
+
+	stale, err := staleAnomalies(a.client, a.query)
+	if err != nil {
+		a.logger.Println("stale metric lookup failed:", err)
+	}
+	anomalies = append(anomalies, stale...)
+
+	for _, g := range a.groups {
+		found, err := a.analyzeGroup(g)
+		if err != nil {
+			a.logger.Println("analysis of group", g.name, "failed:", err)
+			continue
+		}
+		anomalies = append(anomalies, found...)
+	}
+	return anomalies, skipped, nil
+}
+
+// analyzeGroup compares the members of a metric group over the last
+// groupWindow seconds, returning an anomaly for each member that differs
+// from the others. Only the datapoints in the window are fetched.
+func (a *analyzer) analyzeGroup(g metricGroup) ([]Anomaly, error) {
+	names, err := a.index.query(g.query)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) < groupMinMembers {
+		return nil, nil
+	}
+	series := make(map[string]Measurements, len(names))
+	from := time.Now().Unix() - groupWindow
+	err = fetchRange(a.client, names, from, math.MaxInt64, func(name string, ts Measurements) {
+		series[name] = ts
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var anomalies []Anomaly
+	for name, triggered := range groupOutliers(alignGroup(series, groupWindow)) {
+		last := series[name][len(series[name])-1]
+		anomalies = append(anomalies, Anomaly{
+			Metric:     name,
+			Value:      last.value,
+			Timestamp:  last.timestamp,
+			Algorithms: triggered,
+			Group:      g.name,
+		})
+	}
+	sort.Slice(anomalies, func(i, j int) bool { return anomalies[i].Metric < anomalies[j].Metric })
+	return anomalies, nil
+}
+
+// run analyzes the selected metrics every interval, logging each anomaly.
+func (a *analyzer) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		start := time.Now()
+		anomalies, skipped, err := a.analyze()
+		if err != nil {
+			a.logger.Println("analysis failed:", err)
+			continue
+		}
+		for _, anomaly := range anomalies {
+			a.logger.Println("anomaly:", anomaly.Metric, anomaly.Value, anomaly.Timestamp, anomaly.Algorithms, "changed at", anomaly.ChangePoints)
+		}
+		a.logger.Println("analyzed metrics in", time.Since(start), "found", len(anomalies), "anomalies and skipped", len(skipped), "metrics")
+
+		a.mu.Lock()
+		a.anomalies = anomalies
+		a.skipped = skipped
+		a.mu.Unlock()
+	}
+}
+
+// latest returns the anomalies found by the most recent analysis pass.
+func (a *analyzer) latest() []Anomaly {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.anomalies
+}
+
+// skippedMetrics returns the metrics the most recent analysis pass did not
+// run the algorithms over and why.
+func (a *analyzer) skippedMetrics() []skippedMetric {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.skipped
+}
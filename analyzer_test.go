@@ -0,0 +1,28 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeSeriesSeasonalConfirmation(t *testing.T) {
+	defer func(saved []algorithm) { algorithms = saved }(algorithms)
+	seasonalVote := false
+	algorithms = []algorithm{
+		{"raw", func(Measurements, *seasonality) bool { return true }, nil, false},
+		{"seasonal", func(Measurements, *seasonality) bool { return seasonalVote }, nil, true},
+	}
+
+	daily := seasonalSeries(5)
+	if triggered := analyzeSeries(daily, 0, nil); triggered != nil {
+		t.Fatal("analyzeSeries() should drop the votes on a series with a cycle that no seasonal algorithm flags but returned", triggered)
+	}
+	seasonalVote = true
+	if triggered := analyzeSeries(daily, 0, nil); !reflect.DeepEqual(triggered, []string{"raw", "seasonal"}) {
+		t.Fatal("analyzeSeries() should count every vote once a seasonal algorithm flags the series but returned", triggered)
+	}
+	seasonalVote = false
+	if triggered := analyzeSeries(daily, noPeriod, nil); !reflect.DeepEqual(triggered, []string{"raw"}) {
+		t.Fatal("analyzeSeries() should count every vote on a series without a cycle but returned", triggered)
+	}
+}
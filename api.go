@@ -0,0 +1,742 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// queryFromRequest reads a metricQuery from the glob, regex and (repeatable)
+// tag parameters of a request.
+func queryFromRequest(r *http.Request) metricQuery {
+	params := r.URL.Query()
+	return metricQuery{
+		Glob:  params.Get("glob"),
+		Regex: params.Get("regex"),
+		Tags:  params["tag"],
+	}
+}
+
+// lastParam returns the number of seconds of history given by the last
+// parameter, fullDuration when it is missing or larger. It returns an error
+// unless the parameter is a positive number.
+func lastParam(params url.Values) (int64, error) {
+	s := params.Get("last")
+	if s == "" {
+		return fullDuration, nil
+	}
+	last, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || last <= 0 {
+		return 0, fmt.Errorf("bad last %q", s)
+	}
+	if last > fullDuration {
+		last = fullDuration
+	}
+	return last, nil
+}
+
+// handleFindMetrics serves /metrics, returning the names of the metrics
+// selected by the query parameters, e.g. /metrics?glob=web*.cpu.* or
+// /metrics?tag=dc=ams&tag=host=~web.*
+func handleFindMetrics(index *metricIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		names, err := index.query(queryFromRequest(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if names == nil {
+			names = []string{}
+		}
+		writeJSON(w, names)
+	}
+}
+
+// handleAnomalies serves /anomalies, returning the anomalies found by the
+// most recent analysis pass.
+func handleAnomalies(a *analyzer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		anomalies := a.latest()
+		if anomalies == nil {
+			anomalies = []Anomaly{}
+		}
+		writeJSON(w, anomalies)
+	}
+}
+
+// handleCorrelations serves /correlations?metric=name, returning the metrics
+// that moved with it around the time of its anomaly, most strongly
+// correlated first. The time is the timestamp parameter, else that of the
+// metric's latest anomaly, else its latest datapoint. The window (default
+// 1800) seconds either side are compared, allowing metrics to lead or lag by
+// shift (default 120) seconds, and those with an absolute correlation of at
+// least min (default 0.7) reported, at most limit (default 20) of them. The
+// glob, regex and tag parameters restrict the metrics compared.
+func handleCorrelations(client redis.UniversalClient, index *metricIndex, a *analyzer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		name := params.Get("metric")
+		var at int64
+		window, shift, limit := int64(correlationWindow), int64(correlationShift), int64(20)
+		for param, v := range map[string]*int64{"timestamp": &at, "window": &window, "shift": &shift, "limit": &limit} {
+			if s := params.Get(param); s != "" {
+				var err error
+				if *v, err = strconv.ParseInt(s, 10, 64); err != nil || *v < 0 {
+					http.Error(w, "bad "+param+" "+strconv.Quote(s), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		minimum := correlationMinimum
+		if s := params.Get("min"); s != "" {
+			var err error
+			if minimum, err = strconv.ParseFloat(s, 64); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		names, err := index.query(queryFromRequest(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ts, err := fetchMeasurements(client, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(ts) == 0 {
+			http.Error(w, "no data for "+name, http.StatusNotFound)
+			return
+		}
+		if at == 0 {
+			at = ts[len(ts)-1].timestamp
+			for _, anomaly := range a.latest() {
+				if anomaly.Metric == name {
+					at = anomaly.Timestamp
+				}
+			}
+		}
+		c, ok := newCorrelator(ts, at, window, shift, minimum)
+		if !ok {
+			http.Error(w, "not enough variation in "+name+" to correlate", http.StatusNotFound)
+			return
+		}
+		others := names[:0:0]
+		for _, other := range names {
+			if other != name {
+				others = append(others, other)
+			}
+		}
+		if len(others) > maxCorrelationCandidates {
+			http.Error(w, "too many metrics to compare, narrow them with glob, regex or tag", http.StatusBadRequest)
+			return
+		}
+		ranked, err := rankCorrelations(client, others, c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if int64(len(ranked)) > limit {
+			ranked = ranked[:limit]
+		}
+		if ranked == nil {
+			ranked = []correlatedMetric{}
+		}
+		writeJSON(w, ranked)
+	}
+}
+
+// handleSkipped serves /skipped, returning the metrics the most recent
+// analysis pass did not run the algorithms over because their data was not
+// fit for analysis, and why.
+func handleSkipped(a *analyzer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		skipped := a.skippedMetrics()
+		if skipped == nil {
+			skipped = []skippedMetric{}
+		}
+		writeJSON(w, skipped)
+	}
+}
+
+// handleTriggers serves /triggers?metric=name, returning the times the
+// metric was found anomalous, as kept for the meta-analysis.
+func handleTriggers(triggers triggerHistory) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		history, err := triggers.load(r.URL.Query().Get("metric"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		timestamps := history.timestamps()
+		if timestamps == nil {
+			timestamps = []int64{}
+		}
+		writeJSON(w, timestamps)
+	}
+}
+
+// handleStats serves /stats, returning the ingestion counters.
+func handleStats(stats *writeStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, stats.snapshot())
+	}
+}
+
+type forecastPoint struct {
+	Timestamp int64    `json:"timestamp"`
+	Value     *float64 `json:"value,omitempty"`
+	Forecast  float64  `json:"forecast"`
+	Lower     float64  `json:"lower"`
+	Upper     float64  `json:"upper"`
+}
+
+type forecastResponse struct {
+	Metric         string          `json:"metric"`
+	Period         int             `json:"period"`
+	Multiplicative bool            `json:"multiplicative"`
+	Alpha          float64         `json:"alpha"`
+	Beta           float64         `json:"beta"`
+	Gamma          float64         `json:"gamma"`
+	Points         []forecastPoint `json:"points"`
+	Next           forecastPoint   `json:"next"`
+}
+
+// handleForecast serves /forecast?metric=name, returning the Holt-Winters
+// forecast and confidence band of every datapoint after the first seasonal
+// cycle the model was fitted to and of the next one.
+func handleForecast(client redis.UniversalClient, periods *metricPeriods) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("metric")
+		ts, err := fetchMeasurements(client, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(ts) == 0 {
+			http.Error(w, "no data for "+name, http.StatusNotFound)
+			return
+		}
+		ts, reason := checkQuality(ts)
+		if reason != "" {
+			http.Error(w, name+" is not fit for analysis: "+reason, http.StatusNotFound)
+			return
+		}
+		seconds, err := periods.period(name, ts, configuredSeasonalPeriod)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		period := seasonalPeriod(ts, seconds)
+		if period < 2 || len(ts) < 2*period {
+			http.Error(w, "not enough data to forecast "+name, http.StatusNotFound)
+			return
+		}
+
+		fit, start, ok := holtWintersForecast(ts.values(), period)
+		if !ok {
+			http.Error(w, "could not fit a forecast to "+name, http.StatusNotFound)
+			return
+		}
+		ts = ts[start:]
+		resp := forecastResponse{
+			Metric:         name,
+			Period:         period,
+			Multiplicative: fit.multiplicative,
+			Alpha:          fit.alpha,
+			Beta:           fit.beta,
+			Gamma:          fit.gamma,
+			Next: forecastPoint{
+				Timestamp: ts[len(ts)-1].timestamp + samplingInterval(ts),
+				Forecast:  fit.next,
+				Lower:     fit.nextLower,
+				Upper:     fit.nextUpper,
+			},
+		}
+		for i := period; i < len(ts); i++ {
+			value := ts[i].value
+			resp.Points = append(resp.Points, forecastPoint{
+				Timestamp: ts[i].timestamp,
+				Value:     &value,
+				Forecast:  fit.forecasts[i],
+				Lower:     fit.lower[i],
+				Upper:     fit.upper[i],
+			})
+		}
+		writeJSON(w, resp)
+	}
+}
+
+type arimaResponse struct {
+	Metric   string    `json:"metric"`
+	P        int       `json:"p"`
+	D        int       `json:"d"`
+	Q        int       `json:"q"`
+	AR       []float64 `json:"ar"`
+	MA       []float64 `json:"ma"`
+	Mean     float64   `json:"mean"`
+	Sigma    float64   `json:"sigma"`
+	AIC      float64   `json:"aic"`
+	Next     float64   `json:"next"`
+	Residual float64   `json:"residual"` // forecast error of the latest datapoint, in sigmas
+}
+
+// handleARIMA serves /arima?metric=name, returning the ARIMA model fitted to
+// the last day of the metric before its latest datapoint, the forecast of
+// that datapoint and how far it was off.
+func handleARIMA(client redis.UniversalClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("metric")
+		ts, err := fetchMeasurements(client, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		x := arimaWindow(ts)
+		if len(x) < arimaMinPoints+1 {
+			http.Error(w, "not enough data to fit "+name, http.StatusNotFound)
+			return
+		}
+		model, ok := fitARIMA(x[:len(x)-1])
+		if !ok {
+			http.Error(w, "no ARIMA model fits "+name, http.StatusNotFound)
+			return
+		}
+		resp := arimaResponse{
+			Metric: name,
+			P:      model.p,
+			D:      model.d,
+			Q:      model.q,
+			AR:     append([]float64{}, model.ar...),
+			MA:     append([]float64{}, model.ma...),
+			Mean:   model.mean,
+			Sigma:  model.sigma,
+			AIC:    model.aic,
+			Next:   model.next,
+		}
+		if model.sigma > 0 {
+			resp.Residual = (x[len(x)-1] - model.next) / model.sigma
+		}
+		writeJSON(w, resp)
+	}
+}
+
+// handleTrend serves /trend?metric=name, returning the trend line leastSquares
+// fits to the last fullDuration seconds of the metric, by the method given as
+// method (default -trend-method), and the diagnostics of its residuals.
+func handleTrend(client redis.UniversalClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		method := params.Get("method")
+		if method == "" {
+			method = trendMethod
+		}
+		if err := validTrendMethod(method); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ts, err := fetchMeasurements(client, params.Get("metric"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, fitTrend(lastDuration(ts, fullDuration), method))
+	}
+}
+
+type capacityResponse struct {
+	Metric string `json:"metric"`
+	monotonicTrend
+	Significant bool     `json:"significant"`
+	Threshold   *float64 `json:"threshold,omitempty"`
+	ETA         *int64   `json:"eta,omitempty"` // timestamp at which the threshold is reached
+}
+
+// handleCapacity serves /capacity?metric=name, returning the Mann-Kendall
+// test and Sen's slope of the metric, less its seasonal cycle, over the last
+// window seconds (default -mk-window) and, given threshold, when the trend
+// will reach it.
+func handleCapacity(client redis.UniversalClient, periods *metricPeriods) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		name := params.Get("metric")
+		window := mannKendallWindow
+		if s := params.Get("window"); s != "" {
+			var err error
+			if window, err = strconv.ParseInt(s, 10, 64); err != nil || window <= 0 {
+				http.Error(w, "bad window "+strconv.Quote(s), http.StatusBadRequest)
+				return
+			}
+		}
+		var threshold *float64
+		if s := params.Get("threshold"); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			threshold = &v
+		}
+		ts, err := fetchMeasurements(client, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(ts) == 0 {
+			http.Error(w, "no data for "+name, http.StatusNotFound)
+			return
+		}
+		seconds, err := periods.period(name, ts, configuredSeasonalPeriod)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ts = thinTrend(trendWindow(ts, window, decompose(ts, seconds)), maxTrendLength)
+		if len(ts) < mannKendallMinPoints {
+			http.Error(w, "not enough data to test "+name, http.StatusNotFound)
+			return
+		}
+		mt := mannKendall(ts)
+		resp := capacityResponse{Metric: name, monotonicTrend: mt, Significant: mt.significant(mannKendallAlpha), Threshold: threshold}
+		if threshold != nil && resp.Significant {
+			if eta, ok := mt.timeToThreshold(*threshold, ts[len(ts)-1].timestamp); ok {
+				resp.ETA = &eta
+			}
+		}
+		writeJSON(w, resp)
+	}
+}
+
+type esdAnomaly struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// handleESD serves /esd?metric=name, returning every datapoint of the last
+// esdCycles seasonal cycles of the metric that Seasonal Hybrid ESD flags, as
+// tested by the seasonalHybridESD algorithm. The optional max_anoms (default 0.02, at
+// most 0.5) and alpha (default 0.05) parameters tune the test.
+func handleESD(client redis.UniversalClient, periods *metricPeriods) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		maxAnoms, alpha := 0.02, 0.05
+		var err error
+		if s := params.Get("max_anoms"); s != "" {
+			if maxAnoms, err = strconv.ParseFloat(s, 64); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !(maxAnoms > 0 && maxAnoms <= 0.5) {
+				http.Error(w, "max_anoms must be above 0 and at most 0.5", http.StatusBadRequest)
+				return
+			}
+		}
+		if s := params.Get("alpha"); s != "" {
+			if alpha, err = strconv.ParseFloat(s, 64); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		name := params.Get("metric")
+		ts, err := fetchMeasurements(client, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(ts) == 0 {
+			http.Error(w, "no data for "+name, http.StatusNotFound)
+			return
+		}
+		seconds, err := periods.period(name, ts, configuredSeasonalPeriod)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		period := seasonalPeriod(ts, seconds)
+		ts = esdWindow(ts, period)
+		anomalies := []esdAnomaly{}
+		for _, i := range seasonalHybridESD(ts, period, maxAnoms, alpha) {
+			anomalies = append(anomalies, esdAnomaly{Timestamp: ts[i].timestamp, Value: ts[i].value})
+		}
+		writeJSON(w, anomalies)
+	}
+}
+
+type changesResponse struct {
+	Metric       string     `json:"metric"`
+	Cusum        levelShift `json:"cusum"`
+	PageHinkley  levelShift `json:"pageHinkley"`
+	ChangePoints []int64    `json:"changePoints"`
+}
+
+// handleChanges serves /changes?metric=name, returning the latest level
+// shifts in the recent datapoints of the metric found by the sequential
+// change detectors and the times its mean or variance changed over the last
+// day (last=seconds to change, at most a day). The change points are found
+// with PELT, or binary segmentation given method=binseg.
+func handleChanges(client redis.UniversalClient, periods *metricPeriods) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		name := params.Get("metric")
+		duration, err := lastParam(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ts, err := fetchMeasurements(client, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(ts) == 0 {
+			http.Error(w, "no data for "+name, http.StatusNotFound)
+			return
+		}
+		seconds, err := periods.period(name, ts, configuredSeasonalPeriod)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		changes := changePoints(lastDuration(ts, duration), params.Get("method") == "binseg")
+		if changes == nil {
+			changes = []int64{}
+		}
+		// The decomposition needs the cycles before the last day; the
+		// change detectors, like the cusum and pageHinkley algorithms, only
+		// look at the latest datapoints.
+		season := decompose(ts, seconds)
+		recent := lastDuration(ts, fullDuration)
+		writeJSON(w, changesResponse{
+			Metric:       name,
+			Cusum:        cusum(recent, season, cusumDrift, cusumThreshold),
+			PageHinkley:  pageHinkley(recent, season, pageHinkleyDelta, pageHinkleyThreshold),
+			ChangePoints: changes,
+		})
+	}
+}
+
+// handleBOCPD serves /bocpd?metric=name, returning the run length posterior
+// of a metric tracked by Bayesian online change point detection, its most
+// likely run length and the probability that the metric has just changed.
+func handleBOCPD(tracker *changeTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("metric")
+		s, ok := tracker.state(name)
+		if !ok {
+			http.Error(w, "metric "+strconv.Quote(name)+" is not tracked", http.StatusNotFound)
+			return
+		}
+		if s.Posterior == nil {
+			s.Posterior = []float64{}
+		}
+		writeJSON(w, s)
+	}
+}
+
+type windowQuantiles struct {
+	Start     int64     `json:"start"`
+	Count     float64   `json:"count"`
+	Quantiles []float64 `json:"quantiles"`
+}
+
+type quantilesResponse struct {
+	Metric    string            `json:"metric"`
+	Q         []float64         `json:"q"`
+	Total     windowQuantiles   `json:"total"`
+	Reference windowQuantiles   `json:"reference"`
+	Windows   []windowQuantiles `json:"windows"`
+}
+
+// handleQuantiles serves /quantiles?metric=name&q=0.5&q=0.999, returning the
+// requested quantiles (by default the median, 99th and 99.9th percentiles)
+// of every datapoint the metric has received, of its reference and of each
+// rollup window, estimated from its t-digests.
+func handleQuantiles(streams *streamStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		name := params.Get("metric")
+		qs := []float64{0.5, 0.99, 0.999}
+		if len(params["q"]) > 0 {
+			qs = nil
+			for _, s := range params["q"] {
+				q, err := strconv.ParseFloat(s, 64)
+				if err != nil || q < 0 || q > 1 {
+					http.Error(w, "bad quantile "+strconv.Quote(s), http.StatusBadRequest)
+					return
+				}
+				qs = append(qs, q)
+			}
+		}
+		digests := streams.digests(name)
+		if digests == nil {
+			http.Error(w, "no datapoints received for metric "+strconv.Quote(name), http.StatusNotFound)
+			return
+		}
+
+		summarize := func(start int64, d *tdigest) windowQuantiles {
+			wq := windowQuantiles{Start: start, Count: d.total, Quantiles: []float64{}}
+			if d.total > 0 {
+				for _, q := range qs {
+					wq.Quantiles = append(wq.Quantiles, d.quantile(q))
+				}
+			}
+			return wq
+		}
+		resp := quantilesResponse{
+			Metric:    name,
+			Q:         qs,
+			Total:     summarize(0, digests.total),
+			Reference: summarize(0, digests.reference()),
+			Windows:   []windowQuantiles{},
+		}
+		for _, wd := range digests.completed {
+			resp.Windows = append(resp.Windows, summarize(wd.Start, wd.Digest))
+		}
+		if digests.current.Digest != nil {
+			resp.Windows = append(resp.Windows, summarize(digests.current.Start, digests.current.Digest))
+		}
+		writeJSON(w, resp)
+	}
+}
+
+type saliencyPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+	Score     float64 `json:"score"`
+}
+
+// handleSaliency serves /saliency?metric=name, returning the spectral
+// residual anomaly score of each datapoint of the metric over the last day
+// (last=seconds to change, at most a day).
+func handleSaliency(client redis.UniversalClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		duration, err := lastParam(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ts, err := fetchMeasurements(client, params.Get("metric"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ts = lastDuration(ts, duration)
+		points := []saliencyPoint{}
+		if len(ts) > 0 {
+			for i, score := range spectralResidual(ts.values()) {
+				points = append(points, saliencyPoint{ts[i].timestamp, ts[i].value, score})
+			}
+		}
+		writeJSON(w, points)
+	}
+}
+
+type periodResponse struct {
+	Metric string `json:"metric"`
+	Period int64  `json:"period"`
+	Kind   string `json:"kind"`
+}
+
+// handlePeriod serves /period?metric=name, returning the length in seconds of
+// the seasonal cycle used for the metric, and whether it is daily, weekly,
+// other or none.
+func handlePeriod(client redis.UniversalClient, periods *metricPeriods) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("metric")
+		ts, err := fetchMeasurements(client, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(ts) == 0 {
+			http.Error(w, "no data for "+name, http.StatusNotFound)
+			return
+		}
+		seconds, err := periods.period(name, ts, configuredSeasonalPeriod)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if seconds == noPeriod {
+			seconds = 0
+		}
+		writeJSON(w, periodResponse{name, seconds, periodKind(seconds)})
+	}
+}
+
+// handleDiscords serves /discords?metric=name, returning the k (default 3)
+// most unusual subsequences of length seconds (default an hour) in the last
+// seconds (default a week) of the metric, found with its matrix profile.
+func handleDiscords(client redis.UniversalClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		k, length, duration := int64(3), int64(3600), int64(7*86400)
+		for param, v := range map[string]*int64{"k": &k, "length": &length, "last": &duration} {
+			if s := params.Get(param); s != "" {
+				var err error
+				if *v, err = strconv.ParseInt(s, 10, 64); err != nil || *v <= 0 {
+					http.Error(w, "bad "+param+" "+strconv.Quote(s), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		ts, err := fetchMeasurements(client, params.Get("metric"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ts = lastDuration(ts, duration)
+		if len(ts) > maxProfileLength {
+			http.Error(w, "too many datapoints, request fewer with last", http.StatusBadRequest)
+			return
+		}
+		m := 0
+		if interval := samplingInterval(ts); interval > 0 {
+			m = int(length / interval)
+		}
+		discords := topDiscords(ts, m, int(k))
+		if discords == nil {
+			discords = []discord{}
+		}
+		writeJSON(w, discords)
+	}
+}
+
+func serveAPI(addr string, client redis.UniversalClient, index *metricIndex, a *analyzer, tracker *changeTracker, streams *streamStore, stats *writeStats, logger *log.Logger) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/forecast", handleForecast(client, a.periods))
+	mux.HandleFunc("/esd", handleESD(client, a.periods))
+	mux.HandleFunc("/arima", handleARIMA(client))
+	mux.HandleFunc("/trend", handleTrend(client))
+	mux.HandleFunc("/capacity", handleCapacity(client, a.periods))
+	mux.HandleFunc("/period", handlePeriod(client, a.periods))
+	mux.HandleFunc("/changes", handleChanges(client, a.periods))
+	mux.HandleFunc("/saliency", handleSaliency(client))
+	mux.HandleFunc("/discords", handleDiscords(client))
+	mux.HandleFunc("/bocpd", handleBOCPD(tracker))
+	mux.HandleFunc("/quantiles", handleQuantiles(streams))
+	mux.HandleFunc("/metrics", handleFindMetrics(index))
+	mux.HandleFunc("/anomalies", handleAnomalies(a))
+	mux.HandleFunc("/skipped", handleSkipped(a))
+	mux.HandleFunc("/correlations", handleCorrelations(client, index, a))
+	mux.HandleFunc("/triggers", handleTriggers(a.triggers))
+	mux.HandleFunc("/stats", handleStats(stats))
+	logger.Println("serving query API on", addr)
+	logger.Println(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestLastParam(t *testing.T) {
+	for s, want := range map[string]int64{"": fullDuration, "3600": 3600, "864000": fullDuration} {
+		if got, err := lastParam(url.Values{"last": {s}}); err != nil || got != want {
+			t.Fatal("lastParam() should read", s, "as", want, "but returned", got, err)
+		}
+	}
+	for _, s := range []string{"0", "-60", "x"} {
+		if _, err := lastParam(url.Values{"last": {s}}); err == nil {
+			t.Fatal("lastParam() should have rejected", s)
+		}
+	}
+}
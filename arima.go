@@ -0,0 +1,300 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// arimaMaxP, arimaMaxD and arimaMaxQ bound the orders of the models
+	// tried for each series.
+	arimaMaxP = 3
+	arimaMaxD = 2
+	arimaMaxQ = 2
+	// arimaMinPoints is the fewest datapoints an ARIMA model is fitted to.
+	arimaMinPoints = 50
+	// arimaMaxPoints is the most datapoints an ARIMA model is fitted to, as
+	// each series is fitted with every order up to the maximums above.
+	arimaMaxPoints = 1440
+	// arimaThreshold is how many residual standard deviations the latest
+	// datapoint may be from its one-step-ahead forecast.
+	arimaThreshold = 3.0
+)
+
+// difference returns the first differences of x.
+func difference(x []float64) []float64 {
+	if len(x) < 2 {
+		return nil
+	}
+	out := make([]float64, len(x)-1)
+	for i := range out {
+		out[i] = x[i+1] - x[i]
+	}
+	return out
+}
+
+// adfStatistic returns the augmented Dickey-Fuller t statistic of x with a
+// constant and lags lagged differences: the t statistic of γ in the
+// regression Δx[t] = c + γx[t-1] + Σ δ[i]Δx[t-i]. It reports false when the
+// regression cannot be fitted.
+func adfStatistic(x []float64, lags int) (float64, bool) {
+	dx := difference(x)
+	var rows [][]float64
+	var y []float64
+	for t := lags; t < len(dx); t++ {
+		row := []float64{1, x[t]}
+		for i := 1; i <= lags; i++ {
+			row = append(row, dx[t-i])
+		}
+		rows = append(rows, row)
+		y = append(y, dx[t])
+	}
+	if len(y) == 0 {
+		return 0, false
+	}
+	fit, ok := ols(rows, y)
+	if !ok || fit.stderr[1] == 0 {
+		return 0, false
+	}
+	return fit.coef[1] / fit.stderr[1], true
+}
+
+// stationary reports whether the augmented Dickey-Fuller test rejects a unit
+// root in x at the 5% level, using Schwert's rule for the number of lags and
+// MacKinnon's finite sample critical value for a regression with a constant.
+// A constant series counts as stationary.
+func stationary(x []float64) bool {
+	n := float64(len(x))
+	lags := int(12 * math.Pow(n/100, 0.25))
+	if lags > len(x)/4 {
+		lags = len(x) / 4
+	}
+	stat, ok := adfStatistic(x, lags)
+	if !ok {
+		return variance(x) == 0
+	}
+	return stat < -2.8621-2.738/n-8.36/(n*n)
+}
+
+// arimaModel is an ARIMA(p,d,q) model fitted to a series: after d
+// differences and removal of their mean the series follows
+// z[t] = Σ ar[i]z[t-1-i] + Σ ma[j]a[t-1-j] + a[t].
+type arimaModel struct {
+	p, d, q int
+	ar, ma  []float64
+	mean    float64
+	sigma   float64 // standard deviation of the innovations a[t]
+	aic     float64
+
+	// residuals are the one-step-ahead forecast errors over the series, and
+	// next is the forecast of the datapoint following it.
+	residuals []float64
+	next      float64
+}
+
+// cssResiduals returns the innovations of z under the given coefficients,
+// conditional on the first len(ar) values and on zero innovations before
+// them.
+func cssResiduals(z, ar, ma []float64) []float64 {
+	a := make([]float64, len(z))
+	for t := len(ar); t < len(z); t++ {
+		e := z[t]
+		for i, phi := range ar {
+			e -= phi * z[t-1-i]
+		}
+		for j, theta := range ma {
+			if t-1-j >= 0 {
+				e -= theta * a[t-1-j]
+			}
+		}
+		a[t] = e
+	}
+	return a
+}
+
+// invertible reports whether the moving average part with coefficients ma is
+// invertible, that is whether every root of 1 + ma[0]B + ... + ma[q-1]B^q
+// lies outside the unit circle, by the Schur-Cohn step-down test on the
+// reversed polynomial.
+func invertible(ma []float64) bool {
+	a := append([]float64{1}, ma...)
+	for k := len(ma); k >= 1; k-- {
+		kappa := a[k]
+		if math.Abs(kappa) >= 1 {
+			return false
+		}
+		next := make([]float64, k)
+		for i := range next {
+			next[i] = (a[i] - kappa*a[k-i]) / (1 - kappa*kappa)
+		}
+		a = next
+	}
+	return true
+}
+
+// fitARMA fits an ARMA(p,q) model to z, which has zero mean, by the
+// Hannan-Rissanen procedure: the innovations are estimated as the residuals
+// of a long autoregression, and z regressed on its own lags and the lags of
+// those. It reports false when the regressions cannot be fitted or the
+// model is not invertible.
+func fitARMA(z []float64, p, q int) (ar, ma, residuals []float64, ok bool) {
+	n := len(z)
+	var innovations []float64
+	start := p
+	if q > 0 {
+		long := int(math.Max(float64(p+q), math.Min(20, float64(n)/10)))
+		var rows [][]float64
+		var y []float64
+		for t := long; t < n; t++ {
+			row := make([]float64, long)
+			for i := range row {
+				row[i] = z[t-1-i]
+			}
+			rows = append(rows, row)
+			y = append(y, z[t])
+		}
+		if len(y) == 0 {
+			return nil, nil, nil, false
+		}
+		fit, ok := ols(rows, y)
+		if !ok {
+			return nil, nil, nil, false
+		}
+		innovations = make([]float64, n)
+		copy(innovations[long:], fit.residuals)
+		if long+q > start {
+			start = long + q
+		}
+	}
+
+	if p+q > 0 {
+		var rows [][]float64
+		var y []float64
+		for t := start; t < n; t++ {
+			row := make([]float64, 0, p+q)
+			for i := 1; i <= p; i++ {
+				row = append(row, z[t-i])
+			}
+			for j := 1; j <= q; j++ {
+				row = append(row, innovations[t-j])
+			}
+			rows = append(rows, row)
+			y = append(y, z[t])
+		}
+		if len(y) == 0 {
+			return nil, nil, nil, false
+		}
+		fit, ok := ols(rows, y)
+		if !ok {
+			return nil, nil, nil, false
+		}
+		ar, ma = fit.coef[:p], fit.coef[p:]
+		if !invertible(ma) {
+			return nil, nil, nil, false
+		}
+	}
+
+	residuals = cssResiduals(z, ar, ma)
+	for _, e := range residuals {
+		if unDef(e) || math.Abs(e) > 1e12 {
+			return nil, nil, nil, false
+		}
+	}
+	return ar, ma, residuals, true
+}
+
+// fitARIMA fits an ARIMA model to series. The series is differenced until the
+// augmented Dickey-Fuller test finds it stationary, at most arimaMaxD times,
+// and the orders p and q are those with the lowest Akaike information
+// criterion. It reports false when no model could be fitted.
+func fitARIMA(series []float64) (arimaModel, bool) {
+	levels := [][]float64{series}
+	for len(levels)-1 < arimaMaxD && !stationary(levels[len(levels)-1]) {
+		levels = append(levels, difference(levels[len(levels)-1]))
+	}
+	d := len(levels) - 1
+	w := levels[d]
+	if len(w) < arimaMinPoints/2 {
+		return arimaModel{}, false
+	}
+	mu := mean(w)
+	z := make([]float64, len(w))
+	for i, v := range w {
+		z[i] = v - mu
+	}
+
+	var best arimaModel
+	found := false
+	for p := 0; p <= arimaMaxP; p++ {
+		for q := 0; q <= arimaMaxQ; q++ {
+			ar, ma, residuals, ok := fitARMA(z, p, q)
+			if !ok {
+				continue
+			}
+			var sse float64
+			for _, e := range residuals[p:] {
+				sse += e * e
+			}
+			count := float64(len(z) - p)
+			params := float64(p + q + 1)
+			if sse <= 0 || count <= params {
+				continue
+			}
+			aic := count*math.Log(sse/count) + 2*params
+			if !found || aic < best.aic {
+				best = arimaModel{
+					p: p, d: d, q: q, ar: ar, ma: ma, mean: mu,
+					sigma:     math.Sqrt(sse / (count - params)),
+					aic:       aic,
+					residuals: residuals,
+				}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return arimaModel{}, false
+	}
+
+	// Forecast the next differenced value and integrate it back.
+	n := len(z)
+	next := mu
+	for i, phi := range best.ar {
+		next += phi * z[n-1-i]
+	}
+	for j, theta := range best.ma {
+		next += theta * best.residuals[n-1-j]
+	}
+	for k := d - 1; k >= 0; k-- {
+		next += levels[k][len(levels[k])-1]
+	}
+	best.next = next
+	return best, true
+}
+
+// ArimaDeviation function
+// A timeseries is anomalous if its latest datapoint is more than
+// arimaThreshold innovation standard deviations from the one-step-ahead
+// forecast of an ARIMA model fitted to the last day before it. Unlike
+// leastSquares this follows series whose values depend on their recent past,
+// such as resource usage.
+func arimaDeviation(ts Measurements) bool {
+	x := arimaWindow(ts)
+	if len(x) < arimaMinPoints+1 {
+		return false
+	}
+	model, ok := fitARIMA(x[:len(x)-1])
+	if !ok || model.sigma == 0 {
+		return false
+	}
+	return math.Abs(x[len(x)-1]-model.next) > arimaThreshold*model.sigma
+}
+
+// arimaWindow returns the values ARIMA models are fitted to: the last day of
+// ts, and of that at most the last arimaMaxPoints datapoints.
+func arimaWindow(ts Measurements) []float64 {
+	x := lastDuration(ts, fullDuration).values()
+	if len(x) > arimaMaxPoints {
+		x = x[len(x)-arimaMaxPoints:]
+	}
+	return x
+}
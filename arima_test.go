@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// ar1Series returns n datapoints a minute apart, ending now, of a first
+// order autoregressive process around 50.
+func ar1Series(n int, phi float64, seed int64) Measurements {
+	rnd := rand.New(rand.NewSource(seed))
+	now := time.Now().Unix()
+	var ts Measurements
+	z := 0.0
+	for i := 0; i < n; i++ {
+		z = phi*z + rnd.NormFloat64()
+		ts = append(ts, Measurement{50 + z, now - int64(n-1-i)*60})
+	}
+	return ts
+}
+
+func TestOLS(t *testing.T) {
+	var x [][]float64
+	var y []float64
+	for i := 0; i < 10; i++ {
+		x = append(x, []float64{1, float64(i)})
+		y = append(y, 3+2*float64(i))
+	}
+	fit, ok := ols(x, y)
+	if !ok || round(fit.coef[0], 6) != 3 || round(fit.coef[1], 6) != 2 {
+		t.Fatal("ols() should recover the intercept and slope of a line but returned", fit.coef)
+	}
+	if _, ok := ols([][]float64{{1, 1}, {2, 2}, {3, 3}}, []float64{1, 2, 3}); ok {
+		t.Fatal("ols() should refuse collinear regressors")
+	}
+}
+
+func TestStationary(t *testing.T) {
+	if !stationary(ar1Series(500, 0.5, 1).values()) {
+		t.Fatal("stationary() should find an autoregressive series stationary")
+	}
+	if stationary(ar1Series(500, 1, 1).values()) {
+		t.Fatal("stationary() should find a random walk has a unit root")
+	}
+}
+
+func TestFitARIMA(t *testing.T) {
+	model, ok := fitARIMA(ar1Series(1000, 0.7, 2).values())
+	if !ok {
+		t.Fatal("fitARIMA() should fit an autoregressive series")
+	}
+	if model.d != 0 || model.p < 1 || math.Abs(model.ar[0]-0.7) > 0.15 {
+		t.Fatal("fitARIMA() should find AR coefficient 0.7 without differencing but found", model.p, model.d, model.q, model.ar, model.ma)
+	}
+	if math.Abs(model.sigma-1) > 0.1 {
+		t.Fatal("fitARIMA() should estimate the innovation deviation as 1 but found", model.sigma)
+	}
+
+	walk, ok := fitARIMA(ar1Series(1000, 1, 3).values())
+	if !ok || walk.d != 1 {
+		t.Fatal("fitARIMA() should difference a random walk once but found d", walk.d)
+	}
+	series := ar1Series(1000, 1, 3).values()
+	if math.Abs(walk.next-series[len(series)-1]) > 3 {
+		t.Fatal("fitARIMA() should forecast a random walk near its last value but forecast", walk.next)
+	}
+}
+
+func TestArimaDeviation(t *testing.T) {
+	ts := ar1Series(300, 0.8, 4)
+	if arimaDeviation(ts) {
+		t.Fatal("arimaDeviation() should not flag an ordinary datapoint")
+	}
+	ts[len(ts)-1].value += 10
+	if !arimaDeviation(ts) {
+		t.Fatal("arimaDeviation() should flag a datapoint far from its forecast")
+	}
+	if arimaDeviation(ts[:20]) {
+		t.Fatal("arimaDeviation() should not flag a short series")
+	}
+}
+
+func TestArimaWindow(t *testing.T) {
+	var ts Measurements
+	for i := 0; i < 5000; i++ {
+		ts = append(ts, Measurement{float64(i), int64(i * 10)})
+	}
+	if x := arimaWindow(ts); len(x) != arimaMaxPoints || x[len(x)-1] != 4999 {
+		t.Fatal("arimaWindow() should keep the last", arimaMaxPoints, "datapoints but kept", len(x))
+	}
+	if x := arimaWindow(ar1Series(300, 0.8, 4)); len(x) != 300 {
+		t.Fatal("arimaWindow() should keep a short series whole but kept", len(x))
+	}
+}
+
+func TestInvertible(t *testing.T) {
+	for _, ma := range [][]float64{nil, {0.5}, {-0.9}, {0.5, 0.3}, {-1.2, 0.5}} {
+		if !invertible(ma) {
+			t.Fatal("invertible() should accept", ma)
+		}
+	}
+	for _, ma := range [][]float64{{1}, {1.5}, {0.2, -1.1}, {-1.5, 0.5}} {
+		if invertible(ma) {
+			t.Fatal("invertible() should refuse", ma)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync"
+)
+
+const (
+	// bocpdWarmup is the number of datapoints used to set the prior before
+	// a detector starts reporting.
+	bocpdWarmup = 10
+	// bocpdRecent is the run length below which a change is considered to
+	// have just happened.
+	bocpdRecent = 5
+)
+
+// bocpd is a Bayesian online change point detector (Adams & MacKay 2007)
+// for a series of independent normal datapoints whose mean and variance,
+// drawn from a Normal-Gamma prior, change at times governed by a constant
+// hazard. It keeps the posterior distribution of the run length, the number
+// of datapoints since the last change, and the posterior parameters for each
+// run length. Run lengths beyond maxRunLength are folded into the longest so
+// that every update takes constant time.
+type bocpd struct {
+	mu           sync.Mutex
+	hazard       float64
+	maxRunLength int
+
+	warmup []float64
+	prior  normalGamma
+	probs  []float64
+	params []normalGamma
+	seen   int
+}
+
+type normalGamma struct {
+	mu, kappa, alpha, beta float64
+}
+
+// update returns the posterior after observing x.
+func (p normalGamma) update(x float64) normalGamma {
+	return normalGamma{
+		mu:    (p.kappa*p.mu + x) / (p.kappa + 1),
+		kappa: p.kappa + 1,
+		alpha: p.alpha + 0.5,
+		beta:  p.beta + p.kappa*(x-p.mu)*(x-p.mu)/(2*(p.kappa+1)),
+	}
+}
+
+// predictive returns the density of x under the posterior predictive, a
+// Student's t distribution.
+func (p normalGamma) predictive(x float64) float64 {
+	df := 2 * p.alpha
+	scale := math.Sqrt(p.beta * (p.kappa + 1) / (p.alpha * p.kappa))
+	t := (x - p.mu) / scale
+	lg1, _ := math.Lgamma((df + 1) / 2)
+	lg2, _ := math.Lgamma(df / 2)
+	return math.Exp(lg1 - lg2 - 0.5*math.Log(df*math.Pi) - math.Log(scale) - (df+1)/2*math.Log1p(t*t/df))
+}
+
+// newBOCPD returns a detector expecting a change every expectedRunLength
+// datapoints.
+func newBOCPD(expectedRunLength float64, maxRunLength int) *bocpd {
+	return &bocpd{hazard: 1 / expectedRunLength, maxRunLength: maxRunLength}
+}
+
+// observe updates the detector with x. The first bocpdWarmup datapoints only
+// set the prior: its mean and its expected variance are theirs.
+func (b *bocpd) observe(x float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seen++
+	if b.probs == nil {
+		b.warmup = append(b.warmup, x)
+		if len(b.warmup) < bocpdWarmup {
+			return
+		}
+		v := variance(b.warmup)
+		if v == 0 {
+			v = math.Max(1e-6, math.Abs(mean(b.warmup))*1e-6)
+		}
+		b.prior = normalGamma{mu: mean(b.warmup), kappa: 1, alpha: 1, beta: v}
+		b.probs = []float64{1}
+		b.params = []normalGamma{b.prior}
+		for _, w := range b.warmup {
+			b.step(w)
+		}
+		b.warmup = nil
+		return
+	}
+	b.step(x)
+}
+
+func (b *bocpd) step(x float64) {
+	n := len(b.probs)
+	probs := make([]float64, n+1)
+	var total float64
+	for r, p := range b.probs {
+		weighted := p * b.params[r].predictive(x)
+		probs[r+1] = weighted * (1 - b.hazard)
+		probs[0] += weighted * b.hazard
+	}
+	for _, p := range probs {
+		total += p
+	}
+	if total == 0 || unDef(total) {
+		// x is impossible under every run length: restart from the prior.
+		probs = []float64{1}
+		total = 1
+	}
+	for r := range probs {
+		probs[r] /= total
+	}
+
+	params := make([]normalGamma, len(probs))
+	params[0] = b.prior.update(x)
+	for r := 1; r < len(params); r++ {
+		params[r] = b.params[r-1].update(x)
+	}
+	if len(probs) > b.maxRunLength {
+		probs[b.maxRunLength-1] += probs[b.maxRunLength]
+		probs, params = probs[:b.maxRunLength], params[:b.maxRunLength]
+	}
+	b.probs, b.params = probs, params
+}
+
+// bocpdState is a snapshot of a detector.
+type bocpdState struct {
+	Ready             bool      `json:"ready"`
+	RunLength         int       `json:"runLength"`
+	ChangeProbability float64   `json:"changeProbability"`
+	Posterior         []float64 `json:"posterior"`
+}
+
+// state returns the run length posterior, its most likely run length and
+// the probability that the series changed within the last bocpdRecent
+// datapoints. A detector is not ready until its warmup is over and it has
+// seen enough datapoints for a recent change to be distinguishable.
+func (b *bocpd) state() bocpdState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := bocpdState{Posterior: append([]float64(nil), b.probs...)}
+	if b.probs == nil {
+		return s
+	}
+	s.ChangeProbability, s.Ready = b.recentChange()
+	best := -1.0
+	for r, p := range b.probs {
+		if p > best {
+			s.RunLength, best = r, p
+		}
+	}
+	return s
+}
+
+// changeProbability returns the probability of a change within the last
+// bocpdRecent datapoints and whether the detector is ready, without copying
+// the posterior as state does.
+func (b *bocpd) changeProbability() (float64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.recentChange()
+}
+
+// recentChange sums the posterior over the recent run lengths. The caller
+// must hold b.mu.
+func (b *bocpd) recentChange() (float64, bool) {
+	if b.probs == nil {
+		return 0, false
+	}
+	p := 0.0
+	for r := 0; r < bocpdRecent && r < len(b.probs); r++ {
+		p += b.probs[r]
+	}
+	return p, b.seen >= bocpdWarmup+bocpdRecent
+}
+
+// changeTracker runs a bocpd detector for each ingested metric selected by
+// query, and logs an anomaly when the probability of a recent change crosses
+// threshold. Each detector holds maxRunLength run lengths, so tracking is
+// limited to the metrics that need it. A nil changeTracker tracks nothing.
+type changeTracker struct {
+	query             metricQuery
+	expectedRunLength float64
+	maxRunLength      int
+	threshold         float64
+	logger            *log.Logger
+
+	mu        sync.Mutex
+	detectors map[string]*bocpd // nil for metrics that are not tracked
+	alarmed   map[string]bool
+}
+
+func newChangeTracker(query metricQuery, expectedRunLength float64, maxRunLength int, threshold float64, logger *log.Logger) *changeTracker {
+	return &changeTracker{
+		query:             query,
+		expectedRunLength: expectedRunLength,
+		maxRunLength:      maxRunLength,
+		threshold:         threshold,
+		logger:            logger,
+		detectors:         make(map[string]*bocpd),
+		alarmed:           make(map[string]bool),
+	}
+}
+
+func (c *changeTracker) detector(name string) *bocpd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.detectors[name]
+	if !ok {
+		if selected, err := c.query.matches(name); err == nil && selected {
+			d = newBOCPD(c.expectedRunLength, c.maxRunLength)
+		}
+		c.detectors[name] = d
+	}
+	return d
+}
+
+// observe feeds a newly received datapoint to the metric's detector. NaN
+// and infinite values are skipped, as the detector would read them as a
+// change.
+func (c *changeTracker) observe(name string, m Measurement) {
+	if c == nil || unDef(m.value) {
+		return
+	}
+	d := c.detector(name)
+	if d == nil {
+		return
+	}
+	d.observe(m.value)
+	probability, ready := d.changeProbability()
+	changed := ready && probability > c.threshold
+
+	c.mu.Lock()
+	wasChanged := c.alarmed[name]
+	c.alarmed[name] = changed
+	c.mu.Unlock()
+	if changed && !wasChanged {
+		c.logger.Println("anomaly: change point in", name, "at", m.timestamp, "with probability", probability)
+	}
+}
+
+// state returns the state of the metric's detector, if it is tracked.
+func (c *changeTracker) state(name string) (bocpdState, bool) {
+	if c == nil {
+		return bocpdState{}, false
+	}
+	c.mu.Lock()
+	d := c.detectors[name]
+	c.mu.Unlock()
+	if d == nil {
+		return bocpdState{}, false
+	}
+	return d.state(), true
+}
+
+// forget drops the detector of a removed metric.
+func (c *changeTracker) forget(name string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.detectors, name)
+	delete(c.alarmed, name)
+}
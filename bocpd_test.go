@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestBOCPD(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	b := newBOCPD(250, 500)
+	for i := 0; i < 200; i++ {
+		b.observe(10 + rnd.NormFloat64())
+		if s := b.state(); s.Ready && s.ChangeProbability > 0.5 {
+			t.Fatal("bocpd should not detect a change in a stationary series but did at", i, s.ChangeProbability)
+		}
+	}
+	if s := b.state(); s.RunLength < 150 {
+		t.Fatal("bocpd should find a long run in a stationary series but found", s.RunLength)
+	}
+
+	detected := -1
+	for i := 0; i < 50; i++ {
+		b.observe(15 + rnd.NormFloat64())
+		if s := b.state(); detected < 0 && s.ChangeProbability > 0.5 {
+			detected = i
+		}
+	}
+	if detected < 0 || detected > 5 {
+		t.Fatal("bocpd should detect the shift in mean within a few datapoints but detected it at", detected)
+	}
+	if s := b.state(); s.RunLength < 40 || s.RunLength > 55 {
+		t.Fatal("bocpd should find a run starting at the shift but found", s.RunLength)
+	}
+
+	short := newBOCPD(250, 20)
+	for i := 0; i < 100; i++ {
+		short.observe(rnd.NormFloat64())
+	}
+	if s := short.state(); len(s.Posterior) != 20 || s.RunLength != 19 {
+		t.Fatal("bocpd should fold long runs into its maximum run length but returned", s)
+	}
+}
+
+func TestChangeTracker(t *testing.T) {
+	var out bytes.Buffer
+	c := newChangeTracker(metricQuery{Glob: "web.*"}, 250, 500, 0.5, log.New(&out, "", 0))
+	for i := 0; i < 100; i++ {
+		v := 10.0 + float64(i%3)
+		if i >= 50 {
+			v += 20
+		}
+		c.observe("web.cpu", Measurement{v, int64(i)})
+		c.observe("db.cpu", Measurement{v, int64(i)})
+	}
+	if strings.Count(out.String(), "anomaly: change point in web.cpu") != 1 {
+		t.Fatal("changeTracker should report the change once but logged", out.String())
+	}
+	if _, ok := c.state("db.cpu"); ok {
+		t.Fatal("changeTracker should not track metrics outside its query")
+	}
+	c.forget("web.cpu")
+	if _, ok := c.state("web.cpu"); ok {
+		t.Fatal("changeTracker should forget removed metrics")
+	}
+	for i := 0; i < 100; i++ {
+		c.observe("web.load", Measurement{10 + float64(i%3), int64(i)})
+	}
+	before, _ := c.state("web.load")
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		c.observe("web.load", Measurement{v, 100})
+	}
+	if s, _ := c.state("web.load"); s.RunLength != before.RunLength || strings.Contains(out.String(), "web.load") {
+		t.Fatal("changeTracker should skip non-finite values but moved the run length from", before.RunLength, "to", s.RunLength)
+	}
+	var nilTracker *changeTracker
+	nilTracker.observe("web.cpu", Measurement{1, 1})
+}
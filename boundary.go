@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// boundaryRule is a static limit on the metrics matching a glob, checked
+// against their latest datapoint alongside the algorithms, in the manner of
+// Skyline's Boundary. Unset limits are nil.
+type boundaryRule struct {
+	text     string
+	query    metricQuery
+	min, max *float64
+	// rate is the largest change per second allowed between the two latest
+	// datapoints, in either direction.
+	rate    *float64
+	nonZero bool
+}
+
+// breaches returns the names of the limits the latest datapoint of ts
+// breaks: boundaryMin, boundaryMax, boundaryRate and boundaryNonZero.
+func (r boundaryRule) breaches(ts Measurements) []string {
+	if len(ts) == 0 {
+		return nil
+	}
+	latest := ts[len(ts)-1]
+	var broken []string
+	if r.min != nil && latest.value < *r.min {
+		broken = append(broken, "boundaryMin")
+	}
+	if r.max != nil && latest.value > *r.max {
+		broken = append(broken, "boundaryMax")
+	}
+	if r.rate != nil && len(ts) > 1 {
+		prev := ts[len(ts)-2]
+		if dt := latest.timestamp - prev.timestamp; dt > 0 && math.Abs(latest.value-prev.value)/float64(dt) > *r.rate {
+			broken = append(broken, "boundaryRate")
+		}
+	}
+	if r.nonZero && latest.value == 0 {
+		broken = append(broken, "boundaryNonZero")
+	}
+	return broken
+}
+
+// boundaryRules collects the boundary rules given on the command line, one
+// per flag, as glob:limit,limit... where each limit is min=X, max=X, rate=X
+// or nonzero, e.g. disk.*.used_percent:max=90 or web*.requests:nonzero.
+type boundaryRules []boundaryRule
+
+func (rules *boundaryRules) String() string {
+	var parts []string
+	for _, r := range *rules {
+		parts = append(parts, r.text)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (rules *boundaryRules) Set(s string) error {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("bad boundary %q, want glob:limit,limit", s)
+	}
+	glob := s[:i]
+	for _, pattern := range strings.Split(glob, ".") {
+		for _, alt := range expandBraces(pattern) {
+			if _, err := path.Match(alt, ""); err != nil {
+				return fmt.Errorf("bad glob %q: %v", glob, err)
+			}
+		}
+	}
+	r := boundaryRule{text: s, query: metricQuery{Glob: glob}}
+	for _, limit := range strings.Split(s[i+1:], ",") {
+		if limit == "nonzero" {
+			r.nonZero = true
+			continue
+		}
+		parts := strings.SplitN(limit, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("bad limit %q in boundary %q", limit, s)
+		}
+		v, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return fmt.Errorf("bad limit %q in boundary %q: %v", limit, s, err)
+		}
+		switch parts[0] {
+		case "min":
+			r.min = &v
+		case "max":
+			r.max = &v
+		case "rate":
+			r.rate = &v
+		default:
+			return fmt.Errorf("unknown limit %q in boundary %q, want min, max, rate or nonzero", parts[0], s)
+		}
+	}
+	*rules = append(*rules, r)
+	return nil
+}
+
+// check returns the limits of every rule matching the named metric that its
+// latest datapoint breaks, each named once.
+func (rules boundaryRules) check(name string, ts Measurements) []string {
+	var broken []string
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		if ok, err := r.query.matches(name); err != nil || !ok {
+			continue
+		}
+		for _, b := range r.breaches(ts) {
+			if !seen[b] {
+				seen[b] = true
+				broken = append(broken, b)
+			}
+		}
+	}
+	return broken
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestBoundaryRules(t *testing.T) {
+	var rules boundaryRules
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&rules, "boundary", "")
+	err := fs.Parse([]string{
+		"-boundary", "disk.*.used:max=90,rate=0.5",
+		"-boundary", "disk.{sda,sdb}.used:min=1,nonzero",
+	})
+	if err != nil || len(rules) != 2 {
+		t.Fatal("boundaryRules should parse glob:limit,... but failed", err)
+	}
+	for _, bad := range []string{"disk.*.used", "disk.*.used:", ":max=1", "disk.*.used:max", "disk.*.used:max=x", "disk.*.used:avg=1", "disk.[.used:max=1"} {
+		if rules.Set(bad) == nil {
+			t.Fatal("boundaryRules should refuse", bad)
+		}
+	}
+
+	ts := Measurements{{50, 0}, {95, 60}}
+	if got := rules.check("disk.sdc.used", ts); !reflect.DeepEqual(got, []string{"boundaryMax", "boundaryRate"}) {
+		t.Fatal("check() should find the maximum and rate broken but found", got)
+	}
+	ts = Measurements{{1, 0}, {0, 60}}
+	if got := rules.check("disk.sda.used", ts); !reflect.DeepEqual(got, []string{"boundaryMin", "boundaryNonZero"}) {
+		t.Fatal("check() should find the minimum and non-zero limits broken but found", got)
+	}
+	if got := rules.check("disk.sdc.used", ts); got != nil {
+		t.Fatal("check() should only apply the rules matching the metric but found", got)
+	}
+	if got := rules.check("cpu.user", Measurements{{1000, 0}}); got != nil {
+		t.Fatal("check() should not apply rules to other metrics but found", got)
+	}
+	if got := rules.check("disk.sda.used", nil); got != nil {
+		t.Fatal("check() should find nothing broken without data but found", got)
+	}
+}
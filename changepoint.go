@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// changePointPenalty is the cost of adding a change point, as a multiple of
+// the log of the number of datapoints. The default of 3 is the BIC penalty
+// for a change in both mean and variance. It is set from the command line.
+var changePointPenalty = 3.0
+
+// fastChangePoints selects binarySegmentation over pelt for the change points
+// reported by the analyzer. It is set from the command line.
+var fastChangePoints bool
+
+// minSegment is the fewest datapoints between change points.
+const minSegment = 5
+
+// segmentCost gives the cost of fitting a normal distribution, with its own
+// mean and variance, to any segment of a series in constant time from
+// cumulative sums. The cost is twice the negative log likelihood, up to a
+// constant: the segment length times the log of its variance.
+type segmentCost struct {
+	sum, sumSq []float64
+	floor      float64
+}
+
+func newSegmentCost(x []float64) *segmentCost {
+	c := &segmentCost{sum: make([]float64, len(x)+1), sumSq: make([]float64, len(x)+1)}
+	for i, v := range x {
+		c.sum[i+1] = c.sum[i] + v
+		c.sumSq[i+1] = c.sumSq[i] + v*v
+	}
+	// Keep constant segments from having an infinitely negative cost.
+	c.floor = 1e-8*variance(x) + 1e-300
+	return c
+}
+
+// cost returns the cost of the segment x[start:end].
+func (c *segmentCost) cost(start, end int) float64 {
+	n := float64(end - start)
+	m := (c.sum[end] - c.sum[start]) / n
+	v := (c.sumSq[end]-c.sumSq[start])/n - m*m
+	return n * math.Log(math.Max(v, c.floor))
+}
+
+// PELT function
+// Pruned Exact Linear Time search (Killick et al. 2012) for the change points
+// in mean and variance of x minimizing the total segment cost plus penalty
+// for every change point. It returns the index at which each new segment
+// starts.
+func pelt(x []float64, penalty float64, minSize int) []int {
+	n := len(x)
+	if n < 2*minSize {
+		return nil
+	}
+	c := newSegmentCost(x)
+	best := make([]float64, n+1)
+	last := make([]int, n+1)
+	best[0] = -penalty
+	for t := 1; t < minSize; t++ {
+		best[t] = math.Inf(1)
+	}
+	candidates := []int{0}
+	for t := minSize; t <= n; t++ {
+		best[t] = math.Inf(1)
+		costs := make([]float64, len(candidates))
+		for i, s := range candidates {
+			costs[i] = best[s] + c.cost(s, t)
+			if f := costs[i] + penalty; f < best[t] {
+				best[t], last[t] = f, s
+			}
+		}
+		// Drop candidates that can never again be the last change point.
+		kept := candidates[:0]
+		for i, s := range candidates {
+			if costs[i] <= best[t] {
+				kept = append(kept, s)
+			}
+		}
+		candidates = kept
+		if next := t - minSize + 1; !math.IsInf(best[next], 1) {
+			candidates = append(candidates, next)
+		}
+	}
+
+	var changes []int
+	for t := last[n]; t > 0; t = last[t] {
+		changes = append(changes, t)
+	}
+	sort.Ints(changes)
+	return changes
+}
+
+// BinarySegmentation function
+// Finds change points in mean and variance by splitting x where the split
+// most reduces the segment cost, as long as the reduction exceeds penalty,
+// and then splitting each half in the same way. It is faster than pelt but
+// not guaranteed to find the optimal segmentation.
+func binarySegmentation(x []float64, penalty float64, minSize int) []int {
+	c := newSegmentCost(x)
+	var changes []int
+	var split func(start, end int)
+	split = func(start, end int) {
+		if end-start < 2*minSize {
+			return
+		}
+		whole := c.cost(start, end)
+		bestAt, bestGain := -1, penalty
+		for t := start + minSize; t <= end-minSize; t++ {
+			if gain := whole - c.cost(start, t) - c.cost(t, end); gain > bestGain {
+				bestAt, bestGain = t, gain
+			}
+		}
+		if bestAt < 0 {
+			return
+		}
+		changes = append(changes, bestAt)
+		split(start, bestAt)
+		split(bestAt, end)
+	}
+	split(0, len(x))
+	sort.Ints(changes)
+	return changes
+}
+
+// changePoints returns the timestamps at which the mean or variance of ts
+// changed, found with pelt or, when fast is set, binarySegmentation.
+func changePoints(ts Measurements, fast bool) []int64 {
+	x := ts.values()
+	if len(x) < 2 {
+		return nil
+	}
+	penalty := changePointPenalty * math.Log(float64(len(x)))
+	var indexes []int
+	if fast {
+		indexes = binarySegmentation(x, penalty, minSegment)
+	} else {
+		indexes = pelt(x, penalty, minSegment)
+	}
+	timestamps := make([]int64, len(indexes))
+	for i, idx := range indexes {
+		timestamps[i] = ts[idx].timestamp
+	}
+	return timestamps
+}
+
+// lastDuration returns the datapoints of ts in the duration seconds up to its
+// latest datapoint.
+func lastDuration(ts Measurements, duration int64) Measurements {
+	if len(ts) == 0 {
+		return ts
+	}
+	since := ts[len(ts)-1].timestamp - duration
+	i := sort.Search(len(ts), func(i int) bool { return ts[i].timestamp >= since })
+	return ts[i:]
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// piecewiseSeries returns normal noise whose mean and standard deviation
+// change at the given indexes.
+func piecewiseSeries(n int, changes []int, means, stds []float64) []float64 {
+	rnd := rand.New(rand.NewSource(3))
+	var x []float64
+	segment := 0
+	for i := 0; i < n; i++ {
+		if segment < len(changes) && i == changes[segment] {
+			segment++
+		}
+		x = append(x, means[segment]+stds[segment]*rnd.NormFloat64())
+	}
+	return x
+}
+
+func nearly(got, want []int, tolerance int) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] < want[i]-tolerance || got[i] > want[i]+tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPELT(t *testing.T) {
+	x := piecewiseSeries(300, []int{100, 200}, []float64{0, 5, 5}, []float64{1, 1, 4})
+	penalty := 3 * 5.7 // about 3 log n
+	if changes := pelt(x, penalty, 5); !nearly(changes, []int{100, 200}, 5) {
+		t.Fatal("pelt() should find the mean and variance changes near 100 and 200 but found", changes)
+	}
+	if changes := pelt(piecewiseSeries(300, nil, []float64{0}, []float64{1}), penalty, 5); len(changes) != 0 {
+		t.Fatal("pelt() should find no change in stationary noise but found", changes)
+	}
+	if changes := pelt([]float64{1, 2, 3}, penalty, 5); changes != nil {
+		t.Fatal("pelt() should find nothing in a series shorter than two segments but found", changes)
+	}
+}
+
+func TestBinarySegmentation(t *testing.T) {
+	x := piecewiseSeries(300, []int{100, 200}, []float64{0, 5, 5}, []float64{1, 1, 4})
+	if changes := binarySegmentation(x, 3*5.7, 5); !nearly(changes, []int{100, 200}, 5) {
+		t.Fatal("binarySegmentation() should find the changes near 100 and 200 but found", changes)
+	}
+}
+
+func TestChangePoints(t *testing.T) {
+	var ts Measurements
+	for i, v := range piecewiseSeries(200, []int{120}, []float64{10, 20}, []float64{1, 1}) {
+		ts = append(ts, Measurement{v, int64(1000 + i*60)})
+	}
+	if changes := changePoints(ts, false); !reflect.DeepEqual(changes, []int64{1000 + 120*60}) {
+		t.Fatal("changePoints() should return the timestamp of the change but returned", changes)
+	}
+	if recent := lastDuration(ts, 600); len(recent) != 11 || recent[0].timestamp != ts[len(ts)-11].timestamp {
+		t.Fatal("lastDuration() should return the last 10 minutes of datapoints but returned", len(recent))
+	}
+}
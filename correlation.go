@@ -0,0 +1,309 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Defaults of the /correlations query parameters.
+const (
+	// correlationWindow is how many seconds either side of an anomaly are
+	// compared.
+	correlationWindow = 1800
+	// correlationShift is the most seconds by which a correlated metric may
+	// lead or lag the anomalous one.
+	correlationShift = 120
+	// correlationMinimum is the least absolute correlation coefficient of a
+	// metric that is reported.
+	correlationMinimum = 0.7
+)
+
+// maxCorrelationCandidates is the most metrics one /correlations request
+// compares with the anomalous one.
+const maxCorrelationCandidates = 10000
+
+// correlatedMetric is a metric that moved with an anomalous metric.
+type correlatedMetric struct {
+	Metric      string  `json:"metric"`
+	Coefficient float64 `json:"coefficient"` // Pearson correlation, negative when it moved the other way
+	// Shift is the number of seconds by which the metric's movement
+	// followed the anomalous metric's, negative when it came first.
+	Shift int64 `json:"shift"`
+}
+
+// resample averages the datapoints of ts into n buckets of step seconds from
+// start, interpolating linearly across empty buckets and carrying the
+// nearest value into empty buckets at either end. It returns nil when ts has
+// no datapoints in that range.
+func resample(ts Measurements, start, step int64, n int) []float64 {
+	sums := make([]float64, n)
+	counts := make([]int, n)
+	for _, m := range ts {
+		if m.timestamp < start {
+			continue
+		}
+		i := int((m.timestamp - start) / step)
+		if i >= n {
+			continue
+		}
+		sums[i] += m.value
+		counts[i]++
+	}
+	var filled []int
+	out := make([]float64, n)
+	for i := range out {
+		if counts[i] > 0 {
+			out[i] = sums[i] / float64(counts[i])
+			filled = append(filled, i)
+		}
+	}
+	if len(filled) == 0 {
+		return nil
+	}
+	for i := 0; i < filled[0]; i++ {
+		out[i] = out[filled[0]]
+	}
+	for i := filled[len(filled)-1] + 1; i < n; i++ {
+		out[i] = out[filled[len(filled)-1]]
+	}
+	for k := 1; k < len(filled); k++ {
+		left, right := filled[k-1], filled[k]
+		for i := left + 1; i < right; i++ {
+			frac := float64(i-left) / float64(right-left)
+			out[i] = out[left] + frac*(out[right]-out[left])
+		}
+	}
+	return out
+}
+
+// pearson returns the correlation coefficient of a and b, or 0 when either
+// is constant.
+func pearson(a, b []float64) float64 {
+	va, vb := variance(a), variance(b)
+	if va == 0 || vb == 0 {
+		return 0
+	}
+	return cov(a, b) / math.Sqrt(va*vb)
+}
+
+// laggedCorrelation returns the correlation of a and b, b shifted by at most
+// maxLag places either way, that is largest in absolute value, and the lag
+// at which it occurs: b[i+lag] is compared with a[i]. Only lags leaving at
+// least half of the values overlapping are tried.
+func laggedCorrelation(a, b []float64, maxLag int) (float64, int) {
+	n := len(a)
+	if maxLag > n/2 {
+		maxLag = n / 2
+	}
+	best, bestLag := 0.0, 0
+	for lag := -maxLag; lag <= maxLag; lag++ {
+		lo, hi := 0, n
+		if lag > 0 {
+			hi = n - lag
+		} else {
+			lo = -lag
+		}
+		if hi-lo < 3 {
+			continue
+		}
+		r := pearson(a[lo:hi], b[lo+lag:hi+lag])
+		if math.Abs(r) > math.Abs(best) || (math.Abs(r) == math.Abs(best) && abs(lag) < abs(bestLag)) {
+			best, bestLag = r, lag
+		}
+	}
+	return best, bestLag
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// correlator compares other metrics with an anomalous one around the time of
+// the anomaly, in the manner of Skyline's Luminosity. Every series is
+// resampled onto the same grid and its linear trend removed, so that metrics
+// merely drifting in the same direction do not count as moving together.
+type correlator struct {
+	start, step int64
+	target      []float64
+	maxLag      int
+	minimum     float64
+}
+
+// newCorrelator prepares to correlate metrics with ts over window seconds
+// either side of the timestamp at, allowing them to lead or lag by shift
+// seconds. It reports false when ts has too few datapoints in the window.
+func newCorrelator(ts Measurements, at, window, shift int64, minimum float64) (*correlator, bool) {
+	var inWindow Measurements
+	for _, m := range ts {
+		if m.timestamp >= at-window && m.timestamp <= at+window {
+			inWindow = append(inWindow, m)
+		}
+	}
+	step := samplingInterval(inWindow)
+	if step <= 0 {
+		return nil, false
+	}
+	n := int(2*window/step) + 1
+	if n < 6 {
+		return nil, false
+	}
+	c := &correlator{start: at - window, step: step, maxLag: int(shift / step), minimum: minimum}
+	c.target = detrend(resample(inWindow, c.start, step, n))
+	return c, variance(c.target) > 0
+}
+
+// span returns the first timestamp of the grid and the timestamp just past
+// its end, outside which datapoints play no part in the correlation.
+func (c *correlator) span() (int64, int64) {
+	return c.start, c.start + int64(len(c.target))*c.step
+}
+
+// correlate returns the lagged correlation of ts with the anomalous metric
+// and the shift in seconds at which it occurs, reporting false when it is
+// weaker than the minimum.
+func (c *correlator) correlate(ts Measurements) (float64, int64, bool) {
+	values := resample(ts, c.start, c.step, len(c.target))
+	if values == nil {
+		return 0, 0, false
+	}
+	r, lag := laggedCorrelation(c.target, detrend(values), c.maxLag)
+	if math.Abs(r) < c.minimum {
+		return 0, 0, false
+	}
+	return r, int64(lag) * c.step, true
+}
+
+// listBound is a binary search over a stored series for the index of its
+// first datapoint timestamped after some time.
+type listBound struct {
+	lo, hi int64
+	cmd    *redis.StringCmd // fetches the datapoint at the midpoint
+}
+
+// narrow halves the search given the datapoint at its midpoint, which the
+// bound lies after when it is timestamped at or before at.
+func (b *listBound) narrow(at int64) {
+	if b.cmd == nil {
+		return
+	}
+	mid := (b.lo + b.hi) / 2
+	if m, err := parseMeasurement(b.cmd.Val()); err != nil || m.timestamp <= at {
+		b.lo = mid + 1
+	} else {
+		b.hi = mid
+	}
+}
+
+// fetchRange fetches the datapoints of the named metrics timestamped from
+// from up to but not including to, a chunk of metrics at a time, and passes
+// each series with any to visit. The ends of the range are found by binary
+// search over each list, which holds its datapoints in the order they were
+// received, so that only the datapoints in range are transferred.
+func fetchRange(client redis.UniversalClient, names []string, from, to int64, visit func(string, Measurements)) error {
+	const chunk = 1000
+	for start := 0; start < len(names); start += chunk {
+		end := start + chunk
+		if end > len(names) {
+			end = len(names)
+		}
+		batch := names[start:end]
+
+		pipe := client.Pipeline()
+		lengths := make([]*redis.IntCmd, len(batch))
+		for i, name := range batch {
+			lengths[i] = pipe.LLen(ctx, metricKey(name))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return err
+		}
+		// first finds the first datapoint at or after from and last the
+		// first at or after to.
+		first := make([]listBound, len(batch))
+		last := make([]listBound, len(batch))
+		for i := range batch {
+			first[i].hi = lengths[i].Val()
+			last[i].hi = lengths[i].Val()
+		}
+		for {
+			pipe := client.Pipeline()
+			searching := false
+			for i, name := range batch {
+				for _, b := range []*listBound{&first[i], &last[i]} {
+					b.cmd = nil
+					if b.lo < b.hi {
+						b.cmd = pipe.LIndex(ctx, metricKey(name), (b.lo+b.hi)/2)
+						searching = true
+					}
+				}
+			}
+			if !searching {
+				break
+			}
+			if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+				return err
+			}
+			for i := range batch {
+				first[i].narrow(from - 1)
+				last[i].narrow(to - 1)
+			}
+		}
+
+		pipe = client.Pipeline()
+		cmds := make([]*redis.StringSliceCmd, len(batch))
+		fetching := false
+		for i, name := range batch {
+			if first[i].lo < last[i].lo {
+				cmds[i] = pipe.LRange(ctx, metricKey(name), first[i].lo, last[i].lo-1)
+				fetching = true
+			}
+		}
+		if !fetching {
+			continue
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return err
+		}
+		for i, cmd := range cmds {
+			if cmd == nil {
+				continue
+			}
+			raw, err := cmd.Result()
+			if err != nil {
+				continue
+			}
+			ts := make(Measurements, 0, len(raw))
+			for _, s := range raw {
+				if m, err := parseMeasurement(s); err == nil {
+					ts = append(ts, m)
+				}
+			}
+			visit(batch[i], ts)
+		}
+	}
+	return nil
+}
+
+// rankCorrelations returns the named metrics correlated with the anomalous
+// one, most strongly correlated first. Only the datapoints of each metric
+// within the correlator's span are fetched.
+func rankCorrelations(client redis.UniversalClient, names []string, c *correlator) ([]correlatedMetric, error) {
+	var ranked []correlatedMetric
+	from, to := c.span()
+	err := fetchRange(client, names, from, to, func(name string, ts Measurements) {
+		if r, shift, ok := c.correlate(ts); ok {
+			ranked = append(ranked, correlatedMetric{Metric: name, Coefficient: r, Shift: shift})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return math.Abs(ranked[i].Coefficient) > math.Abs(ranked[j].Coefficient)
+	})
+	return ranked, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestResample(t *testing.T) {
+	ts := Measurements{{1, 0}, {3, 5}, {5, 20}, {9, 45}}
+	got := resample(ts, 0, 10, 6)
+	want := []float64{2, 3.5, 5, 7, 9, 9}
+	for i := range want {
+		if round(got[i], 6) != want[i] {
+			t.Fatal("resample() should average and interpolate to", want, "but returned", got)
+		}
+	}
+	if resample(ts, 100, 10, 6) != nil {
+		t.Fatal("resample() should return nil for a range without datapoints")
+	}
+}
+
+func TestLaggedCorrelation(t *testing.T) {
+	rnd := rand.New(rand.NewSource(8))
+	a := make([]float64, 100)
+	for i := range a {
+		a[i] = rnd.NormFloat64()
+	}
+	// b follows a three places later, inverted.
+	b := make([]float64, 100)
+	for i := range b {
+		if i >= 3 {
+			b[i] = -a[i-3]
+		}
+	}
+	r, lag := laggedCorrelation(a, b, 5)
+	if lag != 3 || r > -0.9 {
+		t.Fatal("laggedCorrelation() should find b inverted three places later but returned", r, lag)
+	}
+	if r, _ := laggedCorrelation(a, b, 1); math.Abs(r) > 0.5 {
+		t.Fatal("laggedCorrelation() should not look past its maximum lag but returned", r)
+	}
+}
+
+func TestCorrelator(t *testing.T) {
+	rnd := rand.New(rand.NewSource(9))
+	var target, follower, unrelated, drifting Measurements
+	for i := 0; i < 240; i++ {
+		ts := int64(i * 60)
+		spike := 0.0
+		if i >= 100 && i < 110 {
+			spike = 20
+		}
+		target = append(target, Measurement{50 + spike + rnd.NormFloat64(), ts})
+		// The follower spikes two minutes later and is sampled off the grid.
+		lagged := 0.0
+		if i >= 102 && i < 112 {
+			lagged = 10
+		}
+		follower = append(follower, Measurement{5 + lagged + 0.5*rnd.NormFloat64(), ts + 7})
+		unrelated = append(unrelated, Measurement{rnd.NormFloat64(), ts})
+		drifting = append(drifting, Measurement{float64(i) + rnd.NormFloat64(), ts})
+	}
+	c, ok := newCorrelator(target, 105*60, 3600, 180, 0.7)
+	if !ok {
+		t.Fatal("newCorrelator() should accept a varying series")
+	}
+	r, shift, ok := c.correlate(follower)
+	if !ok || r < 0.9 || shift != 120 {
+		t.Fatal("correlate() should find the follower two minutes behind but returned", r, shift, ok)
+	}
+	if r, _, ok := c.correlate(unrelated); ok {
+		t.Fatal("correlate() should not report unrelated noise but returned", r)
+	}
+	if r, _, ok := c.correlate(drifting); ok {
+		t.Fatal("correlate() should not report a metric that merely drifts but returned", r)
+	}
+	if _, ok := newCorrelator(target, 1e6, 3600, 180, 0.7); ok {
+		t.Fatal("newCorrelator() should refuse a window without datapoints")
+	}
+	// The follower only matters within the window, so it is fetched no
+	// further than that.
+	from, to := c.span()
+	var inSpan Measurements
+	for _, m := range follower {
+		if m.timestamp >= from && m.timestamp < to {
+			inSpan = append(inSpan, m)
+		}
+	}
+	if r2, shift2, _ := c.correlate(inSpan); r2 != r || shift2 != shift {
+		t.Fatal("correlate() should only depend on the datapoints in span() but returned", r2, shift2)
+	}
+}
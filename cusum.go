@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math"
+)
+
+// Drift and threshold of the sequential change detectors, in standard
+// deviations of the baseline. They are set from the command line.
+var (
+	cusumDrift           = 0.5
+	cusumThreshold       = 8.0
+	pageHinkleyDelta     = 0.5
+	pageHinkleyThreshold = 10.0
+)
+
+// levelShift describes a sustained change in the level of a series.
+type levelShift struct {
+	Detected  bool  `json:"detected"`
+	Onset     int64 `json:"onset"`     // timestamp at which the change is estimated to have begun
+	Alarm     int64 `json:"alarm"`     // timestamp of the datapoint at which it was detected
+	Direction int   `json:"direction"` // 1 for an increase, -1 for a decrease
+}
+
+const (
+	// shiftWindow is how many of the most recent datapoints the change
+	// detectors scan, and shiftBaseline how many of those before them the
+	// baseline is taken from.
+	shiftWindow   = 120
+	shiftBaseline = 360
+	// shiftRecent is how close to the latest datapoint an alarm must be for
+	// the change detectors to flag a series.
+	shiftRecent = 5
+)
+
+// shiftSeries returns the datapoints of ts the change detectors look at, at
+// most shiftBaseline+shiftWindow of the latest, and their values with the
+// seasonal cycle removed when s has one, so that regular daily peaks are not
+// taken for level shifts.
+func shiftSeries(ts Measurements, s *seasonality) (Measurements, []float64) {
+	n := shiftBaseline + shiftWindow
+	if n > len(ts) {
+		n = len(ts)
+	}
+	recent := ts[len(ts)-n:]
+	if residual := s.residual(n); residual != nil {
+		return recent, residual
+	}
+	return recent, recent.values()
+}
+
+// standardize splits values into the window the change detectors scan, the
+// last shiftWindow values or the second half when there are fewer than
+// twice that, and scales the window by the mean and standard deviation of
+// the values before it, the baseline against which changes are measured.
+// It returns the offset of the window and nil when the baseline is too
+// short or constant.
+func standardize(values []float64) (int, []float64) {
+	start := len(values) - shiftWindow
+	if start < len(values)/2 {
+		start = len(values) / 2
+	}
+	baseline := values[:start]
+	if len(baseline) < 3 {
+		return start, nil
+	}
+	mu, sigma := mean(baseline), std(baseline)
+	if sigma == 0 {
+		return start, nil
+	}
+	z := make([]float64, len(values)-start)
+	for i, v := range values[start:] {
+		z[i] = (v - mu) / sigma
+	}
+	return start, z
+}
+
+// recentShift reports whether shift was detected within shiftRecent
+// datapoints of the end of ts.
+func recentShift(ts Measurements, shift levelShift) bool {
+	if len(ts) < shiftRecent {
+		return shift.Detected
+	}
+	return shift.Detected && shift.Alarm >= ts[len(ts)-shiftRecent].timestamp
+}
+
+// CUSUM function
+// Two-sided cumulative sum control chart over the recent datapoints of ts,
+// deseasonalized with s. Deviations from
+// the baseline mean of more than drift standard deviations accumulate, and
+// a change is detected once either sum exceeds threshold. The change is
+// estimated to have begun just after the sum last stood at zero. This
+// catches slow, sustained shifts that never produce a single outlying
+// datapoint. The latest change is returned; a sum that has already raised
+// an alarm only raises another once it has fallen back to zero.
+func cusum(ts Measurements, s *seasonality, drift, threshold float64) levelShift {
+	recent, values := shiftSeries(ts, s)
+	start, z := standardize(values)
+	var shift levelShift
+	var high, low float64
+	highStart, lowStart := 0, 0
+	highAlarmed, lowAlarmed := false, false
+	for i, v := range z {
+		high = math.Max(0, high+v-drift)
+		low = math.Max(0, low-v-drift)
+		if high == 0 {
+			highStart, highAlarmed = i+1, false
+		}
+		if low == 0 {
+			lowStart, lowAlarmed = i+1, false
+		}
+		if high > threshold && !highAlarmed {
+			highAlarmed = true
+			shift = levelShift{Detected: true, Onset: recent[start+highStart].timestamp, Alarm: recent[start+i].timestamp, Direction: 1}
+		}
+		if low > threshold && !lowAlarmed {
+			lowAlarmed = true
+			shift = levelShift{Detected: true, Onset: recent[start+lowStart].timestamp, Alarm: recent[start+i].timestamp, Direction: -1}
+		}
+	}
+	return shift
+}
+
+// PageHinkley function
+// Page-Hinkley test over the recent datapoints of ts, deseasonalized like
+// for cusum. The cumulative deviation of each datapoint from the running
+// mean, less a tolerance of delta standard deviations, is compared with its
+// minimum so far (and maximum, for decreases), and a change is detected once
+// the difference exceeds threshold. The change is estimated to have begun
+// just after the extreme was reached. The latest change is returned; another
+// alarm is only raised once a new extreme has been reached.
+func pageHinkley(ts Measurements, s *seasonality, delta, threshold float64) levelShift {
+	recent, values := shiftSeries(ts, s)
+	start, z := standardize(values)
+	var shift levelShift
+	var sum, runningMean, up, down, minUp, maxDown float64
+	minAt, maxAt := 0, 0
+	upAlarmed, downAlarmed := false, false
+	for i, v := range z {
+		sum += v
+		runningMean = sum / float64(i+1)
+		up += v - runningMean - delta
+		down += v - runningMean + delta
+		if up < minUp {
+			minUp, minAt, upAlarmed = up, i+1, false
+		}
+		if down > maxDown {
+			maxDown, maxAt, downAlarmed = down, i+1, false
+		}
+		if up-minUp > threshold && !upAlarmed {
+			upAlarmed = true
+			shift = levelShift{Detected: true, Onset: recent[start+minAt].timestamp, Alarm: recent[start+i].timestamp, Direction: 1}
+		}
+		if maxDown-down > threshold && !downAlarmed {
+			downAlarmed = true
+			shift = levelShift{Detected: true, Onset: recent[start+maxAt].timestamp, Alarm: recent[start+i].timestamp, Direction: -1}
+		}
+	}
+	return shift
+}
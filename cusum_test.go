@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// driftingSeries returns noisy datapoints, one a minute, around 10 that
+// start rising slowly at the given index.
+func driftingSeries(n, start int, slope float64) Measurements {
+	rnd := rand.New(rand.NewSource(2))
+	var ts Measurements
+	for i := 0; i < n; i++ {
+		v := 10 + rnd.NormFloat64()
+		if i >= start {
+			v += slope * float64(i-start)
+		}
+		ts = append(ts, Measurement{v, int64(i * 60)})
+	}
+	return ts
+}
+
+// stepSeries returns driftingSeries without a drift, raised by step between
+// the given indexes.
+func stepSeries(n, from, to int, step float64) Measurements {
+	ts := driftingSeries(n, n, 0)
+	for i := from; i < to; i++ {
+		ts[i].value += step
+	}
+	return ts
+}
+
+func TestCusum(t *testing.T) {
+	if shift := cusum(driftingSeries(400, 400, 0), &seasonality{}, 0.5, 8); shift.Detected {
+		t.Fatal("cusum() should not detect a change in a stationary series but detected", shift)
+	}
+	// A slope of 0.02 takes 50 datapoints to move one standard deviation.
+	shift := cusum(driftingSeries(400, 300, 0.02), &seasonality{}, 0.5, 8)
+	if !shift.Detected || shift.Direction != 1 {
+		t.Fatal("cusum() should detect the upward drift but returned", shift)
+	}
+	if shift.Onset < 280*60 || shift.Onset > 340*60 || shift.Alarm <= shift.Onset {
+		t.Fatal("cusum() should estimate the drift began near", 300*60, "but returned", shift)
+	}
+	if shift := cusum(driftingSeries(400, 300, -0.02), &seasonality{}, 0.5, 8); !shift.Detected || shift.Direction != -1 {
+		t.Fatal("cusum() should detect the downward drift but returned", shift)
+	}
+	if shift := cusum(Measurements{{1, 0}, {1, 1}, {5, 2}}, &seasonality{}, 0.5, 8); shift.Detected {
+		t.Fatal("cusum() should not detect anything without a usable baseline")
+	}
+}
+
+func TestCusumRecent(t *testing.T) {
+	ts := stepSeries(480, 480-3, 480, 5)
+	if shift := cusum(ts, decompose(ts, 0), 0.5, 8); !recentShift(ts, shift) {
+		t.Fatal("cusum() should flag a shift at the latest datapoints but returned", shift)
+	}
+	// A shift that has reverted well before the latest datapoint.
+	ts = stepSeries(480, 400, 420, 5)
+	shift := cusum(ts, decompose(ts, 0), 0.5, 8)
+	if !shift.Detected || recentShift(ts, shift) {
+		t.Fatal("cusum() should only report the old reverted shift as past but returned", shift)
+	}
+	daily := seasonalSeries(10)
+	if shift := cusum(daily, decompose(daily, 0), 0.5, 8); shift.Detected {
+		t.Fatal("cusum() should not take a daily cycle for a level shift but returned", shift)
+	}
+}
+
+func TestPageHinkley(t *testing.T) {
+	if shift := pageHinkley(driftingSeries(400, 400, 0), &seasonality{}, 0.5, 10); shift.Detected {
+		t.Fatal("pageHinkley() should not detect a change in a stationary series but detected", shift)
+	}
+	shift := pageHinkley(driftingSeries(400, 300, 0.02), &seasonality{}, 0.5, 10)
+	if !shift.Detected || shift.Direction != 1 {
+		t.Fatal("pageHinkley() should detect the upward drift but returned", shift)
+	}
+	if shift.Onset < 280*60 || shift.Onset > 360*60 {
+		t.Fatal("pageHinkley() should estimate the drift began near", 300*60, "but returned", shift)
+	}
+	if shift := pageHinkley(driftingSeries(400, 300, -0.02), &seasonality{}, 0.5, 10); !shift.Detected || shift.Direction != -1 {
+		t.Fatal("pageHinkley() should detect the downward drift but returned", shift)
+	}
+}
+
+func TestPageHinkleyRecent(t *testing.T) {
+	ts := stepSeries(480, 480-3, 480, 5)
+	if shift := pageHinkley(ts, decompose(ts, 0), 0.5, 10); !recentShift(ts, shift) {
+		t.Fatal("pageHinkley() should flag a shift at the latest datapoints but returned", shift)
+	}
+	ts = stepSeries(480, 400, 420, 5)
+	if shift := pageHinkley(ts, decompose(ts, 0), 0.5, 10); recentShift(ts, shift) {
+		t.Fatal("pageHinkley() should not flag an old reverted shift but returned", shift)
+	}
+	daily := seasonalSeries(10)
+	if shift := pageHinkley(daily, decompose(daily, 0), 0.5, 10); shift.Detected {
+		t.Fatal("pageHinkley() should not take a daily cycle for a level shift but returned", shift)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// incompleteBeta returns the regularized incomplete beta function I_x(a, b),
+// evaluated with the continued fraction from Numerical Recipes.
+func incompleteBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betaContinuedFraction(a, b, x) / a
+	}
+	return 1 - front*betaContinuedFraction(b, a, 1-x)/b
+}
+
+func betaContinuedFraction(a, b, x float64) float64 {
+	const tiny = 1e-300
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= 300; m++ {
+		fm := float64(m)
+		num := fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+
+		num = -(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-14 {
+			break
+		}
+	}
+	return h
+}
+
+// studentTCDF returns P(T <= t) for Student's t distribution with df degrees
+// of freedom.
+func studentTCDF(t, df float64) float64 {
+	tail := 0.5 * incompleteBeta(df/2, 0.5, df/(df+t*t))
+	if t > 0 {
+		return 1 - tail
+	}
+	return tail
+}
+
+// studentTQuantile returns the t for which studentTCDF(t, df) is p, found by
+// bisection.
+func studentTQuantile(p, df float64) float64 {
+	if p <= 0 || p >= 1 {
+		return math.NaN()
+	}
+	if p < 0.5 {
+		return -studentTQuantile(1-p, df)
+	}
+	lo, hi := 0.0, 1.0
+	for studentTCDF(hi, df) < p {
+		lo, hi = hi, hi*2
+	}
+	for i := 0; i < 100 && hi-lo > 1e-12*hi; i++ {
+		mid := (lo + hi) / 2
+		if studentTCDF(mid, df) < p {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// madScale makes the median absolute deviation of normally distributed data
+// an estimate of its standard deviation.
+const madScale = 1.4826
+
+// generalizedESD runs the generalized extreme Studentized deviate test for up
+// to maxAnoms outliers in x at significance alpha, and returns the indexes
+// of the outliers found. With robust set the test statistic uses the median
+// and the median absolute deviation in place of the mean and standard
+// deviation.
+func generalizedESD(x []float64, maxAnoms int, alpha float64, robust bool) []int {
+	n := len(x)
+	remaining := make([]int, n)
+	for i := range remaining {
+		remaining[i] = i
+	}
+
+	var candidates []int
+	found := 0
+	for i := 1; i <= maxAnoms && n-i-1 > 0; i++ {
+		values := make([]float64, len(remaining))
+		for j, idx := range remaining {
+			values[j] = x[idx]
+		}
+		var center, scale float64
+		if robust {
+			center = median(values)
+			deviations := make([]float64, len(values))
+			for j, v := range values {
+				deviations[j] = math.Abs(v - center)
+			}
+			scale = madScale * median(deviations)
+		} else {
+			center, scale = mean(values), std(values)
+		}
+		if scale == 0 {
+			break
+		}
+
+		worst, r := 0, -1.0
+		for j, v := range values {
+			if d := math.Abs(v-center) / scale; d > r {
+				worst, r = j, d
+			}
+		}
+		candidates = append(candidates, remaining[worst])
+		remaining = append(remaining[:worst], remaining[worst+1:]...)
+
+		p := 1 - alpha/(2*float64(n-i+1))
+		t := studentTQuantile(p, float64(n-i-1))
+		lambda := float64(n-i) * t / math.Sqrt((float64(n-i-1)+t*t)*float64(n-i+1))
+		if r > lambda {
+			found = i
+		}
+	}
+
+	anomalies := append([]int(nil), candidates[:found]...)
+	sort.Ints(anomalies)
+	return anomalies
+}
+
+// seasonalMedianResidual removes the trend, as the piecewise median of each
+// cycle, and the seasonal component, as the median of the detrended values at
+// each phase of the cycle, from series.
+func seasonalMedianResidual(series []float64, period int) []float64 {
+	n := len(series)
+	detrended := make([]float64, n)
+	for start := 0; start < n; start += period {
+		end := start + period
+		// A final partial cycle takes its median from the last full one.
+		from := start
+		if end > n {
+			end, from = n, n-period
+		}
+		level := median(series[from:end])
+		for i := start; i < end; i++ {
+			detrended[i] = series[i] - level
+		}
+	}
+
+	seasonal := make([]float64, period)
+	for phase := 0; phase < period; phase++ {
+		var values []float64
+		for i := phase; i < n; i += period {
+			values = append(values, detrended[i])
+		}
+		seasonal[phase] = median(values)
+	}
+	residual := make([]float64, n)
+	for i := range detrended {
+		residual[i] = detrended[i] - seasonal[i%period]
+	}
+	return residual
+}
+
+// esdMaxAnomalies caps the number of anomalies Seasonal Hybrid ESD looks
+// for, as each one costs a pass over the whole residual.
+const esdMaxAnomalies = 100
+
+// esdCycles is how many of the most recent seasonal cycles
+// seasonalHybridESDLatest tests.
+const esdCycles = 4
+
+// seasonalHybridESD finds all the anomalies in ts with Twitter's Seasonal
+// Hybrid ESD: the series is deseasonalized with the seasonal median, detrended
+// with the piecewise median, and the generalized ESD test, using the median
+// and MAD, is run on the residual. At most the fraction maxAnoms of the
+// datapoints, and no more than esdMaxAnomalies, may be flagged. It returns
+// the indexes of the anomalous datapoints.
+func seasonalHybridESD(ts Measurements, period int, maxAnoms, alpha float64) []int {
+	if period < 2 || len(ts) < 2*period {
+		return nil
+	}
+	residual := seasonalMedianResidual(ts.values(), period)
+	k := int(maxAnoms * float64(len(ts)))
+	if k > esdMaxAnomalies {
+		k = esdMaxAnomalies
+	}
+	return generalizedESD(residual, k, alpha, true)
+}
+
+// esdWindow returns the datapoints of the last esdCycles cycles of ts, which
+// has period datapoints per cycle, that Seasonal Hybrid ESD is run over.
+func esdWindow(ts Measurements, period int) Measurements {
+	if len(ts) > esdCycles*period {
+		return ts[len(ts)-esdCycles*period:]
+	}
+	return ts
+}
+
+// SeasonalHybridESD function
+// A timeseries is anomalous if Seasonal Hybrid ESD, allowing up to 2% of the
+// datapoints of its last esdCycles cycles to be anomalies at 5%
+// significance, flags its latest datapoint.
+func seasonalHybridESDLatest(ts Measurements, s *seasonality) bool {
+	period := s.period
+	ts = esdWindow(ts, period)
+	anomalies := seasonalHybridESD(ts, period, 0.02, 0.05)
+	return len(anomalies) > 0 && anomalies[len(anomalies)-1] == len(ts)-1
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStudentTQuantile(t *testing.T) {
+	if round(studentTQuantile(0.975, 10), 6) != 2.228139 {
+		t.Fatal("studentTQuantile(0.975, 10) should be 2.228139 but was", studentTQuantile(0.975, 10))
+	}
+	if round(studentTQuantile(0.995, 5), 6) != 4.032143 {
+		t.Fatal("studentTQuantile(0.995, 5) should be 4.032143 but was", studentTQuantile(0.995, 5))
+	}
+	if round(studentTQuantile(0.05, 30), 6) != -1.697261 {
+		t.Fatal("studentTQuantile(0.05, 30) should be -1.697261 but was", studentTQuantile(0.05, 30))
+	}
+}
+
+func TestGeneralizedESD(t *testing.T) {
+	// Rosner's (1983) example, in which the test finds three outliers.
+	x := []float64{-0.25, 0.68, 0.94, 1.15, 1.20, 1.26, 1.26, 1.34, 1.38, 1.43, 1.49, 1.49, 1.55, 1.56, 1.58, 1.65, 1.69, 1.70, 1.76, 1.77, 1.81, 1.91, 1.94, 1.96, 1.99, 2.06, 2.09, 2.10, 2.14, 2.15, 2.23, 2.24, 2.26, 2.35, 2.37, 2.40, 2.47, 2.54, 2.62, 2.64, 2.90, 2.92, 2.92, 2.93, 3.21, 3.26, 3.30, 3.59, 3.68, 4.30, 4.64, 5.34, 5.42, 6.01}
+	anomalies := generalizedESD(x, 10, 0.05, false)
+	if !reflect.DeepEqual(anomalies, []int{51, 52, 53}) {
+		t.Fatal("generalizedESD() should find the 3 largest values but found", anomalies)
+	}
+}
+
+func TestSeasonalHybridESD(t *testing.T) {
+	ts := seasonalSeries(10)
+	if anomalies := seasonalHybridESD(ts, 24, 0.02, 0.05); len(anomalies) != 0 {
+		t.Fatal("seasonalHybridESD() should find nothing in a regular seasonal series but found", anomalies)
+	}
+	ts[50].value += 30
+	ts[len(ts)-1].value -= 30
+	anomalies := seasonalHybridESD(ts, 24, 0.02, 0.05)
+	if !reflect.DeepEqual(anomalies, []int{50, len(ts) - 1}) {
+		t.Fatal("seasonalHybridESD() should find both anomalies but found", anomalies)
+	}
+	if !seasonalHybridESDLatest(ts, decompose(ts, 0)) {
+		t.Fatal("seasonalHybridESDLatest() should flag the anomalous latest datapoint")
+	}
+	if seasonalHybridESDLatest(ts[:len(ts)-1], decompose(ts[:len(ts)-1], 0)) {
+		t.Fatal("seasonalHybridESDLatest() should not flag a series whose latest datapoint is normal")
+	}
+}
+
+func TestSeasonalHybridESDCap(t *testing.T) {
+	ts := seasonalSeries(50)
+	for i := 5; i < len(ts); i += 7 {
+		ts[i].value += 30
+	}
+	if anomalies := seasonalHybridESD(ts, 24, 0.5, 0.05); len(anomalies) != esdMaxAnomalies {
+		t.Fatal("seasonalHybridESD() should stop at", esdMaxAnomalies, "anomalies but found", len(anomalies))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// fft returns the discrete Fourier transform of x. Lengths that are powers of
+// two use the radix-2 Cooley-Tukey algorithm, and other lengths Bluestein's
+// algorithm, which expresses the transform as a convolution of power of two
+// length, so that every length takes O(n log n).
+func fft(x []complex128) []complex128 {
+	n := len(x)
+	if n&(n-1) == 0 {
+		out := append([]complex128(nil), x...)
+		radix2(out, false)
+		return out
+	}
+	return bluestein(x)
+}
+
+// ifft returns the inverse discrete Fourier transform of x.
+func ifft(x []complex128) []complex128 {
+	conj := make([]complex128, len(x))
+	for i, v := range x {
+		conj[i] = cmplx.Conj(v)
+	}
+	out := fft(conj)
+	scale := complex(1/float64(len(x)), 0)
+	for i, v := range out {
+		out[i] = cmplx.Conj(v) * scale
+	}
+	return out
+}
+
+// fftReal returns the discrete Fourier transform of a real series.
+func fftReal(x []float64) []complex128 {
+	c := make([]complex128, len(x))
+	for i, v := range x {
+		c[i] = complex(v, 0)
+	}
+	return fft(c)
+}
+
+// radix2 transforms x, whose length must be a power of two, in place.
+func radix2(x []complex128, inverse bool) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	sign := -1.0
+	if inverse {
+		sign = 1
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(size))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := x[start+k], x[start+k+size/2]*w
+				x[start+k], x[start+k+size/2] = even+odd, even-odd
+				w *= step
+			}
+		}
+	}
+}
+
+func bluestein(x []complex128) []complex128 {
+	n := len(x)
+	m := 1
+	for m < 2*n-1 {
+		m <<= 1
+	}
+	// chirp[k] = exp(-iπk²/n), with k² reduced modulo 2n to keep the angle
+	// accurate for long series.
+	chirp := make([]complex128, n)
+	for k := 0; k < n; k++ {
+		kk := (int64(k) * int64(k)) % int64(2*n)
+		chirp[k] = cmplx.Rect(1, -math.Pi*float64(kk)/float64(n))
+	}
+	a := make([]complex128, m)
+	b := make([]complex128, m)
+	for k := 0; k < n; k++ {
+		a[k] = x[k] * chirp[k]
+	}
+	b[0] = cmplx.Conj(chirp[0])
+	for k := 1; k < n; k++ {
+		b[k] = cmplx.Conj(chirp[k])
+		b[m-k] = b[k]
+	}
+	radix2(a, false)
+	radix2(b, false)
+	for i := range a {
+		a[i] *= b[i]
+	}
+	radix2(a, true)
+	out := make([]complex128, n)
+	scale := complex(1/float64(m), 0)
+	for k := 0; k < n; k++ {
+		out[k] = a[k] * scale * chirp[k]
+	}
+	return out
+}
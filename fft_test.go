@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+// naiveDFT is the O(n²) definition of the transform.
+func naiveDFT(x []complex128) []complex128 {
+	n := len(x)
+	out := make([]complex128, n)
+	for k := range out {
+		for j, v := range x {
+			out[k] += v * cmplx.Rect(1, -2*math.Pi*float64(j*k)/float64(n))
+		}
+	}
+	return out
+}
+
+func TestFFT(t *testing.T) {
+	rnd := rand.New(rand.NewSource(9))
+	for _, n := range []int{1, 2, 8, 12, 97, 100} {
+		x := make([]complex128, n)
+		for i := range x {
+			x[i] = complex(rnd.NormFloat64(), rnd.NormFloat64())
+		}
+		want, got := naiveDFT(x), fft(x)
+		back := ifft(got)
+		for k := range x {
+			if cmplx.Abs(got[k]-want[k]) > 1e-9 {
+				t.Fatal("fft() of length", n, "should match the DFT at", k, "but returned", got[k], "for", want[k])
+			}
+			if cmplx.Abs(back[k]-x[k]) > 1e-9 {
+				t.Fatal("ifft() of length", n, "should invert fft() but returned", back[k], "for", x[k])
+			}
+		}
+	}
+
+	// A pure cycle puts all its energy in one frequency.
+	x := make([]float64, 60)
+	for i := range x {
+		x[i] = math.Cos(2 * math.Pi * float64(i) / 12)
+	}
+	spectrum := fftReal(x)
+	if round(cmplx.Abs(spectrum[5]), 6) != 30 || round(cmplx.Abs(spectrum[4]), 6) != 0 {
+		t.Fatal("fftReal() should find the cycle of 12 at frequency 5 but returned", spectrum[4], spectrum[5])
+	}
+}
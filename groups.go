@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// groupWindow is the length in seconds of the history over which the
+// members of a metric group are compared. It is set from the command line.
+var groupWindow int64 = 3600
+
+const (
+	// groupMinMembers is the fewest metrics a group needs to be analyzed.
+	groupMinMembers = 3
+	// peerThreshold is how many median absolute deviations across its
+	// peers a member may be from their median, as in
+	// medianAbsoluteDeviation, averaged over its last peerPoints
+	// datapoints.
+	peerThreshold = 6.0
+	peerPoints    = 3
+	// mahalanobisZ is the standard normal quantile of the significance
+	// level at which the Mahalanobis distance of a group is anomalous,
+	// 0.1%.
+	mahalanobisZ = 3.09
+)
+
+// metricGroup is a set of metrics, such as the same measurement on every
+// host of a cluster, that are analyzed jointly to find the members that
+// differ from the rest.
+type metricGroup struct {
+	name  string
+	query metricQuery
+}
+
+// groupFlags collects metric groups given on the command line as name=glob,
+// one per flag.
+type groupFlags []metricGroup
+
+func (g *groupFlags) String() string {
+	var parts []string
+	for _, group := range *g {
+		parts = append(parts, group.name+"="+group.query.Glob)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (g *groupFlags) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("bad group %q, want name=glob", s)
+	}
+	*g = append(*g, metricGroup{name: parts[0], query: metricQuery{Glob: parts[1]}})
+	return nil
+}
+
+// alignedGroup holds the series of a group's members resampled onto a common
+// grid, values[i] being that of members[i].
+type alignedGroup struct {
+	members []string
+	values  [][]float64
+}
+
+// alignGroup resamples the last window seconds of each series onto a grid
+// with the median sampling interval of the members, ending at the latest
+// datapoint of any of them. Members without datapoints in the window are
+// left out.
+func alignGroup(series map[string]Measurements, window int64) alignedGroup {
+	var end int64
+	for _, ts := range series {
+		if len(ts) > 0 && ts[len(ts)-1].timestamp > end {
+			end = ts[len(ts)-1].timestamp
+		}
+	}
+	var intervals []float64
+	for _, ts := range series {
+		if interval := samplingInterval(lastDuration(ts, window)); interval > 0 {
+			intervals = append(intervals, float64(interval))
+		}
+	}
+	var g alignedGroup
+	if len(intervals) == 0 {
+		return g
+	}
+	step := int64(median(intervals))
+	n := int(window/step) + 1
+	start := end - int64(n-1)*step
+
+	names := make([]string, 0, len(series))
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if values := resample(series[name], start, step, n); values != nil {
+			g.members = append(g.members, name)
+			g.values = append(g.values, values)
+		}
+	}
+	return g
+}
+
+// peerScores returns, for each member and datapoint, its absolute deviation
+// from the median of all members at that datapoint, in median absolute
+// deviations across the members. Datapoints where most members agree
+// exactly score zero.
+func peerScores(values [][]float64) [][]float64 {
+	scores := make([][]float64, len(values))
+	for i := range scores {
+		scores[i] = make([]float64, len(values[i]))
+	}
+	column := make([]float64, len(values))
+	deviations := make([]float64, len(values))
+	for t := range values[0] {
+		for i := range values {
+			column[i] = values[i][t]
+		}
+		med := median(column)
+		for i, v := range column {
+			deviations[i] = math.Abs(v - med)
+		}
+		mad := median(deviations)
+		if mad == 0 {
+			continue
+		}
+		for i := range values {
+			scores[i][t] = deviations[i] / mad
+		}
+	}
+	return scores
+}
+
+// peerDeviations returns the indexes of the members whose average peer
+// score over the last peerPoints datapoints exceeds peerThreshold.
+func peerDeviations(g alignedGroup) []int {
+	if len(g.members) < groupMinMembers {
+		return nil
+	}
+	var deviating []int
+	for i, scores := range peerScores(g.values) {
+		if len(scores) < peerPoints {
+			return nil
+		}
+		if mean(scores[len(scores)-peerPoints:]) > peerThreshold {
+			deviating = append(deviating, i)
+		}
+	}
+	return deviating
+}
+
+// mahalanobis returns the squared Mahalanobis distance of the group's latest
+// datapoints from the mean and covariance of the members over the rest of
+// the window, and how much each member contributes to it: how much the
+// distance falls when that member is left out, which is the member's squared
+// deviation from what the others predict for it. It reports false when there
+// are too few datapoints to estimate the covariance of the members.
+func mahalanobis(g alignedGroup) (float64, []float64, bool) {
+	k := len(g.members)
+	if k < 2 {
+		return 0, nil, false
+	}
+	n := len(g.values[0]) - 1
+	if n < 2*k {
+		return 0, nil, false
+	}
+	mu := make([]float64, k)
+	for i := range g.values {
+		mu[i] = mean(g.values[i][:n])
+	}
+	covariance := make([][]float64, k)
+	var trace float64
+	for i := range covariance {
+		covariance[i] = make([]float64, k)
+		for j := 0; j <= i; j++ {
+			var c float64
+			for t := 0; t < n; t++ {
+				c += (g.values[i][t] - mu[i]) * (g.values[j][t] - mu[j])
+			}
+			covariance[i][j] = c / float64(n-1)
+			covariance[j][i] = covariance[i][j]
+		}
+		trace += covariance[i][i]
+	}
+	if trace == 0 {
+		return 0, nil, false
+	}
+	// A small ridge keeps members that move in lockstep from making the
+	// covariance singular.
+	for i := range covariance {
+		covariance[i][i] += 1e-6 * trace / float64(k)
+	}
+	inv, ok := invert(covariance)
+	if !ok {
+		return 0, nil, false
+	}
+
+	diff := make([]float64, k)
+	for i := range diff {
+		diff[i] = g.values[i][n] - mu[i]
+	}
+	contributions := make([]float64, k)
+	var d2 float64
+	for i := range diff {
+		var y float64
+		for j := range diff {
+			y += inv[i][j] * diff[j]
+		}
+		contributions[i] = y * y / inv[i][i]
+		d2 += diff[i] * y
+	}
+	return d2, contributions, true
+}
+
+// chiSquareQuantile approximates the quantile of the chi-squared
+// distribution with k degrees of freedom at the standard normal quantile z,
+// by the Wilson-Hilferty transformation.
+func chiSquareQuantile(k int, z float64) float64 {
+	fk := float64(k)
+	c := 2 / (9 * fk)
+	return fk * math.Pow(1-c+z*math.Sqrt(c), 3)
+}
+
+// groupOutliers returns the algorithms that flag each member of the group,
+// keyed by member: peerDeviation for members far from the median of their
+// peers, and mahalanobis for the member contributing most to an anomalous
+// Mahalanobis distance of the group as a whole.
+func groupOutliers(g alignedGroup) map[string][]string {
+	flagged := make(map[string][]string)
+	for _, i := range peerDeviations(g) {
+		flagged[g.members[i]] = append(flagged[g.members[i]], "peerDeviation")
+	}
+	if len(g.members) >= groupMinMembers {
+		if d2, contributions, ok := mahalanobis(g); ok && d2 > chiSquareQuantile(len(g.members), mahalanobisZ) {
+			top := 0
+			for i, c := range contributions {
+				if c > contributions[top] {
+					top = i
+				}
+			}
+			flagged[g.members[top]] = append(flagged[g.members[top]], "mahalanobis")
+		}
+	}
+	return flagged
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"testing"
+)
+
+// hostSeries returns an hour of minutely datapoints for each of n hosts that
+// follow a shared load with their own noise.
+func hostSeries(n int, seed int64) map[string]Measurements {
+	rnd := rand.New(rand.NewSource(seed))
+	series := make(map[string]Measurements)
+	for t := 0; t < 60; t++ {
+		load := 100 + 10*rnd.NormFloat64()
+		for h := 0; h < n; h++ {
+			name := "web0" + string(rune('0'+h)) + ".latency"
+			series[name] = append(series[name], Measurement{load + rnd.NormFloat64(), int64(t * 60)})
+		}
+	}
+	return series
+}
+
+func TestGroupFlags(t *testing.T) {
+	var groups groupFlags
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&groups, "group", "")
+	if err := fs.Parse([]string{"-group", "web=web*.latency", "-group", "db=db*.cpu.{user,system}"}); err != nil {
+		t.Fatal("groupFlags should parse name=glob but failed", err)
+	}
+	if len(groups) != 2 || groups[1].name != "db" || groups[1].query.Glob != "db*.cpu.{user,system}" {
+		t.Fatal("groupFlags should hold each group but held", groups)
+	}
+	if groups.Set("web*.latency") == nil {
+		t.Fatal("groupFlags should refuse a group without a name")
+	}
+}
+
+func TestAlignGroup(t *testing.T) {
+	series := hostSeries(4, 1)
+	series["web00.latency"] = series["web00.latency"][:30]
+	series["empty"] = nil
+	g := alignGroup(series, 3600)
+	if len(g.members) != 4 || len(g.values[0]) != 61 {
+		t.Fatal("alignGroup() should align the members with data on one grid but returned", g.members, len(g.values[0]))
+	}
+	if g.values[0][60] != series["web00.latency"][29].value {
+		t.Fatal("alignGroup() should carry a member's last value to the end of the window")
+	}
+}
+
+func TestPeerDeviation(t *testing.T) {
+	series := hostSeries(6, 2)
+	if flagged := groupOutliers(alignGroup(series, 3600)); len(flagged) != 0 {
+		t.Fatal("groupOutliers() should not flag hosts that move together but flagged", flagged)
+	}
+	ts := series["web03.latency"]
+	for i := len(ts) - 3; i < len(ts); i++ {
+		ts[i].value += 30
+	}
+	flagged := groupOutliers(alignGroup(series, 3600))
+	if len(flagged) != 1 || len(flagged["web03.latency"]) == 0 || flagged["web03.latency"][0] != "peerDeviation" {
+		t.Fatal("groupOutliers() should flag the host that left its peers but flagged", flagged)
+	}
+}
+
+func TestMahalanobis(t *testing.T) {
+	// The hosts follow a shared load; at the end one moves without the
+	// others, which is unusual for the group though small beside the load.
+	series := hostSeries(4, 3)
+	g := alignGroup(series, 3600)
+	d2, _, ok := mahalanobis(g)
+	if !ok || d2 > chiSquareQuantile(4, mahalanobisZ) {
+		t.Fatal("mahalanobis() should find the latest datapoints ordinary but returned", d2)
+	}
+
+	last := len(g.values[1]) - 1
+	g.values[1][last] += 8
+	d2, contributions, _ := mahalanobis(g)
+	if d2 < chiSquareQuantile(4, mahalanobisZ) {
+		t.Fatal("mahalanobis() should find a host breaking from the load significant but returned", d2)
+	}
+	for i, c := range contributions {
+		if c > contributions[1] {
+			t.Fatal("the host that moved should contribute most but", g.members[i], "contributed", c)
+		}
+	}
+	if q := chiSquareQuantile(4, mahalanobisZ); q < 18 || q > 18.9 {
+		t.Fatal("chiSquareQuantile(4) at 0.1% should be near 18.47 but was", q)
+	}
+}
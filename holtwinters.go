@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math"
+)
+
+// bandWidth is how many seasonal deviations the confidence band extends
+// either side of the forecast.
+const bandWidth = 3.0
+
+// holtWintersCycles is how many of the most recent seasonal cycles the model
+// is fitted to, which bounds the cost of the parameter search on long series.
+const holtWintersCycles = 4
+
+// holtWintersFit is the result of triple exponential smoothing of a series.
+// The confidence band around each forecast is the Brutlag seasonal
+// deviation: the ewma of the absolute forecast errors at the same point in
+// previous cycles.
+type holtWintersFit struct {
+	alpha, beta, gamma float64
+	multiplicative     bool
+	period             int
+
+	// forecasts, lower and upper hold the one-step-ahead forecast of each
+	// datapoint and its band. They are NaN for the first cycle, which is
+	// used to initialize the model.
+	forecasts []float64
+	lower     []float64
+	upper     []float64
+	sse       float64
+
+	// next is the forecast of the datapoint following the series, and
+	// nextLower and nextUpper its band.
+	next, nextLower, nextUpper float64
+}
+
+// holtWinters smooths series with level, trend and seasonal smoothing
+// parameters alpha, beta and gamma, gamma also smoothing the deviations.
+// Seasonality is additive, or multiplicative for series that scale with
+// their level, in which case every value must be positive. The series must
+// hold at least two cycles and gamma must be positive.
+func holtWinters(series []float64, period int, alpha, beta, gamma float64, multiplicative bool) holtWintersFit {
+	fit := smooth(series, period, alpha, beta, gamma, multiplicative)
+	fit.band(series)
+	return fit
+}
+
+// smooth is holtWinters without the confidence bands, which the parameter
+// search does not need.
+func smooth(series []float64, period int, alpha, beta, gamma float64, multiplicative bool) holtWintersFit {
+	n := len(series)
+	fit := holtWintersFit{
+		alpha: alpha, beta: beta, gamma: gamma,
+		multiplicative: multiplicative,
+		period:         period,
+		forecasts:      make([]float64, n),
+		lower:          make([]float64, n),
+		upper:          make([]float64, n),
+	}
+
+	// Initialize from the first two cycles.
+	level := mean(series[:period])
+	trend := (mean(series[period:2*period]) - level) / float64(period)
+	seasonal := make([]float64, n+1)
+	for i := 0; i < period; i++ {
+		if multiplicative {
+			seasonal[i] = series[i] / level
+		} else {
+			seasonal[i] = series[i] - level
+		}
+		fit.forecasts[i], fit.lower[i], fit.upper[i] = math.NaN(), math.NaN(), math.NaN()
+	}
+
+	forecast := func(t int) float64 {
+		if multiplicative {
+			return (level + trend) * seasonal[t-period]
+		}
+		return level + trend + seasonal[t-period]
+	}
+
+	for t := period; t < n; t++ {
+		y := series[t]
+		yhat := forecast(t)
+		fit.forecasts[t] = yhat
+		err := y - yhat
+		fit.sse += err * err
+
+		prevLevel := level
+		if multiplicative {
+			level = alpha*y/seasonal[t-period] + (1-alpha)*(level+trend)
+			seasonal[t] = gamma*y/level + (1-gamma)*seasonal[t-period]
+		} else {
+			level = alpha*(y-seasonal[t-period]) + (1-alpha)*(level+trend)
+			seasonal[t] = gamma*(y-level) + (1-gamma)*seasonal[t-period]
+		}
+		trend = beta*(level-prevLevel) + (1-beta)*trend
+	}
+	fit.next = forecast(n)
+	return fit
+}
+
+// band sets the confidence bands of the forecasts fit made of series. The
+// band of a forecast is the ewma of the absolute errors at its point in the
+// cycle so far, or a deviation estimated from the first two cycles in the
+// first forecast cycle.
+func (fit *holtWintersFit) band(series []float64) {
+	n, period := len(series), fit.period
+	trend := (mean(series[period:2*period]) - mean(series[:period])) / float64(period)
+	var initDeviation float64
+	for i := 0; i < period; i++ {
+		initDeviation += math.Abs(series[i+period]-series[i]-float64(period)*trend) / 2
+	}
+	initDeviation /= float64(period)
+
+	com := (1 - fit.gamma) / fit.gamma
+	for phase := period; phase < 2*period && phase <= n; phase++ {
+		var errs []float64
+		for t := phase; t < n; t += period {
+			errs = append(errs, math.Abs(series[t]-fit.forecasts[t]))
+		}
+		deviations := ewma(errs, com)
+		deviation := initDeviation
+		t := phase
+		for ; t < n; t += period {
+			fit.lower[t] = fit.forecasts[t] - bandWidth*deviation
+			fit.upper[t] = fit.forecasts[t] + bandWidth*deviation
+			deviation = deviations[(t-phase)/period]
+		}
+		if t == n {
+			fit.nextLower = fit.next - bandWidth*deviation
+			fit.nextUpper = fit.next + bandWidth*deviation
+		}
+	}
+}
+
+// fitHoltWinters chooses alpha, beta and gamma minimizing the sum of squared
+// one-step-ahead forecast errors over series, by a grid search refined
+// around the best point found. It reports false when no parameters give a
+// finite error, as when series holds NaN.
+func fitHoltWinters(series []float64, period int, multiplicative bool) (holtWintersFit, bool) {
+	var best holtWintersFit
+	found := false
+	try := func(alpha, beta, gamma float64) {
+		if alpha < 0 || alpha > 1 || beta < 0 || beta > 1 || gamma <= 0 || gamma > 1 {
+			return
+		}
+		fit := smooth(series, period, alpha, beta, gamma, multiplicative)
+		if unDef(fit.sse) {
+			return
+		}
+		if !found || fit.sse < best.sse {
+			best, found = fit, true
+		}
+	}
+
+	for a := 0.1; a < 1; a += 0.2 {
+		for b := 0.1; b < 1; b += 0.2 {
+			for g := 0.1; g < 1; g += 0.2 {
+				try(a, b, g)
+			}
+		}
+	}
+	for step := 0.1; found && step > 0.005; step /= 2 {
+		a, b, g := best.alpha, best.beta, best.gamma
+		for _, da := range []float64{-step, 0, step} {
+			for _, db := range []float64{-step, 0, step} {
+				for _, dg := range []float64{-step, 0, step} {
+					try(a+da, b+db, g+dg)
+				}
+			}
+		}
+	}
+	if found {
+		best.band(series)
+	}
+	return best, found
+}
+
+// holtWintersForecast fits the last holtWintersCycles cycles of series,
+// which must hold at least two cycles of period, with additive seasonality
+// and, if every value is positive, multiplicative seasonality too, returning
+// whichever fits better and the offset into series the fit starts at. It
+// reports false when neither can be fitted.
+func holtWintersForecast(series []float64, period int) (holtWintersFit, int, bool) {
+	start := 0
+	if len(series) > holtWintersCycles*period {
+		start = len(series) - holtWintersCycles*period
+	}
+	series = series[start:]
+	fit, ok := fitHoltWinters(series, period, false)
+	for _, v := range series {
+		if v <= 0 {
+			return fit, start, ok
+		}
+	}
+	if mfit, mok := fitHoltWinters(series, period, true); mok && (!ok || mfit.sse < fit.sse) {
+		return mfit, start, true
+	}
+	return fit, start, ok
+}
+
+// HoltWintersDeviation function
+// A timeseries is anomalous if its latest datapoint lies outside the
+// confidence band of the Holt-Winters forecast made from the datapoints
+// before it. The band follows the seasonal pattern of past forecast errors,
+// so it is wider where the series is usually noisier.
+func holtWintersDeviation(ts Measurements, s *seasonality) bool {
+	period := s.period
+	if period < 2 || len(ts) < 2*period+1 {
+		return false
+	}
+	series := ts.values()
+	latest := series[len(series)-1]
+	fit, _, ok := holtWintersForecast(series[:len(series)-1], period)
+	if !ok {
+		return false
+	}
+	return latest < fit.nextLower || latest > fit.nextUpper
+}
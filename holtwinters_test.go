@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHoltWintersFit(t *testing.T) {
+	series := seasonalSeries(10).values()
+	fit, ok := fitHoltWinters(series, 24, false)
+	if !ok {
+		t.Fatal("fitHoltWinters() should fit a regular seasonal series")
+	}
+	if !math.IsNaN(fit.forecasts[0]) || math.IsNaN(fit.forecasts[24]) {
+		t.Fatal("holtWinters() should only forecast after the first cycle")
+	}
+	if rmse := math.Sqrt(fit.sse / float64(len(series)-24)); rmse > 3 {
+		t.Fatal("fitHoltWinters() should forecast a regular seasonal series closely but has rmse", rmse)
+	}
+	want := 100 + 0.1*float64(len(series)) + 50*math.Sin(2*math.Pi*float64(len(series))/24)
+	if fit.next < fit.nextLower || fit.next > fit.nextUpper || math.Abs(fit.next-want) > 5 {
+		t.Fatal("next forecast should be near", want, "but was", fit.next, "in", fit.nextLower, fit.nextUpper)
+	}
+
+	fixed := holtWinters(series, 24, 0.5, 0.1, 0.2, false)
+	if fixed.sse < fit.sse {
+		t.Fatal("fitHoltWinters() should not do worse than arbitrary parameters", fit.sse, fixed.sse)
+	}
+}
+
+func TestHoltWintersMultiplicative(t *testing.T) {
+	// Seasonal swings that grow with the level.
+	var series []float64
+	for i := 0; i < 24*10; i++ {
+		level := 100 + float64(i)
+		series = append(series, level*(1+0.5*math.Sin(2*math.Pi*float64(i)/24)))
+	}
+	additive, _ := fitHoltWinters(series, 24, false)
+	multiplicative, _ := fitHoltWinters(series, 24, true)
+	if multiplicative.sse >= additive.sse {
+		t.Fatal("multiplicative seasonality should fit a scaling series better", multiplicative.sse, additive.sse)
+	}
+	if fit, _, ok := holtWintersForecast(series, 24); !ok || !fit.multiplicative {
+		t.Fatal("holtWintersForecast() should choose multiplicative seasonality")
+	}
+}
+
+func TestHoltWintersDeviation(t *testing.T) {
+	normal := seasonalSeries(10)
+	if holtWintersDeviation(normal, decompose(normal, 0)) {
+		t.Fatal("holtWintersDeviation() should not flag a regular daily peak")
+	}
+	anomalous := seasonalSeries(10)
+	anomalous[len(anomalous)-1].value += 40
+	if !holtWintersDeviation(anomalous, decompose(anomalous, 0)) {
+		t.Fatal("holtWintersDeviation() should flag a value outside the forecast band")
+	}
+	if holtWintersDeviation(anomalous, decompose(anomalous, noPeriod)) {
+		t.Fatal("holtWintersDeviation() should skip a metric without a cycle")
+	}
+	short := seasonalSeries(1)
+	if holtWintersDeviation(short, decompose(short, 0)) {
+		t.Fatal("holtWintersDeviation() should not flag a series shorter than two cycles")
+	}
+}
+
+func TestHoltWintersRejectsNaN(t *testing.T) {
+	series := seasonalSeries(10).values()
+	series[30] = math.NaN()
+	if _, ok := fitHoltWinters(series, 24, false); ok {
+		t.Fatal("fitHoltWinters() should report no fit for a series holding NaN")
+	}
+	ts := seasonalSeries(10)
+	ts[30].value = math.NaN()
+	if holtWintersDeviation(ts, decompose(ts, 0)) {
+		t.Fatal("holtWintersDeviation() should not flag a series it cannot fit")
+	}
+}
+
+func TestHoltWintersWindow(t *testing.T) {
+	series := seasonalSeries(10).values()
+	fit, start, ok := holtWintersForecast(series, 24)
+	if !ok || start != len(series)-holtWintersCycles*24 || len(fit.forecasts) != holtWintersCycles*24 {
+		t.Fatal("holtWintersForecast() should fit the last", holtWintersCycles, "cycles but started at", start)
+	}
+}
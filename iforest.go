@@ -0,0 +1,195 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+const (
+	// isolationWindow is the number of datapoints in each feature window.
+	isolationWindow = 30
+	// isolationTrees and isolationSample are the number of trees in the
+	// forest and the number of windows each is grown from.
+	isolationTrees  = 100
+	isolationSample = 256
+	// isolationHistory is the number of windows before the latest the
+	// forest is grown from, a day of minutely datapoints.
+	isolationHistory = 96
+	// isolationThreshold is the anomaly score above which the latest window
+	// is anomalous. Scores near 0.5 are typical and near 1 isolated; the
+	// latest window of a regular series scores up to about 0.6 against
+	// isolationHistory windows of history.
+	isolationThreshold = 0.65
+)
+
+// windowFeatures describes the shape of one window of a series: its level,
+// its slope, its exponentially weighted standard deviation, the mean absolute
+// residual once the seasonal cycle and trend are removed, and the mean
+// absolute change between consecutive datapoints.
+func windowFeatures(window Measurements, residual []float64) []float64 {
+	values := window.values()
+	_, slope := linearRegressionLSE(window)
+	if unDef(slope) {
+		slope = 0
+	}
+	ewStd := ewmStd(values, float64(len(values))/4)
+	var seasonal float64
+	for _, r := range residual {
+		seasonal += math.Abs(r)
+	}
+	if len(residual) > 0 {
+		seasonal /= float64(len(residual))
+	}
+	var change float64
+	for i := 1; i < len(values); i++ {
+		change += math.Abs(values[i] - values[i-1])
+	}
+	change /= float64(len(values) - 1)
+	return []float64{mean(values), slope, ewStd[len(ewStd)-1], seasonal, change}
+}
+
+// seriesFeatures returns the features of the last windows, at most count of
+// them, of size datapoints sliding by half a window over ts, aligned so that
+// the last window ends at the latest datapoint, oldest first. The residuals
+// are taken from s.
+func seriesFeatures(ts Measurements, size, count int, s *seasonality) [][]float64 {
+	if len(ts) < 2*size {
+		return nil
+	}
+	step := size / 2
+	if n := size + (count-1)*step; len(ts) > n {
+		ts = ts[len(ts)-n:]
+	}
+	residual := s.residual(len(ts))
+	var features [][]float64
+	for end := size + (len(ts)-size)%step; end <= len(ts); end += step {
+		var r []float64
+		if residual != nil {
+			r = residual[end-size : end]
+		}
+		features = append(features, windowFeatures(ts[end-size:end], r))
+	}
+	if len(features) > count {
+		features = features[len(features)-count:]
+	}
+	return features
+}
+
+// isolationNode is a node of an isolation tree. Leaves have no children and
+// record how many sample points reached them.
+type isolationNode struct {
+	feature     int
+	split       float64
+	left, right *isolationNode
+	size        int
+}
+
+// averagePathLength is the average path length of an unsuccessful search in
+// a binary search tree of n points, c(n), which normalizes path lengths.
+func averagePathLength(n int) float64 {
+	switch {
+	case n <= 1:
+		return 0
+	case n == 2:
+		return 1
+	}
+	harmonic := math.Log(float64(n-1)) + 0.5772156649
+	return 2*harmonic - 2*float64(n-1)/float64(n)
+}
+
+func growIsolationTree(points [][]float64, depth, maxDepth int, rnd *rand.Rand) *isolationNode {
+	if depth >= maxDepth || len(points) <= 1 {
+		return &isolationNode{size: len(points)}
+	}
+	// Split on a random feature that still varies among the points.
+	features := rnd.Perm(len(points[0]))
+	for _, f := range features {
+		lo, hi := points[0][f], points[0][f]
+		for _, p := range points {
+			lo, hi = math.Min(lo, p[f]), math.Max(hi, p[f])
+		}
+		if lo == hi {
+			continue
+		}
+		split := lo + rnd.Float64()*(hi-lo)
+		var left, right [][]float64
+		for _, p := range points {
+			if p[f] < split {
+				left = append(left, p)
+			} else {
+				right = append(right, p)
+			}
+		}
+		return &isolationNode{
+			feature: f,
+			split:   split,
+			left:    growIsolationTree(left, depth+1, maxDepth, rnd),
+			right:   growIsolationTree(right, depth+1, maxDepth, rnd),
+		}
+	}
+	return &isolationNode{size: len(points)}
+}
+
+func (n *isolationNode) pathLength(x []float64, depth int) float64 {
+	if n.left == nil {
+		return float64(depth) + averagePathLength(n.size)
+	}
+	if x[n.feature] < n.split {
+		return n.left.pathLength(x, depth+1)
+	}
+	return n.right.pathLength(x, depth+1)
+}
+
+// isolationForest is an ensemble of isolation trees (Liu, Ting & Zhou 2008).
+// Anomalies are few and different, so random splits isolate them in fewer
+// steps than normal points.
+type isolationForest struct {
+	trees  []*isolationNode
+	sample int
+}
+
+// fitIsolationForest grows trees isolation trees, each from a random sample
+// of at most sample points. The forest is seeded so that the same points
+// always give the same forest.
+func fitIsolationForest(points [][]float64, trees, sample int) *isolationForest {
+	rnd := rand.New(rand.NewSource(1))
+	if sample > len(points) {
+		sample = len(points)
+	}
+	maxDepth := int(math.Ceil(math.Log2(float64(sample))))
+	forest := &isolationForest{sample: sample}
+	for i := 0; i < trees; i++ {
+		subset := make([][]float64, sample)
+		for j, k := range rnd.Perm(len(points))[:sample] {
+			subset[j] = points[k]
+		}
+		forest.trees = append(forest.trees, growIsolationTree(subset, 0, maxDepth, rnd))
+	}
+	return forest
+}
+
+// score returns the anomaly score of x, 2^(-E[h(x)]/c(sample)), between 0 and
+// 1.
+func (f *isolationForest) score(x []float64) float64 {
+	var total float64
+	for _, t := range f.trees {
+		total += t.pathLength(x, 0)
+	}
+	return math.Pow(2, -total/float64(len(f.trees))/averagePathLength(f.sample))
+}
+
+// IsolationForest function
+// A timeseries is anomalous if an isolation forest grown from the shape
+// features of its earlier windows (level, slope, exponentially weighted
+// standard deviation, seasonal residual and rate of change) isolates its
+// latest window quickly. This catches windows that are unusual in shape even
+// when no single datapoint is unusual in magnitude.
+func isolationForestLatest(ts Measurements, s *seasonality) bool {
+	features := seriesFeatures(ts, isolationWindow, isolationHistory+1, s)
+	if len(features) < 32 {
+		return false
+	}
+	latest := features[len(features)-1]
+	forest := fitIsolationForest(features[:len(features)-1], isolationTrees, isolationSample)
+	return forest.score(latest) > isolationThreshold
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestIsolationForest(t *testing.T) {
+	rnd := rand.New(rand.NewSource(7))
+	var points [][]float64
+	for i := 0; i < 500; i++ {
+		points = append(points, []float64{rnd.NormFloat64(), rnd.NormFloat64()})
+	}
+	forest := fitIsolationForest(points, isolationTrees, isolationSample)
+	if s := forest.score([]float64{0, 0}); s > 0.5 {
+		t.Fatal("isolationForest should score a typical point below 0.5 but scored", s)
+	}
+	if s := forest.score([]float64{6, -6}); s < isolationThreshold {
+		t.Fatal("isolationForest should score an isolated point above", isolationThreshold, "but scored", s)
+	}
+	if averagePathLength(256) < 10 || averagePathLength(256) > 11 {
+		t.Fatal("averagePathLength(256) should be about 10.24 but was", averagePathLength(256))
+	}
+}
+
+func TestIsolationForestLatest(t *testing.T) {
+	ts := seasonalSeries(28)
+	if isolationForestLatest(ts, decompose(ts, 0)) {
+		t.Fatal("isolationForestLatest should not flag a regular seasonal series")
+	}
+	// A burst of oscillation that stays within the normal range of values.
+	rnd := rand.New(rand.NewSource(8))
+	for i := len(ts) - isolationWindow; i < len(ts); i++ {
+		ts[i].value += 40 * (rnd.Float64() - 0.5) * float64(1-2*(i%2))
+	}
+	if !isolationForestLatest(ts, decompose(ts, 0)) {
+		t.Fatal("isolationForestLatest should flag a window of unusual shape")
+	}
+	if isolationForestLatest(ts[:100], decompose(ts[:100], 0)) {
+		t.Fatal("isolationForestLatest should not flag a series with too few windows")
+	}
+}
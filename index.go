@@ -0,0 +1,453 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Metric names are dotted paths optionally followed by tags, in the same
+// format graphite uses: "web01.cpu.user;host=web01;dc=ams". The path is
+// indexed in a trie of its dotted segments and every tag in an inverted
+// index, so that glob and tag queries never have to scan every series.
+// The path is also indexed as the tag "name".
+
+type indexNode struct {
+	children map[string]*indexNode
+	series   map[string]bool
+}
+
+func newIndexNode() *indexNode {
+	return &indexNode{children: make(map[string]*indexNode), series: make(map[string]bool)}
+}
+
+type metricIndex struct {
+	mu    sync.RWMutex
+	root  *indexNode
+	names map[string]bool
+	tags  map[string]map[string]map[string]bool
+}
+
+func newMetricIndex() *metricIndex {
+	return &metricIndex{
+		root:  newIndexNode(),
+		names: make(map[string]bool),
+		tags:  make(map[string]map[string]map[string]bool),
+	}
+}
+
+// loadMetricIndex builds an index of every metric in the metricNames sets.
+func loadMetricIndex(client redis.UniversalClient) (*metricIndex, error) {
+	names, err := setMembers(client, metricNamesKey)
+	if err != nil {
+		return nil, err
+	}
+	index := newMetricIndex()
+	for _, name := range names {
+		index.add(name)
+	}
+	return index, nil
+}
+
+// splitName splits a metric name into its dotted path and its tags.
+func splitName(name string) (string, map[string]string) {
+	parts := strings.Split(name, ";")
+	tags := map[string]string{"name": parts[0]}
+	for _, tag := range parts[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			tags[kv[0]] = kv[1]
+		}
+	}
+	return parts[0], tags
+}
+
+func (idx *metricIndex) contains(name string) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.names[name]
+}
+
+func (idx *metricIndex) len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.names)
+}
+
+// add indexes name. It is cheap to call for names that are already indexed.
+func (idx *metricIndex) add(name string) {
+	if idx.contains(name) {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.names[name] {
+		return
+	}
+	idx.names[name] = true
+
+	metricPath, tags := splitName(name)
+	node := idx.root
+	for _, segment := range strings.Split(metricPath, ".") {
+		child, ok := node.children[segment]
+		if !ok {
+			child = newIndexNode()
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.series[name] = true
+
+	for k, v := range tags {
+		values, ok := idx.tags[k]
+		if !ok {
+			values = make(map[string]map[string]bool)
+			idx.tags[k] = values
+		}
+		if values[v] == nil {
+			values[v] = make(map[string]bool)
+		}
+		values[v][name] = true
+	}
+}
+
+// remove drops name from the index, pruning any trie nodes and tag values
+// that are left empty.
+func (idx *metricIndex) remove(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !idx.names[name] {
+		return
+	}
+	delete(idx.names, name)
+
+	metricPath, tags := splitName(name)
+	removeSeries(idx.root, strings.Split(metricPath, "."), name)
+
+	for k, v := range tags {
+		delete(idx.tags[k][v], name)
+		if len(idx.tags[k][v]) == 0 {
+			delete(idx.tags[k], v)
+		}
+		if len(idx.tags[k]) == 0 {
+			delete(idx.tags, k)
+		}
+	}
+}
+
+// removeSeries removes name from the node at segments below node and reports
+// whether node is now empty.
+func removeSeries(node *indexNode, segments []string, name string) bool {
+	if len(segments) == 0 {
+		delete(node.series, name)
+	} else if child, ok := node.children[segments[0]]; ok {
+		if removeSeries(child, segments[1:], name) {
+			delete(node.children, segments[0])
+		}
+	}
+	return len(node.children) == 0 && len(node.series) == 0
+}
+
+// all returns every indexed metric name.
+func (idx *metricIndex) all() []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	names := make([]string, 0, len(idx.names))
+	for name := range idx.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findGlob returns the metrics whose path matches pattern. The pattern is
+// matched one dotted segment at a time, each segment supporting the wildcards
+// of path.Match and graphite style {a,b} alternatives.
+func (idx *metricIndex) findGlob(pattern string) ([]string, error) {
+	var segments [][]string
+	for _, segment := range strings.Split(pattern, ".") {
+		alternatives := expandBraces(segment)
+		for _, alt := range alternatives {
+			if _, err := path.Match(alt, ""); err != nil {
+				return nil, fmt.Errorf("bad glob %q: %v", pattern, err)
+			}
+		}
+		segments = append(segments, alternatives)
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var names []string
+	globNodes(idx.root, segments, func(node *indexNode) {
+		for name := range node.series {
+			names = append(names, name)
+		}
+	})
+	sort.Strings(names)
+	return names, nil
+}
+
+func globNodes(node *indexNode, segments [][]string, visit func(*indexNode)) {
+	if len(segments) == 0 {
+		visit(node)
+		return
+	}
+	for _, alt := range segments[0] {
+		if !strings.ContainsAny(alt, `*?[\`) {
+			if child, ok := node.children[alt]; ok {
+				globNodes(child, segments[1:], visit)
+			}
+			continue
+		}
+		for segment, child := range node.children {
+			if ok, _ := path.Match(alt, segment); ok {
+				globNodes(child, segments[1:], visit)
+			}
+		}
+	}
+}
+
+// expandBraces expands the {a,b} alternatives in a glob segment. Braces do
+// not nest.
+func expandBraces(segment string) []string {
+	start := strings.Index(segment, "{")
+	end := strings.Index(segment, "}")
+	if start < 0 || end < start {
+		return []string{segment}
+	}
+	var expanded []string
+	for _, alt := range strings.Split(segment[start+1:end], ",") {
+		for _, rest := range expandBraces(segment[end+1:]) {
+			expanded = append(expanded, segment[:start]+alt+rest)
+		}
+	}
+	return expanded
+}
+
+// findRegex returns the metrics whose full name, tags included, matches expr.
+func (idx *metricIndex) findRegex(expr string) ([]string, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var names []string
+	for name := range idx.names {
+		if re.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+type tagMatcher struct {
+	key    string
+	value  string
+	re     *regexp.Regexp
+	negate bool
+}
+
+// parseTagMatcher parses one of tag=value, tag!=value, tag=~regex and
+// tag!=~regex. Regular expressions are anchored at both ends.
+func parseTagMatcher(expr string) (tagMatcher, error) {
+	var m tagMatcher
+	i := strings.Index(expr, "=")
+	if i < 1 {
+		return m, fmt.Errorf("bad tag matcher %q", expr)
+	}
+	m.key, m.value = expr[:i], expr[i+1:]
+	if strings.HasSuffix(m.key, "!") {
+		m.key = m.key[:len(m.key)-1]
+		m.negate = true
+	}
+	if strings.HasPrefix(m.value, "~") {
+		re, err := regexp.Compile("^(?:" + m.value[1:] + ")$")
+		if err != nil {
+			return m, err
+		}
+		m.re = re
+	}
+	if m.key == "" {
+		return m, fmt.Errorf("bad tag matcher %q", expr)
+	}
+	return m, nil
+}
+
+func (m tagMatcher) matchValue(value string) bool {
+	if m.re != nil {
+		return m.re.MatchString(value)
+	}
+	return value == m.value
+}
+
+// seriesFor returns the series having a value for m.key that m matches,
+// ignoring negation.
+func (idx *metricIndex) seriesFor(m tagMatcher) map[string]bool {
+	matched := make(map[string]bool)
+	for value, series := range idx.tags[m.key] {
+		if m.matchValue(value) {
+			for name := range series {
+				matched[name] = true
+			}
+		}
+	}
+	return matched
+}
+
+// findTags returns the metrics matched by every one of the tag matchers.
+// A negated matcher also matches metrics that do not have the tag at all.
+func (idx *metricIndex) findTags(exprs []string) ([]string, error) {
+	var matchers []tagMatcher
+	for _, expr := range exprs {
+		m, err := parseTagMatcher(expr)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// Start from the smallest positive match rather than every series.
+	var candidates map[string]bool
+	for _, m := range matchers {
+		if m.negate {
+			continue
+		}
+		matched := idx.seriesFor(m)
+		if candidates == nil || len(matched) < len(candidates) {
+			candidates = matched
+		}
+	}
+	if candidates == nil {
+		candidates = idx.names
+	}
+
+	var names []string
+	for name := range candidates {
+		_, tags := splitName(name)
+		ok := true
+		for _, m := range matchers {
+			value, present := tags[m.key]
+			if (present && m.matchValue(value)) == m.negate {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// metricQuery selects metrics by any combination of a path glob, a regular
+// expression on the full name and tag matchers. An empty query selects every
+// metric.
+type metricQuery struct {
+	Glob  string
+	Regex string
+	Tags  []string
+}
+
+func (idx *metricIndex) query(q metricQuery) ([]string, error) {
+	var results [][]string
+	if q.Glob != "" {
+		names, err := idx.findGlob(q.Glob)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, names)
+	}
+	if q.Regex != "" {
+		names, err := idx.findRegex(q.Regex)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, names)
+	}
+	if len(q.Tags) > 0 {
+		names, err := idx.findTags(q.Tags)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, names)
+	}
+	if len(results) == 0 {
+		return idx.all(), nil
+	}
+
+	names := results[0]
+	for _, other := range results[1:] {
+		names = intersectSorted(names, other)
+	}
+	return names, nil
+}
+
+// matches reports whether the metric name is selected by q.
+func (q metricQuery) matches(name string) (bool, error) {
+	metricPath, tags := splitName(name)
+	if q.Glob != "" {
+		segments := strings.Split(metricPath, ".")
+		patterns := strings.Split(q.Glob, ".")
+		if len(segments) != len(patterns) {
+			return false, nil
+		}
+		for i, pattern := range patterns {
+			matched := false
+			for _, alt := range expandBraces(pattern) {
+				ok, err := path.Match(alt, segments[i])
+				if err != nil {
+					return false, fmt.Errorf("bad glob %q: %v", q.Glob, err)
+				}
+				matched = matched || ok
+			}
+			if !matched {
+				return false, nil
+			}
+		}
+	}
+	if q.Regex != "" {
+		ok, err := regexp.MatchString(q.Regex, name)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	for _, expr := range q.Tags {
+		m, err := parseTagMatcher(expr)
+		if err != nil {
+			return false, err
+		}
+		value, present := tags[m.key]
+		if (present && m.matchValue(value)) == m.negate {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func intersectSorted(a, b []string) []string {
+	var both []string
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			both = append(both, a[i])
+			i++
+			j++
+		}
+	}
+	return both
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testIndex() *metricIndex {
+	index := newMetricIndex()
+	for _, name := range []string{
+		"web01.cpu.user;host=web01;dc=ams",
+		"web01.cpu.system;host=web01;dc=ams",
+		"web02.cpu.user;host=web02;dc=fra",
+		"db01.cpu.user;host=db01;dc=ams",
+		"web01.mem.free",
+	} {
+		index.add(name)
+	}
+	return index
+}
+
+func TestFindGlob(t *testing.T) {
+	index := testIndex()
+	names, err := index.findGlob("web*.cpu.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"web01.cpu.system;host=web01;dc=ams", "web01.cpu.user;host=web01;dc=ams", "web02.cpu.user;host=web02;dc=fra"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatal("findGlob(web*.cpu.*) should return", want, "but returned", names)
+	}
+	names, _ = index.findGlob("{web01,db01}.cpu.user")
+	want = []string{"db01.cpu.user;host=db01;dc=ams", "web01.cpu.user;host=web01;dc=ams"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatal("findGlob({web01,db01}.cpu.user) should return", want, "but returned", names)
+	}
+	names, _ = index.findGlob("web01.cpu")
+	if len(names) != 0 {
+		t.Fatal("findGlob(web01.cpu) should only match whole paths but returned", names)
+	}
+	if _, err := index.findGlob("web[.cpu"); err == nil {
+		t.Fatal("findGlob() was provided with a malformed glob and should have returned an error")
+	}
+}
+
+func TestFindRegex(t *testing.T) {
+	index := testIndex()
+	names, err := index.findRegex(`^web0[12]\.cpu\.user`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"web01.cpu.user;host=web01;dc=ams", "web02.cpu.user;host=web02;dc=fra"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatal("findRegex() should return", want, "but returned", names)
+	}
+}
+
+func TestFindTags(t *testing.T) {
+	index := testIndex()
+	names, err := index.findTags([]string{"dc=ams", "host=~web.*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"web01.cpu.system;host=web01;dc=ams", "web01.cpu.user;host=web01;dc=ams"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatal("findTags(dc=ams, host=~web.*) should return", want, "but returned", names)
+	}
+	names, _ = index.findTags([]string{"dc!=ams", "name=~web.*"})
+	want = []string{"web01.mem.free", "web02.cpu.user;host=web02;dc=fra"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatal("findTags(dc!=ams, name=~web.*) should return", want, "but returned", names)
+	}
+	if _, err := index.findTags([]string{"=ams"}); err == nil {
+		t.Fatal("findTags() was provided with a matcher without a tag and should have returned an error")
+	}
+}
+
+func TestIndexRemove(t *testing.T) {
+	index := testIndex()
+	index.remove("web02.cpu.user;host=web02;dc=fra")
+	index.remove("web01.mem.free")
+	if index.len() != 3 {
+		t.Fatal("index should hold 3 metrics but holds", index.len())
+	}
+	if _, ok := index.root.children["web02"]; ok {
+		t.Fatal("remove() should have pruned the empty web02 node")
+	}
+	if _, ok := index.tags["dc"]["fra"]; ok {
+		t.Fatal("remove() should have pruned the empty dc=fra tag value")
+	}
+	names, _ := index.query(metricQuery{Glob: "*.cpu.user", Tags: []string{"dc=ams"}})
+	want := []string{"db01.cpu.user;host=db01;dc=ams", "web01.cpu.user;host=web01;dc=ams"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatal("query() should return", want, "but returned", names)
+	}
+}
+
+func TestQueryMatches(t *testing.T) {
+	index := testIndex()
+	queries := []metricQuery{
+		{Glob: "web*.cpu.*"},
+		{Glob: "{web01,db01}.cpu.user", Tags: []string{"dc=ams"}},
+		{Regex: "mem"},
+		{Tags: []string{"dc!=ams", "name=~web.*"}},
+		{},
+	}
+	for _, q := range queries {
+		want, _ := index.query(q)
+		var got []string
+		for _, name := range index.all() {
+			if ok, err := q.matches(name); err != nil {
+				t.Fatal(err)
+			} else if ok {
+				got = append(got, name)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatal("matches() should agree with query() for", q, "selecting", want, "but selected", got)
+		}
+	}
+}
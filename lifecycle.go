@@ -0,0 +1,258 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// lastSeenKey is a sorted set of metric names scored by the unix time at
+// which their most recent datapoint was received, split by shardKey.
+const lastSeenKey = "metricLastSeen"
+
+// staleMetricsKey is the set of metrics currently reported as having stopped
+// sending data, split by shardKey.
+const staleMetricsKey = "staleMetrics"
+
+// metricsNotSeenSince returns the names of all metrics whose most recent
+// datapoint was received before cutoff.
+func metricsNotSeenSince(client redis.UniversalClient, cutoff int64) ([]string, error) {
+	pipe := client.Pipeline()
+	var cmds []*redis.StringSliceCmd
+	for _, key := range shardKeys(lastSeenKey) {
+		cmds = append(cmds, pipe.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: "(" + strconv.FormatInt(cutoff, 10),
+		}))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, cmd := range cmds {
+		names = append(names, cmd.Val()...)
+	}
+	return names, nil
+}
+
+// diffStale compares the metrics that are stale now against those already
+// reported as stale and returns the ones that just stopped reporting and the
+// ones that have started reporting again.
+func diffStale(stale, known []string) (stopped, resumed []string) {
+	isStale := make(map[string]bool, len(stale))
+	for _, name := range stale {
+		isStale[name] = true
+	}
+	isKnown := make(map[string]bool, len(known))
+	for _, name := range known {
+		isKnown[name] = true
+		if !isStale[name] {
+			resumed = append(resumed, name)
+		}
+	}
+	for _, name := range stale {
+		if !isKnown[name] {
+			stopped = append(stopped, name)
+		}
+	}
+	return stopped, resumed
+}
+
+// reportStaleMetrics logs every metric that has received no data since cutoff
+// as an absence anomaly, once per outage, and logs metrics that resume.
+func reportStaleMetrics(client redis.UniversalClient, logger *log.Logger, cutoff int64) error {
+	stale, err := metricsNotSeenSince(client, cutoff)
+	if err != nil {
+		return err
+	}
+	known, err := setMembers(client, staleMetricsKey)
+	if err != nil {
+		return err
+	}
+	stopped, resumed := diffStale(stale, known)
+	if len(stopped) == 0 && len(resumed) == 0 {
+		return nil
+	}
+
+	pipe := client.Pipeline()
+	for _, name := range stopped {
+		logger.Println("anomaly: metric stopped reporting:", name)
+	}
+	for _, name := range resumed {
+		logger.Println("metric resumed reporting:", name)
+	}
+	for _, name := range stopped {
+		pipe.SAdd(ctx, shardKey(staleMetricsKey, name), name)
+	}
+	for _, name := range resumed {
+		pipe.SRem(ctx, shardKey(staleMetricsKey, name), name)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// staleAnomaly is the anomaly reported for a metric that has stopped
+// reporting, dated when it was last seen and valued at its latest stored
+// datapoint, if any.
+func staleAnomaly(name string, lastSeen int64, latest string) Anomaly {
+	anomaly := Anomaly{Metric: name, Timestamp: lastSeen, Algorithms: []string{"stale"}}
+	if m, err := parseMeasurement(latest); err == nil {
+		anomaly.Value = m.value
+	}
+	return anomaly
+}
+
+// staleAnomalies returns an anomaly for each metric selected by q that is
+// currently reported as having stopped sending data, so that outages show up
+// with the other anomalies for as long as they last.
+func staleAnomalies(client redis.UniversalClient, q metricQuery) ([]Anomaly, error) {
+	known, err := setMembers(client, staleMetricsKey)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range known {
+		if ok, err := q.matches(name); err == nil && ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+
+	pipe := client.Pipeline()
+	seen := make([]*redis.FloatCmd, len(names))
+	latest := make([]*redis.StringCmd, len(names))
+	for i, name := range names {
+		seen[i] = pipe.ZScore(ctx, shardKey(lastSeenKey, name), name)
+		latest[i] = pipe.LIndex(ctx, metricKey(name), -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	anomalies := make([]Anomaly, len(names))
+	for i, name := range names {
+		anomalies[i] = staleAnomaly(name, int64(seen[i].Val()), latest[i].Val())
+	}
+	return anomalies, nil
+}
+
+// deleteIfUnchanged deletes a metric's keys, KEYS[1] being its datapoints,
+// unless its latest datapoint is no longer ARGV[1], in which case it has
+// received data since it was looked up. Every key is in the metric's slot.
+var deleteIfUnchanged = redis.NewScript(`
+local tail = redis.call("LINDEX", KEYS[1], -1)
+if (tail or "") ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", unpack(KEYS))
+return 1
+`)
+
+// unindexIfStale removes ARGV[1] from the last seen set KEYS[1], the name set
+// KEYS[2] and the stale set KEYS[3] unless it has been seen since ARGV[2].
+// The keys are shards of the same index and so in the same slot.
+var unindexIfStale = redis.NewScript(`
+local seen = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if seen and tonumber(seen) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("SREM", KEYS[2], ARGV[1])
+redis.call("SREM", KEYS[3], ARGV[1])
+return 1
+`)
+
+// collectGarbage deletes the data and index entries of every metric that has
+// received no data since cutoff and returns the names of those removed. A
+// metric's keys and its index entries live in different slots, so each is
+// removed by a script that first checks, atomically, that no datapoint has
+// arrived since the lookup: the data only while its latest datapoint is the
+// one looked up, and the index entries, after it, only while the metric is
+// still unseen since cutoff. A metric found to have received data is kept.
+func collectGarbage(client redis.UniversalClient, cutoff int64) ([]string, error) {
+	names, err := metricsNotSeenSince(client, cutoff)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	pipe := client.Pipeline()
+	tails := make([]*redis.StringCmd, len(names))
+	for i, name := range names {
+		tails[i] = pipe.LIndex(ctx, metricKey(name), -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	pipe = client.Pipeline()
+	deleted := make([]*redis.Cmd, len(names))
+	for i, name := range names {
+		keys := []string{metricKey(name), metricSubKey(name, "stats"), metricSubKey(name, "digests"), metricSubKey(name, "meta"), metricSubKey(name, "triggers")}
+		deleted[i] = deleteIfUnchanged.Eval(ctx, pipe, keys, tails[i].Val())
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	pipe = client.Pipeline()
+	var candidates []string
+	var unindexed []*redis.Cmd
+	for i, name := range names {
+		if n, _ := deleted[i].Int(); n == 0 {
+			continue
+		}
+		keys := []string{shardKey(lastSeenKey, name), shardKey(metricNamesKey, name), shardKey(staleMetricsKey, name)}
+		candidates = append(candidates, name)
+		unindexed = append(unindexed, unindexIfStale.Eval(ctx, pipe, keys, name, cutoff))
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	var removed []string
+	for i, name := range candidates {
+		if n, _ := unindexed[i].Int(); n == 1 {
+			removed = append(removed, name)
+		}
+	}
+	return removed, nil
+}
+
+// watchMetrics checks every interval for metrics that have stopped reporting
+// for longer than staleAfter, and removes metrics that have been silent for
+// longer than gcAfter from the store, the index, the change tracker, the
+// streaming statistics and the period cache. A gcAfter of zero
+// disables garbage collection.
+func watchMetrics(client redis.UniversalClient, index *metricIndex, tracker *changeTracker, streams *streamStore, periods *metricPeriods, logger *log.Logger, interval, staleAfter, gcAfter time.Duration) {
+	for now := range time.Tick(interval) {
+		err := reportStaleMetrics(client, logger, now.Add(-staleAfter).Unix())
+		if err != nil {
+			logger.Println("stale metric check failed:", err)
+		}
+
+		if gcAfter <= 0 {
+			continue
+		}
+		removed, err := collectGarbage(client, now.Add(-gcAfter).Unix())
+		if err != nil {
+			logger.Println("metric garbage collection failed:", err)
+			continue
+		}
+		for _, name := range removed {
+			index.remove(name)
+			tracker.forget(name)
+			streams.forget(name)
+			periods.forget(name)
+		}
+		if len(removed) > 0 {
+			logger.Println("garbage collected", len(removed), "metrics")
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStaleAnomaly(t *testing.T) {
+	anomaly := staleAnomaly("web01.cpu", 1500000000, "42.5,1499999990")
+	if anomaly.Metric != "web01.cpu" || anomaly.Timestamp != 1500000000 || anomaly.Value != 42.5 || !reflect.DeepEqual(anomaly.Algorithms, []string{"stale"}) {
+		t.Fatal("staleAnomaly() should report the metric as stale when last seen but returned", anomaly)
+	}
+	if anomaly := staleAnomaly("web01.cpu", 1500000000, ""); anomaly.Value != 0 {
+		t.Fatal("staleAnomaly() should leave the value zero without a datapoint but returned", anomaly.Value)
+	}
+}
+
+func TestDiffStale(t *testing.T) {
+	stopped, resumed := diffStale([]string{"a", "b", "c"}, []string{"b", "d"})
+	if !reflect.DeepEqual(stopped, []string{"a", "c"}) {
+		t.Fatal("diffStale() should report a and c as stopped but reported", stopped)
+	}
+	if !reflect.DeepEqual(resumed, []string{"d"}) {
+		t.Fatal("diffStale() should report d as resumed but reported", resumed)
+	}
+	stopped, resumed = diffStale([]string{}, []string{})
+	if len(stopped) != 0 || len(resumed) != 0 {
+		t.Fatal("diffStale() was provided with empty slices and should have returned nothing but returned", stopped, resumed)
+	}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	redis "gopkg.in/redis.v2"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -30,28 +34,20 @@ type Measurement struct {
 
 type Measurements []Measurement
 
-func handleMetric(inq chan []byte, outq chan Metric, client *redis.Client, loopcount *uint64, loopstart *time.Time, wg *sync.WaitGroup) {
-	var MAX_METRICS int64 = 500000
+func handleMetric(inq chan []byte, outq chan Metric, writer *batchWriter, index *metricIndex, tracker *changeTracker, streams *streamStore, loopcount *uint64, loopstart *time.Time, wg *sync.WaitGroup) {
 	defer wg.Done()
-	pipe := client.Pipeline()
+	defer close(writer.in)
 
-	var pipecount uint32 = 0
 	for item := range inq {
-		message := string(item)
-		messageCleaned := strings.TrimSuffix(message, "\n")
-		splitLine := strings.Split(messageCleaned, " ")
-		metricName := splitLine[0]
-		pipe.RPush(metricName, splitLine[1]+","+splitLine[2])
-		pipe.LTrim(metricName, 0, MAX_METRICS)
-
-		pipe.SAdd("metricNames", metricName)
-		pipecount++
-
-		if pipecount > 512 {
-			_, err := pipe.Exec()
-			check(err)
-			pipecount = 0
+		dp, err := parseDatapoint(item, time.Now().Unix())
+		if err != nil {
+			atomic.AddUint64(&writer.stats.malformed, 1)
+			continue
 		}
+		index.add(dp.name)
+		tracker.observe(dp.name, dp.measurement)
+		streams.observe(dp.name, dp.measurement)
+		writer.send(dp)
 
 		if *loopcount%10000 == 0 {
 			fmt.Println("rate:", float64(*loopcount)/time.Since(*loopstart).Seconds())
@@ -61,19 +57,88 @@ func handleMetric(inq chan []byte, outq chan Metric, client *redis.Client, loopc
 	}
 }
 
-func startListening(inq chan []byte, outq chan Metric) {
-	addr, _ := net.ResolveUDPAddr("udp", ":2001")
-	sock, err := net.ListenUDP("udp", addr)
-	check(err)
+// startListening reads datapoints from sock until it is closed, then closes inq.
+func startListening(sock *net.UDPConn, inq chan []byte, outq chan Metric) {
 	for {
 		buf := make([]byte, 512)
 		size, _, err := sock.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			close(inq)
+			return
+		}
 		check(err)
 		inq <- buf[0:size]
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		if err := runSnapshotCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	staleAfter := flag.Duration("stale-after", 10*time.Minute, "report metrics that have sent no data for this long")
+	gcAfter := flag.Duration("gc-after", 7*24*time.Hour, "delete metrics that have sent no data for this long (0 disables)")
+	watchInterval := flag.Duration("watch-interval", time.Minute, "how often to check for stale metrics")
+	analyzeInterval := flag.Duration("analyze-interval", time.Minute, "how often to analyze metrics")
+	analyzeGlob := flag.String("analyze-glob", "", "only analyze metrics whose path matches this glob")
+	analyzeRegex := flag.String("analyze-regex", "", "only analyze metrics whose name matches this regular expression")
+	analyzeTags := flag.String("analyze-tags", "", "only analyze metrics matching these comma separated tag matchers")
+	seasonalCycle := flag.Duration("seasonal-period", 0, "seasonal cycle length for the seasonal algorithms (0 detects it per metric)")
+	flag.Float64Var(&cusumDrift, "cusum-drift", cusumDrift, "CUSUM drift allowance in baseline standard deviations")
+	flag.Float64Var(&cusumThreshold, "cusum-threshold", cusumThreshold, "CUSUM decision threshold in baseline standard deviations")
+	flag.Float64Var(&pageHinkleyDelta, "ph-delta", pageHinkleyDelta, "Page-Hinkley tolerance in baseline standard deviations")
+	flag.Float64Var(&pageHinkleyThreshold, "ph-threshold", pageHinkleyThreshold, "Page-Hinkley decision threshold in baseline standard deviations")
+	flag.Float64Var(&changePointPenalty, "change-point-penalty", changePointPenalty, "cost of a change point as a multiple of the log of the number of datapoints")
+	flag.BoolVar(&fastChangePoints, "binseg", false, "find change points with binary segmentation instead of PELT")
+	mannKendallWindowFlag := flag.Duration("mk-window", 6*time.Hour, "window over which mannKendallTrend looks for a monotonic trend")
+	flag.Float64Var(&mannKendallAlpha, "mk-alpha", mannKendallAlpha, "significance level of the Mann-Kendall trend test")
+	flag.BoolVar(&metaAnalysis, "meta-analysis", metaAnalysis, "suppress anomalies in metrics that trigger on a regular cadence")
+	flag.Float64Var(&metaSigma, "meta-sigma", metaSigma, "standard deviations from the mean interval between triggers at which a trigger stands out")
+	flag.IntVar(&metaMinIntervals, "meta-min-intervals", metaMinIntervals, "intervals between past triggers needed to judge a metric's cadence")
+	metaEpisodeGapFlag := flag.Duration("meta-episode-gap", 5*time.Minute, "how long a metric must go without triggering for its next trigger to start a new episode (at least -analyze-interval)")
+	flag.IntVar(&qualityMinPoints, "min-points", qualityMinPoints, "fewest datapoints a metric needs to be analyzed")
+	minSpanFlag := flag.Duration("min-span", time.Hour, "shortest history a metric needs to be analyzed")
+	flag.Float64Var(&qualityMaxGapRatio, "max-gap-ratio", qualityMaxGapRatio, "largest share of a metric's history that may fall in gaps for it to be analyzed")
+	flag.Float64Var(&qualityMaxSparsity, "max-sparsity", qualityMaxSparsity, "largest share of a metric's datapoints that may be zero for it to be analyzed, 1 for any")
+	var boundaries boundaryRules
+	flag.Var(&boundaries, "boundary", "glob:limit,... static limits on the latest datapoint of matching metrics, each min=X, max=X, rate=X (per second) or nonzero (repeatable)")
+	var groups groupFlags
+	flag.Var(&groups, "group", "name=glob of a metric group whose members are compared with each other (repeatable)")
+	groupWindowFlag := flag.Duration("group-window", time.Hour, "history over which the members of a metric group are compared")
+	flag.StringVar(&trendMethod, "trend-method", trendMethod, "how leastSquares fits its trend line: ols, theilsen or huber")
+	flag.BoolVar(&trendChecks, "trend-checks", false, "skip leastSquares when its residuals are autocorrelated or heteroscedastic")
+	bocpdGlob := flag.String("bocpd-glob", "", "track change points as they arrive in metrics whose path matches this glob")
+	bocpdRegex := flag.String("bocpd-regex", "", "track change points as they arrive in metrics whose name matches this regular expression")
+	bocpdTags := flag.String("bocpd-tags", "", "track change points as they arrive in metrics matching these comma separated tag matchers")
+	bocpdRunLength := flag.Float64("bocpd-run-length", 250, "expected number of datapoints between change points")
+	bocpdMaxRunLength := flag.Int("bocpd-max-run-length", 500, "longest run length tracked for each metric")
+	bocpdThreshold := flag.Float64("bocpd-threshold", 0.5, "probability of a recent change at which a change point is reported")
+	consensus := flag.Int("consensus", 6, "number of algorithms that must agree for a metric to be anomalous")
+	httpAddr := flag.String("http", ":2002", "address to serve the query API on (empty disables)")
+	redisOpt := redisFlags(flag.CommandLine)
+	batchSize := flag.Int("batch-size", 512, "number of datapoints written to Redis in one pipeline")
+	flushInterval := flag.Duration("flush-interval", time.Second, "longest time a partial batch waits before being written")
+	maxBuffered := flag.Int("max-buffered", 100000, "datapoints each worker buffers in memory while Redis is unavailable")
+	spoolDir := flag.String("spool-dir", "", "directory to spool datapoints to once the memory buffer is full (empty disables)")
+	spoolMaxMB := flag.Int64("spool-max-mb", 1024, "maximum size of the spool in megabytes")
+	digestWindowFlag := flag.Duration("digest-window", time.Duration(digestWindow)*time.Second, "length of the rollup windows of each metric's t-digests")
+	flag.IntVar(&digestWindows, "digest-windows", digestWindows, "number of completed rollup windows that make up the percentile rank reference")
+	statsInterval := flag.Duration("stats-interval", 10*time.Second, "how often to persist the streaming statistics of each metric (t-digests are persisted as their windows complete)")
+	flag.Parse()
+	check(validTrendMethod(trendMethod))
+	configuredSeasonalPeriod = int64(seasonalCycle.Seconds())
+	digestWindow = int64(digestWindowFlag.Seconds())
+	check(validDigestWindows(digestWindow, digestWindows))
+	mannKendallWindow = int64(mannKendallWindowFlag.Seconds())
+	groupWindow = int64(groupWindowFlag.Seconds())
+	check(validEpisodeGap(*metaEpisodeGapFlag, *analyzeInterval))
+	metaEpisodeGap = int64(metaEpisodeGapFlag.Seconds())
+	qualityMinSpan = int64(minSpanFlag.Seconds())
+
 	startTime := time.Now()
 	WORKER_COUNT := runtime.NumCPU() * 2
 
@@ -83,21 +148,93 @@ func main() {
 	logger := log.New(logFile, "", log.LstdFlags)
 	logger.Println("starting execution at", startTime)
 
-	client := redis.NewClient(&redis.Options{Network: "tcp", Addr: "localhost:6379"})
+	client := newRedisClient(redisOpt())
 	defer client.Close()
 
+	moved, err := migrateStore(client)
+	check(err)
+	if moved > 0 {
+		logger.Println("moved the datapoints of", moved, "metrics to the current key layout")
+	}
+	index, err := loadMetricIndex(client)
+	check(err)
+	logger.Println("indexed", index.len(), "metrics")
+	streams := newStreamStore(client)
+	check(streams.load(index.all()))
+
+	query := metricQuery{Glob: *analyzeGlob, Regex: *analyzeRegex}
+	if *analyzeTags != "" {
+		query.Tags = strings.Split(*analyzeTags, ",")
+	}
+	var tracker *changeTracker
+	if *bocpdGlob != "" || *bocpdRegex != "" || *bocpdTags != "" {
+		bocpdQuery := metricQuery{Glob: *bocpdGlob, Regex: *bocpdRegex}
+		if *bocpdTags != "" {
+			bocpdQuery.Tags = strings.Split(*bocpdTags, ",")
+		}
+		tracker = newChangeTracker(bocpdQuery, *bocpdRunLength, *bocpdMaxRunLength, *bocpdThreshold, logger)
+	}
+	var stats writeStats
+	var sp *spool
+	if *spoolDir != "" {
+		sp, err = openSpool(*spoolDir, *spoolMaxMB<<20)
+		check(err)
+		logger.Println(sp.len(), "datapoints waiting in the spool")
+	}
+
+	a := &analyzer{client: client, index: index, query: query, consensus: *consensus, streams: streams, periods: newMetricPeriods(client), groups: groups, boundaries: boundaries, triggers: triggerHistory{client}, logger: logger}
+	go a.run(*analyzeInterval)
+	if *httpAddr != "" {
+		go serveAPI(*httpAddr, client, index, a, tracker, streams, &stats, logger)
+	}
+
+	addr, _ := net.ResolveUDPAddr("udp", ":2001")
+	sock, err := net.ListenUDP("udp", addr)
+	check(err)
+
 	inq := make(chan []byte)
 	mets := make(chan Metric)
-	go startListening(inq, mets)
+	go startListening(sock, inq, mets)
+	go watchMetrics(client, index, tracker, streams, a.periods, logger, *watchInterval, *staleAfter, *gcAfter)
 
 	loopstart := time.Now()
 	var loopcount uint64
 	var wg sync.WaitGroup
 
 	for i := 0; i < WORKER_COUNT; i++ {
-		wg.Add(1)
-		go handleMetric(inq, mets, client, &loopcount, &loopstart, &wg)
+		writer := &batchWriter{
+			client:      client,
+			stats:       &stats,
+			spool:       sp,
+			logger:      logger,
+			batchSize:   *batchSize,
+			maxBuffered: *maxBuffered,
+			in:          make(chan datapoint, *maxBuffered),
+		}
+		wg.Add(2)
+		go writer.run(*flushInterval, &wg)
+		go handleMetric(inq, mets, writer, index, tracker, streams, &loopcount, &loopstart, &wg)
 	}
 
+	// On shutdown stop listening and let the workers write out what they hold.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		logger.Println("received", <-signals, "shutting down")
+		sock.Close()
+	}()
+
+	go func() {
+		for range time.Tick(*statsInterval) {
+			if err := streams.persist(); err != nil {
+				logger.Println("persisting streaming statistics failed:", err)
+			}
+		}
+	}()
+
 	wg.Wait()
+	if err := streams.persistAll(); err != nil {
+		logger.Println("persisting streaming statistics failed:", err)
+	}
+	logger.Println("stopped with datapoint counts", stats.snapshot())
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+)
+
+var (
+	// mannKendallWindow is the length in seconds of the window over which
+	// mannKendallTrend looks for a monotonic trend, and mannKendallAlpha the
+	// significance level it needs. They are set from the command line.
+	mannKendallWindow int64 = 6 * 3600
+	mannKendallAlpha        = 0.001
+)
+
+const (
+	// mannKendallMinPoints is the fewest datapoints the Mann-Kendall test is
+	// applied to, below which its normal approximation is poor.
+	mannKendallMinPoints = 10
+	// maxTrendLength is the most datapoints the Mann-Kendall test is applied
+	// to, as its cost grows with the square of their number. Longer windows
+	// are thinned to it.
+	maxTrendLength = 2000
+)
+
+// monotonicTrend is the result of the Mann-Kendall test of a series and the
+// Sen's slope of the series.
+type monotonicTrend struct {
+	S      float64 `json:"s"`      // number of increasing pairs less decreasing pairs
+	Tau    float64 `json:"tau"`    // Kendall's tau between the values and time
+	Z      float64 `json:"z"`      // S standardized, with continuity correction
+	PValue float64 `json:"pValue"` // two-sided p-value of there being no trend
+	// Slope is Sen's slope in value units per second and Intercept the
+	// value of the line through the series at timestamp 0.
+	Slope     float64 `json:"slope"`
+	Intercept float64 `json:"intercept"`
+}
+
+// significant reports whether the trend is significant at level alpha.
+func (mt monotonicTrend) significant(alpha float64) bool {
+	return mt.PValue < alpha
+}
+
+// mannKendall tests ts for a monotonic trend. S counts the pairs of
+// datapoints that increase less those that decrease; with no trend it is
+// approximately normal with mean 0 and a variance that is reduced for tied
+// values. Sen's slope, the median of the slopes between pairs, estimates
+// the rate of change without being moved by outliers.
+func mannKendall(ts Measurements) monotonicTrend {
+	n := len(ts)
+	var mt monotonicTrend
+	if n < 2 {
+		mt.PValue = 1
+		return mt
+	}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			switch d := ts[j].value - ts[i].value; {
+			case d > 0:
+				mt.S++
+			case d < 0:
+				mt.S--
+			}
+		}
+	}
+	pairs := float64(n) * float64(n-1) / 2
+	mt.Tau = mt.S / pairs
+
+	fn := float64(n)
+	variance := fn * (fn - 1) * (2*fn + 5)
+	values := sorted(ts.values())
+	for i := 0; i < n; {
+		j := i
+		for j < n && values[j] == values[i] {
+			j++
+		}
+		if t := float64(j - i); t > 1 {
+			variance -= t * (t - 1) * (2*t + 5)
+		}
+		i = j
+	}
+	variance /= 18
+	switch {
+	case variance <= 0:
+	case mt.S > 0:
+		mt.Z = (mt.S - 1) / math.Sqrt(variance)
+	case mt.S < 0:
+		mt.Z = (mt.S + 1) / math.Sqrt(variance)
+	}
+	mt.PValue = math.Erfc(math.Abs(mt.Z) / math.Sqrt2)
+
+	x := make([]float64, n)
+	for i, m := range ts {
+		x[i] = float64(m.timestamp - ts[0].timestamp)
+	}
+	mt.Intercept, mt.Slope = theilSen(x, ts.values())
+	mt.Intercept -= mt.Slope * float64(ts[0].timestamp)
+	return mt
+}
+
+// timeToThreshold returns the timestamp at which the Sen's slope line of a
+// trend reaches threshold, extrapolating from the timestamp now. It reports
+// false when the line is flat or heading away from the threshold, as it is
+// once it has passed it.
+func (mt monotonicTrend) timeToThreshold(threshold float64, now int64) (int64, bool) {
+	gap := threshold - (mt.Intercept + mt.Slope*float64(now))
+	if gap == 0 {
+		return now, true
+	}
+	if mt.Slope == 0 || (gap > 0) != (mt.Slope > 0) {
+		return 0, false
+	}
+	return now + int64(math.Ceil(gap/mt.Slope)), true
+}
+
+// trendWindow returns the last window seconds of ts less their seasonal
+// component in s, so that the rising or falling side of a cycle longer than
+// the window is not taken for a trend.
+func trendWindow(ts Measurements, window int64, s *seasonality) Measurements {
+	recent := lastDuration(ts, window)
+	if s.period == 0 {
+		return recent
+	}
+	from := len(ts) - len(recent)
+	adjusted := make(Measurements, len(recent))
+	for i, m := range recent {
+		adjusted[i] = Measurement{m.value - s.seasonalAt(from+i), m.timestamp}
+	}
+	return adjusted
+}
+
+// MannKendallTrend function
+// A timeseries is anomalous if the Mann-Kendall test finds a significant
+// monotonic trend over the last mannKendallWindow seconds, such as a disk
+// filling up or memory leaking. The seasonal cycle is removed first, as a
+// cycle longer than the window trends on its rising or falling side too.
+// Windows of more than maxTrendLength datapoints are thinned first.
+func mannKendallTrend(ts Measurements, s *seasonality) bool {
+	window := thinTrend(trendWindow(ts, mannKendallWindow, s), maxTrendLength)
+	if len(window) < mannKendallMinPoints {
+		return false
+	}
+	return mannKendall(window).significant(mannKendallAlpha)
+}
+
+// thinTrend returns ts with runs of consecutive datapoints averaged so that
+// at most n remain, each at the timestamp of the last of its run. The runs
+// end at the latest datapoint, which is kept as is when ts needs no thinning.
+func thinTrend(ts Measurements, n int) Measurements {
+	if len(ts) <= n {
+		return ts
+	}
+	k := (len(ts) + n - 1) / n
+	thinned := make(Measurements, 0, n)
+	for end := len(ts) % k; end <= len(ts); end += k {
+		if end == 0 {
+			continue
+		}
+		run := ts[max(end-k, 0):end]
+		sum := 0.0
+		for _, m := range run {
+			sum += m.value
+		}
+		thinned = append(thinned, Measurement{sum / float64(len(run)), run[len(run)-1].timestamp})
+	}
+	return thinned
+}
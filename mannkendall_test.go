@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// leakSeries returns n datapoints a minute apart, ending now, growing by rate
+// per second with normal noise of deviation 1.
+func leakSeries(n int, rate float64) Measurements {
+	rnd := rand.New(rand.NewSource(7))
+	now := time.Now().Unix()
+	var ts Measurements
+	for i := 0; i < n; i++ {
+		t := now - int64(n-1-i)*60
+		ts = append(ts, Measurement{100 + rate*float64(i*60) + rnd.NormFloat64(), t})
+	}
+	return ts
+}
+
+func TestMannKendall(t *testing.T) {
+	var ts Measurements
+	for i, v := range []float64{1, 2, 3, 4, 5} {
+		ts = append(ts, Measurement{v, int64(i)})
+	}
+	mt := mannKendall(ts)
+	if mt.S != 10 || mt.Tau != 1 || round(mt.Slope, 6) != 1 {
+		t.Fatal("mannKendall() should count every pair increasing but returned", mt)
+	}
+	// Var(S) = 5*4*15/18, so z = 9/sqrt(16.67).
+	if round(mt.Z, 4) != round(9/math.Sqrt(50.0/3), 4) {
+		t.Fatal("mannKendall() should standardize S with continuity correction but returned", mt.Z)
+	}
+
+	ties := Measurements{{1, 0}, {1, 1}, {1, 2}, {2, 3}}
+	if mt := mannKendall(ties); mt.S != 3 || mt.PValue >= 1 {
+		t.Fatal("mannKendall() should count tied pairs as neither but returned", mt)
+	}
+	if mt := mannKendall(Measurements{{1, 0}, {1, 1}, {1, 2}}); mt.PValue != 1 {
+		t.Fatal("mannKendall() should find no trend in a constant series but returned", mt)
+	}
+}
+
+func TestMannKendallTrend(t *testing.T) {
+	if mannKendallTrend(leakSeries(360, 0), &seasonality{}) {
+		t.Fatal("mannKendallTrend() should not flag a flat series")
+	}
+	leak := leakSeries(360, 0.001)
+	if !mannKendallTrend(leak, decompose(leak, 0)) {
+		t.Fatal("mannKendallTrend() should flag a steady leak")
+	}
+	if mannKendallTrend(leak[:5], decompose(leak[:5], 0)) {
+		t.Fatal("mannKendallTrend() should not flag a short series")
+	}
+}
+
+func TestMannKendallTrendSeasonal(t *testing.T) {
+	// Three days of a daily cycle, a minute apart: every six hour window
+	// rises or falls with the cycle.
+	rnd := rand.New(rand.NewSource(9))
+	var ts, leak Measurements
+	for i := 0; i < 3*1440; i++ {
+		v := 100 + 50*math.Sin(2*math.Pi*float64(i)/1440) + rnd.NormFloat64()
+		ts = append(ts, Measurement{v, int64(i * 60)})
+		leak = append(leak, Measurement{v + 0.001*float64(i*60), int64(i * 60)})
+	}
+	if mannKendallTrend(ts, decompose(ts, 0)) {
+		t.Fatal("mannKendallTrend() should not take the side of a daily cycle for a trend")
+	}
+	if !mannKendallTrend(leak, decompose(leak, 0)) {
+		t.Fatal("mannKendallTrend() should flag a leak on top of a daily cycle")
+	}
+}
+
+func TestThinTrend(t *testing.T) {
+	var ts Measurements
+	for i := 0; i < 10; i++ {
+		ts = append(ts, Measurement{float64(i), int64(i * 60)})
+	}
+	if thinned := thinTrend(ts, 10); len(thinned) != 10 {
+		t.Fatal("thinTrend() should keep a short enough series as is but returned", thinned)
+	}
+	want := Measurements{{0, 0}, {2, 180}, {5, 360}, {8, 540}}
+	if thinned := thinTrend(ts, 4); !reflect.DeepEqual(thinned, want) {
+		t.Fatal("thinTrend() should average runs ending at the latest datapoint but returned", thinned)
+	}
+	leak := leakSeries(360, 0.001)
+	if !mannKendall(thinTrend(leak, 50)).significant(mannKendallAlpha) {
+		t.Fatal("thinTrend() should keep a steady leak")
+	}
+}
+
+func TestTimeToThreshold(t *testing.T) {
+	leak := leakSeries(360, 0.001)
+	mt := mannKendall(leak)
+	if math.Abs(mt.Slope-0.001) > 0.0001 {
+		t.Fatal("Sen's slope should be 0.001 but was", mt.Slope)
+	}
+	now := leak[len(leak)-1].timestamp
+	eta, ok := mt.timeToThreshold(200, now)
+	// The line is near 100 + 0.001*21540 at now and rises 0.001 a second.
+	want := now + int64((200-121.54)/0.001)
+	if !ok || math.Abs(float64(eta-want)) > 3600 {
+		t.Fatal("timeToThreshold() should be about", want, "but was", eta, ok)
+	}
+	if _, ok := mt.timeToThreshold(50, now); ok {
+		t.Fatal("timeToThreshold() should not reach a threshold the trend is moving away from")
+	}
+	if _, ok := (monotonicTrend{Intercept: 100}).timeToThreshold(200, now); ok {
+		t.Fatal("timeToThreshold() should not reach a threshold with a flat trend")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// maxProfileLength is the most datapoints a matrix profile is computed over,
+// as its cost grows with the square of their number.
+const maxProfileLength = 20000
+
+// rollingMoments returns the mean and standard deviation of every
+// subsequence of x of length m.
+func rollingMoments(x []float64, m int) ([]float64, []float64) {
+	n := len(x) - m + 1
+	means, stds := make([]float64, n), make([]float64, n)
+	var sum, sumSq float64
+	for i, v := range x {
+		sum += v
+		sumSq += v * v
+		if i >= m {
+			sum -= x[i-m]
+			sumSq -= x[i-m] * x[i-m]
+		}
+		if i >= m-1 {
+			mu := sum / float64(m)
+			means[i-m+1] = mu
+			stds[i-m+1] = math.Sqrt(math.Max(0, sumSq/float64(m)-mu*mu))
+		}
+	}
+	return means, stds
+}
+
+// matrixProfile returns, for every subsequence of x of length m, the
+// z-normalized Euclidean distance to its nearest neighbour among the
+// subsequences that do not overlap it by more than three quarters, and the
+// index of that neighbour. It uses STOMP (Zhu et al. 2016), which updates the
+// dot products of one subsequence with all the others from those of the
+// previous subsequence, in O(n²) time and O(n) space.
+func matrixProfile(x []float64, m int) ([]float64, []int) {
+	n := len(x) - m + 1
+	if m < 2 || n < 2 {
+		return nil, nil
+	}
+	means, stds := rollingMoments(x, m)
+	exclusion := int(math.Ceil(float64(m) / 4))
+
+	first := make([]float64, n)
+	for j := range first {
+		for k := 0; k < m; k++ {
+			first[j] += x[k] * x[j+k]
+		}
+	}
+	profile := make([]float64, n)
+	index := make([]int, n)
+	for i := range profile {
+		profile[i], index[i] = math.Inf(1), -1
+	}
+
+	dot := append([]float64(nil), first...)
+	fm := float64(m)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			for j := n - 1; j > 0; j-- {
+				dot[j] = dot[j-1] - x[i-1]*x[j-1] + x[i+m-1]*x[j+m-1]
+			}
+			dot[0] = first[i]
+		}
+		for j := 0; j < n; j++ {
+			if j > i-exclusion && j < i+exclusion {
+				continue
+			}
+			var d float64
+			switch {
+			case stds[i] == 0 && stds[j] == 0:
+				d = 0
+			case stds[i] == 0 || stds[j] == 0:
+				d = math.Sqrt(fm)
+			default:
+				corr := (dot[j] - fm*means[i]*means[j]) / (fm * stds[i] * stds[j])
+				d = math.Sqrt(math.Max(0, 2*fm*(1-corr)))
+			}
+			if d < profile[i] {
+				profile[i], index[i] = d, j
+			}
+		}
+	}
+	return profile, index
+}
+
+// discord is a subsequence unlike any other in its series.
+type discord struct {
+	Start     int64   `json:"start"`     // timestamp of its first datapoint
+	End       int64   `json:"end"`       // timestamp of its last datapoint
+	Distance  float64 `json:"distance"`  // z-normalized distance to its nearest neighbour
+	Neighbour int64   `json:"neighbour"` // timestamp at which its nearest neighbour starts
+}
+
+// topDiscords returns the k subsequences of ts of length m farthest from
+// their nearest neighbours, most unusual first. Discords do not overlap each
+// other. Unlike the tests on the latest datapoint this finds unusual shapes
+// anywhere in the series, such as a missing nightly batch spike.
+func topDiscords(ts Measurements, m, k int) []discord {
+	profile, index := matrixProfile(ts.values(), m)
+	order := make([]int, len(profile))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return profile[order[a]] > profile[order[b]] })
+
+	var discords []discord
+	var taken []int
+	for _, i := range order {
+		if len(discords) == k {
+			break
+		}
+		if math.IsInf(profile[i], 1) {
+			continue
+		}
+		overlaps := false
+		for _, t := range taken {
+			if i > t-m && i < t+m {
+				overlaps = true
+				break
+			}
+		}
+		if overlaps {
+			continue
+		}
+		taken = append(taken, i)
+		discords = append(discords, discord{
+			Start:     ts[i].timestamp,
+			End:       ts[i+m-1].timestamp,
+			Distance:  profile[i],
+			Neighbour: ts[index[i]].timestamp,
+		})
+	}
+	return discords
+}
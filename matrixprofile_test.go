@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestMatrixProfile(t *testing.T) {
+	x := []float64{1, 2, 3, 1, 2, 3, 1, 2, 3, 5, 0, 4, 1, 2, 3}
+	profile, index := matrixProfile(x, 3)
+	if len(profile) != 13 {
+		t.Fatal("matrixProfile() should return one distance per subsequence but returned", len(profile))
+	}
+	if profile[0] > 1e-6 || index[0]%3 != 0 {
+		t.Fatal("matrixProfile() should match a repeated subsequence exactly but returned", profile[0], index[0])
+	}
+
+	// Compare with the distances computed directly.
+	rnd := rand.New(rand.NewSource(12))
+	y := make([]float64, 60)
+	for i := range y {
+		y[i] = rnd.NormFloat64()
+	}
+	m := 8
+	profile, _ = matrixProfile(y, m)
+	znorm := func(s []float64) []float64 {
+		mu, sd := mean(s), math.Sqrt(variance(s)*float64(len(s)-1)/float64(len(s)))
+		out := make([]float64, len(s))
+		for i, v := range s {
+			out[i] = (v - mu) / sd
+		}
+		return out
+	}
+	for i := range profile {
+		best := math.Inf(1)
+		for j := range profile {
+			if j > i-2 && j < i+2 {
+				continue
+			}
+			a, b := znorm(y[i:i+m]), znorm(y[j:j+m])
+			var d float64
+			for k := range a {
+				d += (a[k] - b[k]) * (a[k] - b[k])
+			}
+			best = math.Min(best, math.Sqrt(d))
+		}
+		if math.Abs(profile[i]-best) > 1e-6 {
+			t.Fatal("matrixProfile() should match the brute force distance at", i, "but returned", profile[i], "for", best)
+		}
+	}
+}
+
+func TestTopDiscords(t *testing.T) {
+	// A nightly batch spike, missing on the fifth night. Every day long
+	// subsequence holds a spike but those around that night.
+	rnd := rand.New(rand.NewSource(13))
+	var ts Measurements
+	for i := 0; i < 7*24; i++ {
+		v := 10 + rnd.NormFloat64()
+		if hour := i % 24; hour == 2 || hour == 3 {
+			v += 50
+		}
+		if i/24 == 4 && (i%24 == 2 || i%24 == 3) {
+			v -= 50
+		}
+		ts = append(ts, Measurement{v, int64(i * 3600)})
+	}
+	discords := topDiscords(ts, 24, 2)
+	if len(discords) != 2 {
+		t.Fatal("topDiscords() should return two discords but returned", discords)
+	}
+	night := int64(4*24+2) * 3600
+	if discords[0].Start > night || discords[0].End < night+3600 {
+		t.Fatal("topDiscords() should find the missing spike at", night, "but returned", discords[0])
+	}
+	if discords[1].Start < discords[0].End && discords[1].End > discords[0].Start {
+		t.Fatal("topDiscords() should not return overlapping discords but returned", discords)
+	}
+	if topDiscords(ts[:3], 6, 2) != nil {
+		t.Fatal("topDiscords() should return nothing for a short series")
+	}
+}
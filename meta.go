@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Tunables of the meta-analysis of trigger history, set from the command
+// line.
+var (
+	// metaAnalysis suppresses anomalies in metrics that trigger on a
+	// regular cadence.
+	metaAnalysis = true
+	// metaSigma is how many standard deviations from the mean interval
+	// between triggers an interval must be for the trigger to stand out.
+	metaSigma = 3.0
+	// metaMinIntervals is the fewest intervals between past triggers from
+	// which a cadence is judged; until then every trigger stands out.
+	metaMinIntervals = 3
+	// metaEpisodeGap is how many seconds a metric must go without triggering
+	// for its next trigger to start a new episode rather than continue the
+	// last one.
+	metaEpisodeGap int64 = 300
+)
+
+// metaHistoryLength is the most triggers kept per metric.
+const metaHistoryLength = 100
+
+// validEpisodeGap returns an error unless gap is long enough for a metric
+// that stays anomalous across analysis passes interval apart to continue
+// one episode.
+func validEpisodeGap(gap, interval time.Duration) error {
+	if gap < interval {
+		return fmt.Errorf("meta episode gap %v is shorter than the analysis interval %v", gap, interval)
+	}
+	return nil
+}
+
+// continuesEpisode reports whether trigger continues the episode of a metric
+// last found anomalous at lastSeen, zero if never.
+func continuesEpisode(lastSeen int64, trigger Measurement) bool {
+	return lastSeen > 0 && trigger.timestamp-lastSeen <= metaEpisodeGap
+}
+
+// triggerHistory keeps the start of each episode in which a metric was found
+// anomalous in the list metricSubKey(name, "triggers"), as "value,timestamp"
+// like its datapoints, for the meta-analysis of isAnomalouslyAnomalous. The
+// time it was last found anomalous and whether its current episode stood out
+// are kept in metricSubKey(name, "meta").
+type triggerHistory struct {
+	client redis.UniversalClient
+}
+
+// load returns the stored triggers of the named metric, oldest first.
+func (th triggerHistory) load(name string) (Measurements, error) {
+	raw, err := th.client.LRange(ctx, metricSubKey(name, "triggers"), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	history := make(Measurements, 0, len(raw))
+	for _, s := range raw {
+		if m, err := parseMeasurement(s); err == nil {
+			history = append(history, m)
+		}
+	}
+	return history, nil
+}
+
+// record notes a trigger of the named metric and reports whether its episode
+// stands out from the metric's past episodes. A trigger continuing the
+// current episode keeps that episode's verdict; one starting a new episode
+// is judged and added to the history.
+func (th triggerHistory) record(name string, trigger Measurement) (bool, error) {
+	meta := metricSubKey(name, "meta")
+	fields, err := th.client.HMGet(ctx, meta, "triggered", "standsOut").Result()
+	if err != nil {
+		return false, err
+	}
+	var lastSeen int64
+	if s, ok := fields[0].(string); ok {
+		lastSeen, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if continuesEpisode(lastSeen, trigger) {
+		standsOut := fields[1] == "1"
+		if trigger.timestamp > lastSeen {
+			err = th.client.HSet(ctx, meta, "triggered", trigger.timestamp).Err()
+		}
+		return standsOut, err
+	}
+	history, err := th.load(name)
+	if err != nil {
+		return false, err
+	}
+	standsOut, _ := isAnomalouslyAnomalous(history, trigger)
+	key := metricSubKey(name, "triggers")
+	value := strconv.FormatFloat(trigger.value, 'f', -1, 64) + "," + strconv.FormatInt(trigger.timestamp, 10)
+	pipe := th.client.Pipeline()
+	pipe.RPush(ctx, key, value)
+	pipe.LTrim(ctx, key, -metaHistoryLength, -1)
+	pipe.HSet(ctx, meta, "triggered", trigger.timestamp, "standsOut", standsOut)
+	_, err = pipe.Exec(ctx)
+	return standsOut, err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContinuesEpisode(t *testing.T) {
+	if continuesEpisode(0, Measurement{1, 1000}) {
+		t.Fatal("continuesEpisode() should start an episode for a metric that never triggered")
+	}
+	// A sustained anomaly found on every one-minute pass.
+	lastSeen := int64(1000)
+	for ts := int64(1060); ts <= 1600; ts += 60 {
+		if !continuesEpisode(lastSeen, Measurement{float64(ts), ts}) {
+			t.Fatal("continuesEpisode() should continue the episode on consecutive passes but started one at", ts)
+		}
+		lastSeen = ts
+	}
+	if continuesEpisode(lastSeen, Measurement{1, lastSeen + metaEpisodeGap + 60}) {
+		t.Fatal("continuesEpisode() should start an episode after the metric went quiet")
+	}
+}
+
+func TestValidEpisodeGap(t *testing.T) {
+	if validEpisodeGap(5*time.Minute, time.Minute) != nil {
+		t.Fatal("validEpisodeGap() should accept a gap longer than the analysis interval")
+	}
+	if validEpisodeGap(30*time.Second, time.Minute) == nil {
+		t.Fatal("validEpisodeGap() should reject a gap shorter than the analysis interval")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// periodAutocorrelation is the least autocorrelation at which a lag is
+	// considered a candidate period.
+	periodAutocorrelation = 0.3
+	// periodPower is how many times the median periodogram power the power
+	// at a candidate period's frequency must be to confirm it.
+	periodPower = 10.0
+	// periodTolerance is how close, as a fraction, a detected period must be
+	// to one of seasonalPeriods to be taken as exactly that period.
+	periodTolerance = 0.05
+	// periodRefresh is how long a detected period is trusted before the
+	// metric is checked again.
+	periodRefresh = 24 * time.Hour
+)
+
+// noPeriod is the period of a metric in which no cycle was detected, as
+// opposed to 0, no period given.
+const noPeriod int64 = -1
+
+// detrend returns x less its least squares line.
+func detrend(x []float64) []float64 {
+	n := float64(len(x))
+	var sumI, sumX, sumII, sumIX float64
+	for i, v := range x {
+		fi := float64(i)
+		sumI += fi
+		sumX += v
+		sumII += fi * fi
+		sumIX += fi * v
+	}
+	slope := 0.0
+	if d := n*sumII - sumI*sumI; d != 0 {
+		slope = (n*sumIX - sumI*sumX) / d
+	}
+	intercept := (sumX - slope*sumI) / n
+	out := make([]float64, len(x))
+	for i, v := range x {
+		out[i] = v - intercept - slope*float64(i)
+	}
+	return out
+}
+
+// autocorrelation returns the autocorrelation of x at lags 0 to maxLag,
+// computed through the FFT of x padded with zeros to twice its length.
+func autocorrelation(x []float64, maxLag int) []float64 {
+	m := mean(x)
+	padded := make([]float64, 2*len(x))
+	for i, v := range x {
+		padded[i] = v - m
+	}
+	spectrum := fftReal(padded)
+	for i, c := range spectrum {
+		spectrum[i] = complex(real(c)*real(c)+imag(c)*imag(c), 0)
+	}
+	raw := ifft(spectrum)
+	acf := make([]float64, maxLag+1)
+	if real(raw[0]) == 0 {
+		return acf
+	}
+	for lag := range acf {
+		acf[lag] = real(raw[lag]) / real(raw[0])
+	}
+	return acf
+}
+
+// periodogram returns the power of x at each frequency k/len(x), for k from 0
+// to len(x)/2.
+func periodogram(x []float64) []float64 {
+	spectrum := fftReal(x)
+	power := make([]float64, len(x)/2+1)
+	for k := range power {
+		a := cmplx.Abs(spectrum[k])
+		power[k] = a * a / float64(len(x))
+	}
+	return power
+}
+
+// dominantPeriod returns the period of x in datapoints, or 0 when it has
+// none. The candidate is the lag of the highest local maximum of the
+// autocorrelation among those of at least two full cycles, and it is only
+// accepted if the periodogram confirms a peak at the matching frequency, so
+// that slow trends and noise do not pass for cycles.
+func dominantPeriod(x []float64) int {
+	n := len(x)
+	if n < 8 {
+		return 0
+	}
+	x = detrend(x)
+	acf := autocorrelation(x, n/2)
+	best := 0
+	for lag := 2; lag < n/2; lag++ {
+		if acf[lag] > acf[lag-1] && acf[lag] >= acf[lag+1] && acf[lag] > periodAutocorrelation {
+			if best == 0 || acf[lag] > acf[best] {
+				best = lag
+			}
+		}
+	}
+	if best == 0 {
+		return 0
+	}
+
+	power := periodogram(x)
+	typical := median(power[1:])
+	k := int(math.Floor(float64(n)/float64(best) + 0.5))
+	peak := 0.0
+	for i := k - 1; i <= k+1; i++ {
+		if i >= 1 && i < len(power) {
+			peak = math.Max(peak, power[i])
+		}
+	}
+	if typical > 0 && peak < periodPower*typical {
+		return 0
+	}
+	return best
+}
+
+// detectPeriod returns the length in seconds of the dominant cycle of ts, or
+// noPeriod when it has none. Periods within periodTolerance of a day or a week are
+// rounded to exactly that.
+func detectPeriod(ts Measurements) int64 {
+	interval := samplingInterval(ts)
+	if interval <= 0 {
+		return noPeriod
+	}
+	p := dominantPeriod(ts.values())
+	if p == 0 {
+		return noPeriod
+	}
+	seconds := int64(p) * interval
+	for _, s := range seasonalPeriods {
+		if math.Abs(float64(seconds-s)) <= periodTolerance*float64(s) {
+			return s
+		}
+	}
+	return seconds
+}
+
+// periodKind names a period in seconds.
+func periodKind(seconds int64) string {
+	switch seconds {
+	case 0, noPeriod:
+		return "none"
+	case 86400:
+		return "daily"
+	case 7 * 86400:
+		return "weekly"
+	}
+	return "other"
+}
+
+type detectedPeriod struct {
+	seconds  int64
+	detected int64 // unix time of detection
+}
+
+// metricPeriods detects the seasonal period of each metric and keeps it as
+// metadata, in the "period" and "periodDetected" fields of
+// metricSubKey(name, "meta"), so that the seasonal algorithms need no
+// configuration per metric. Periods are detected again once older than
+// periodRefresh. A period is only kept once ts spans two of its cycles, and
+// the lack of one once ts spans two of the longest of seasonalPeriods, so
+// that a young metric is not taken to have no cycle for a day.
+type metricPeriods struct {
+	client redis.UniversalClient
+
+	mu      sync.Mutex
+	periods map[string]detectedPeriod
+}
+
+func newMetricPeriods(client redis.UniversalClient) *metricPeriods {
+	return &metricPeriods{client: client, periods: make(map[string]detectedPeriod)}
+}
+
+// period returns the seasonal period of ts, the series of the named metric,
+// in seconds: the configured one if any, else the stored one, detecting and
+// storing it if it is missing or stale. noPeriod means the metric has no
+// cycle.
+func (mp *metricPeriods) period(name string, ts Measurements, configured int64) (int64, error) {
+	if configured > 0 {
+		return configured, nil
+	}
+	now := time.Now().Unix()
+	mp.mu.Lock()
+	p, ok := mp.periods[name]
+	mp.mu.Unlock()
+
+	if !ok {
+		fields, err := mp.client.HMGet(ctx, metricSubKey(name, "meta"), "period", "periodDetected").Result()
+		if err != nil {
+			return 0, err
+		}
+		if s, ok := fields[0].(string); ok {
+			p.seconds, _ = strconv.ParseInt(s, 10, 64)
+		}
+		if s, ok := fields[1].(string); ok {
+			p.detected, _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	if now-p.detected > int64(periodRefresh.Seconds()) {
+		seconds := detectPeriod(ts)
+		if !spansCycles(ts, seconds) {
+			return seconds, nil
+		}
+		p = detectedPeriod{seconds, now}
+		err := mp.client.HSet(ctx, metricSubKey(name, "meta"), "period", p.seconds, "periodDetected", p.detected).Err()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	mp.mu.Lock()
+	mp.periods[name] = p
+	mp.mu.Unlock()
+	return p.seconds, nil
+}
+
+// spansCycles reports whether ts spans two cycles of the given period, or of
+// the longest of seasonalPeriods for noPeriod.
+func spansCycles(ts Measurements, seconds int64) bool {
+	if len(ts) == 0 {
+		return false
+	}
+	if seconds == noPeriod {
+		seconds = seasonalPeriods[0]
+	}
+	return ts[len(ts)-1].timestamp-ts[0].timestamp >= 2*seconds
+}
+
+// forget drops the cached period of a removed metric.
+func (mp *metricPeriods) forget(name string) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	delete(mp.periods, name)
+}
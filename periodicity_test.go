@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestAutocorrelation(t *testing.T) {
+	x := []float64{1, 3, 2, 5, 4, 6, 2, 1}
+	acf := autocorrelation(x, 3)
+	m := mean(x)
+	var c0, c2 float64
+	for i := range x {
+		c0 += (x[i] - m) * (x[i] - m)
+		if i >= 2 {
+			c2 += (x[i] - m) * (x[i-2] - m)
+		}
+	}
+	if acf[0] != 1 || round(acf[2], 9) != round(c2/c0, 9) {
+		t.Fatal("autocorrelation() should match its definition but returned", acf)
+	}
+}
+
+func TestDetectPeriod(t *testing.T) {
+	if p := detectPeriod(seasonalSeries(5)); p != 86400 {
+		t.Fatal("detectPeriod() should find the daily cycle but returned", p)
+	}
+
+	// Busy weekdays and quiet weekends, on top of a daily cycle.
+	rnd := rand.New(rand.NewSource(11))
+	var weekly, sixHourly, noise, trend Measurements
+	for i := 0; i < 28*24; i++ {
+		v := 100 + 20*math.Sin(2*math.Pi*float64(i)/24) + rnd.NormFloat64()
+		if day := (i / 24) % 7; day >= 5 {
+			v -= 60
+		}
+		weekly = append(weekly, Measurement{v, int64(i * 3600)})
+		sixHourly = append(sixHourly, Measurement{math.Sin(2*math.Pi*float64(i)/6) + 0.3*rnd.NormFloat64(), int64(i * 3600)})
+		noise = append(noise, Measurement{rnd.NormFloat64(), int64(i * 3600)})
+		trend = append(trend, Measurement{float64(i) + rnd.NormFloat64(), int64(i * 3600)})
+	}
+	if p := detectPeriod(weekly); p != 7*86400 || periodKind(p) != "weekly" {
+		t.Fatal("detectPeriod() should find the weekly cycle but returned", p)
+	}
+	if p := detectPeriod(sixHourly); p != 6*3600 || periodKind(p) != "other" {
+		t.Fatal("detectPeriod() should find the six hour cycle but returned", p)
+	}
+	if p := detectPeriod(noise); p != noPeriod {
+		t.Fatal("detectPeriod() should find no cycle in noise but returned", p)
+	}
+	if p := detectPeriod(trend); p != noPeriod {
+		t.Fatal("detectPeriod() should find no cycle in a trend but returned", p)
+	}
+}
+
+func TestSpansCycles(t *testing.T) {
+	daily := seasonalSeries(5)
+	if !spansCycles(daily, 86400) {
+		t.Fatal("spansCycles() should accept a daily cycle in five days of data")
+	}
+	if spansCycles(daily, 3*86400) {
+		t.Fatal("spansCycles() should reject a three day cycle in five days of data")
+	}
+	if spansCycles(daily, noPeriod) || !spansCycles(seasonalSeries(15), noPeriod) {
+		t.Fatal("spansCycles() should only accept no cycle in two weeks of data")
+	}
+	if spansCycles(nil, 86400) {
+		t.Fatal("spansCycles() should reject an empty series")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+// Data quality requirements a metric's stored series must meet before it is
+// analyzed, set from the command line.
+var (
+	// qualityMinPoints is the fewest datapoints analyzed.
+	qualityMinPoints = 10
+	// qualityMinSpan is the shortest time in seconds the datapoints must
+	// cover.
+	qualityMinSpan int64 = 3600
+	// qualityMaxGapRatio is the largest share of that time that may fall in
+	// gaps, stretches between datapoints longer than qualityGapFactor
+	// sampling intervals.
+	qualityMaxGapRatio = 0.5
+	// qualityMaxSparsity is the largest share of datapoints that may be
+	// zero, above which every blip of a mostly idle metric would stand out.
+	// It is off by default, as such a blip may be the anomaly looked for.
+	qualityMaxSparsity = 1.0
+)
+
+const qualityGapFactor = 3
+
+// Reasons a metric is not analyzed.
+const (
+	reasonTooFewPoints = "too few datapoints"
+	reasonTooShort     = "too short a history"
+	reasonGaps         = "too many gaps"
+	reasonSparse       = "mostly zero"
+	reasonConstant     = "constant"
+)
+
+// skippedMetric is a metric left out of an analysis pass and why.
+type skippedMetric struct {
+	Metric string `json:"metric"`
+	Reason string `json:"reason"`
+}
+
+// gapRatio returns the share of the time covered by ts that falls in gaps,
+// intervals between datapoints longer than qualityGapFactor times the
+// median interval.
+func gapRatio(ts Measurements) float64 {
+	interval := samplingInterval(ts)
+	span := ts[len(ts)-1].timestamp - ts[0].timestamp
+	if interval <= 0 || span <= 0 {
+		return 0
+	}
+	var gaps int64
+	for i := 1; i < len(ts); i++ {
+		if d := ts[i].timestamp - ts[i-1].timestamp; d > qualityGapFactor*interval {
+			gaps += d - interval
+		}
+	}
+	return float64(gaps) / float64(span)
+}
+
+// checkQuality returns ts without its NaN and infinite values, which the
+// algorithms cannot handle, and the reason it is not fit for analysis, or
+// the empty string when it is.
+func checkQuality(ts Measurements) (Measurements, string) {
+	clean := make(Measurements, 0, len(ts))
+	for _, m := range ts {
+		if !unDef(m.value) {
+			clean = append(clean, m)
+		}
+	}
+	if len(clean) < qualityMinPoints || len(clean) < 2 {
+		return clean, reasonTooFewPoints
+	}
+	if clean[len(clean)-1].timestamp-clean[0].timestamp < qualityMinSpan {
+		return clean, reasonTooShort
+	}
+	if gapRatio(clean) > qualityMaxGapRatio {
+		return clean, reasonGaps
+	}
+	zeros := 0
+	constant := true
+	for _, m := range clean {
+		if m.value == 0 {
+			zeros++
+		}
+		constant = constant && m.value == clean[0].value
+	}
+	if constant {
+		return clean, reasonConstant
+	}
+	if float64(zeros)/float64(len(clean)) > qualityMaxSparsity {
+		return clean, reasonSparse
+	}
+	return clean, ""
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// minutely returns a datapoint a minute for each value.
+func minutely(values []float64) Measurements {
+	var ts Measurements
+	for i, v := range values {
+		ts = append(ts, Measurement{v, int64(i * 60)})
+	}
+	return ts
+}
+
+func TestCheckQuality(t *testing.T) {
+	values := make([]float64, 120)
+	for i := range values {
+		values[i] = float64(i % 7)
+	}
+	if _, reason := checkQuality(minutely(values)); reason != "" {
+		t.Fatal("checkQuality() should pass two hours of varying data but returned", reason)
+	}
+
+	withNaN := minutely(values)
+	withNaN[5].value, withNaN[9].value = math.NaN(), math.Inf(1)
+	clean, reason := checkQuality(withNaN)
+	if reason != "" || len(clean) != 118 {
+		t.Fatal("checkQuality() should drop undefined values but returned", len(clean), reason)
+	}
+
+	gappy := append(minutely(values[:40]), minutely(values[:40])...)
+	for i := 40; i < 80; i++ {
+		gappy[i].timestamp += 4 * 3600
+	}
+	sparse := make([]float64, 120)
+	sparse[60] = 1
+	constant := make([]float64, 120)
+	for i := range constant {
+		constant[i] = 3
+	}
+	for _, c := range []struct {
+		ts     Measurements
+		reason string
+	}{
+		{nil, reasonTooFewPoints},
+		{minutely(values[:5]), reasonTooFewPoints},
+		{minutely(values[:30]), reasonTooShort},
+		{gappy, reasonGaps},
+		{minutely(constant), reasonConstant},
+	} {
+		if _, reason := checkQuality(c.ts); reason != c.reason {
+			t.Fatal("checkQuality() should return", c.reason, "but returned", reason)
+		}
+	}
+
+	if _, reason := checkQuality(minutely(sparse)); reason != "" {
+		t.Fatal("checkQuality() should pass mostly zero data by default but returned", reason)
+	}
+	defer func(share float64) { qualityMaxSparsity = share }(qualityMaxSparsity)
+	qualityMaxSparsity = 0.9
+	if _, reason := checkQuality(minutely(sparse)); reason != reasonSparse {
+		t.Fatal("checkQuality() should return", reasonSparse, "with -max-sparsity 0.9 but returned", reason)
+	}
+}
+
+func TestGapRatio(t *testing.T) {
+	ts := minutely([]float64{1, 2, 3, 4, 5})
+	if gapRatio(ts) != 0 {
+		t.Fatal("gapRatio() should be zero for evenly spaced data but was", gapRatio(ts))
+	}
+	ts[4].timestamp = 840
+	// An eleven minute interval in fourteen minutes, less the one expected.
+	if round(gapRatio(ts), 4) != round(10.0/14, 4) {
+		t.Fatal("gapRatio() should be 10/14 but was", gapRatio(ts))
+	}
+}
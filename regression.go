@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// invert returns the inverse of the square matrix a by Gauss-Jordan
+// elimination with partial pivoting, and false if a is singular.
+func invert(a [][]float64) ([][]float64, bool) {
+	n := len(a)
+	m := make([][]float64, n)
+	inv := make([][]float64, n)
+	for i := range a {
+		m[i] = append([]float64(nil), a[i]...)
+		inv[i] = make([]float64, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		scale := m[col][col]
+		for j := 0; j < n; j++ {
+			m[col][j] /= scale
+			inv[col][j] /= scale
+		}
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			f := m[row][col]
+			for j := 0; j < n; j++ {
+				m[row][j] -= f * m[col][j]
+				inv[row][j] -= f * inv[col][j]
+			}
+		}
+	}
+	return inv, true
+}
+
+// olsFit is an ordinary least squares fit of y on the columns of a design
+// matrix.
+type olsFit struct {
+	coef      []float64
+	stderr    []float64 // standard error of each coefficient
+	residuals []float64
+	sse       float64
+}
+
+// ols regresses y on the rows of x, each holding the regressors of one
+// observation, through the normal equations. It reports false when there are
+// no more observations than regressors or the regressors are collinear.
+func ols(x [][]float64, y []float64) (olsFit, bool) {
+	n := len(y)
+	if n == 0 || n <= len(x[0]) {
+		return olsFit{}, false
+	}
+	k := len(x[0])
+	xtx := make([][]float64, k)
+	xty := make([]float64, k)
+	for i := range xtx {
+		xtx[i] = make([]float64, k)
+	}
+	for r, row := range x {
+		for i := 0; i < k; i++ {
+			xty[i] += row[i] * y[r]
+			for j := 0; j <= i; j++ {
+				xtx[i][j] += row[i] * row[j]
+			}
+		}
+	}
+	for i := 0; i < k; i++ {
+		for j := i + 1; j < k; j++ {
+			xtx[i][j] = xtx[j][i]
+		}
+	}
+	inv, ok := invert(xtx)
+	if !ok {
+		return olsFit{}, false
+	}
+
+	fit := olsFit{coef: make([]float64, k), stderr: make([]float64, k), residuals: make([]float64, n)}
+	for i := 0; i < k; i++ {
+		for j := 0; j < k; j++ {
+			fit.coef[i] += inv[i][j] * xty[j]
+		}
+	}
+	for r, row := range x {
+		fitted := 0.0
+		for i, v := range row {
+			fitted += fit.coef[i] * v
+		}
+		fit.residuals[r] = y[r] - fitted
+		fit.sse += fit.residuals[r] * fit.residuals[r]
+	}
+	s2 := fit.sse / float64(n-k)
+	for i := range fit.stderr {
+		fit.stderr[i] = math.Sqrt(math.Max(0, s2*inv[i][i]))
+	}
+	return fit, true
+}
+
+// Methods of fitting the trend line of leastSquares, set from the command
+// line. The robust methods keep the anomalies being looked for from
+// dragging the line towards them and hiding themselves, at a cost: Huber
+// regression iterates over the series and Theil-Sen takes the median of up
+// to theilSenPairs slopes, so they are opt-in.
+const (
+	trendOLS      = "ols"
+	trendTheilSen = "theilsen"
+	trendHuber    = "huber"
+)
+
+var (
+	// trendMethod is how leastSquares fits its trend line.
+	trendMethod = trendOLS
+	// trendChecks makes leastSquares abstain when the residuals of its
+	// trend line violate the assumptions of the test.
+	trendChecks bool
+)
+
+const (
+	// theilSenPairs is the most pairs of datapoints whose slopes the
+	// Theil-Sen estimator takes the median of; longer series are sampled.
+	theilSenPairs = 250000
+	// huberK is the Huber loss tuning constant in robust standard
+	// deviations, for 95% efficiency on normal errors.
+	huberK = 1.345
+	// durbinWatsonLow is the Durbin-Watson statistic below which residuals
+	// are taken to be positively autocorrelated.
+	durbinWatsonLow = 1.0
+	// heteroscedasticityLevel is the significance level of the
+	// Breusch-Pagan test.
+	heteroscedasticityLevel = 0.01
+)
+
+// trendFit is a straight line fitted to a series, its residuals and their
+// diagnostics.
+type trendFit struct {
+	Method    string    `json:"method"`
+	Intercept float64   `json:"intercept"`
+	Slope     float64   `json:"slope"`
+	Scale     float64   `json:"scale"` // standard deviation of the residuals, estimated robustly by the robust methods
+	Residuals []float64 `json:"-"`
+	// DurbinWatson is near 2 for independent residuals and near 0 for
+	// positively autocorrelated ones.
+	DurbinWatson float64 `json:"durbinWatson"`
+	// BreuschPagan is the p-value of the Breusch-Pagan test that the
+	// variance of the residuals changes with time.
+	BreuschPagan float64 `json:"breuschPagan"`
+}
+
+// validTrendMethod returns an error unless method is one of the trend
+// fitting methods.
+func validTrendMethod(method string) error {
+	switch method {
+	case trendOLS, trendTheilSen, trendHuber:
+		return nil
+	}
+	return fmt.Errorf("unknown trend method %q, want %s, %s or %s", method, trendOLS, trendTheilSen, trendHuber)
+}
+
+// theilSen returns the intercept and slope of the Theil-Sen line through the
+// points (x, y): the median of the slopes between pairs of points, and the
+// median of the intercepts through every point with that slope. Up to 29% of
+// the points can be arbitrarily wrong without moving it far.
+func theilSen(x, y []float64) (float64, float64) {
+	n := len(x)
+	var slopes []float64
+	add := func(i, j int) {
+		if x[i] != x[j] {
+			slopes = append(slopes, (y[j]-y[i])/(x[j]-x[i]))
+		}
+	}
+	if n*(n-1)/2 <= theilSenPairs {
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				add(i, j)
+			}
+		}
+	} else {
+		rnd := rand.New(rand.NewSource(1))
+		for k := 0; k < theilSenPairs; k++ {
+			add(rnd.Intn(n), rnd.Intn(n))
+		}
+	}
+	if len(slopes) == 0 {
+		return median(y), 0
+	}
+	slope := median(slopes)
+	intercepts := make([]float64, n)
+	for i := range x {
+		intercepts[i] = y[i] - slope*x[i]
+	}
+	return median(intercepts), slope
+}
+
+// huber returns the intercept and slope of the line through (x, y) that
+// minimizes the Huber loss of the residuals, by iteratively reweighted least
+// squares from the ordinary least squares line. Residuals within huberK
+// robust standard deviations count fully and larger ones in proportion to
+// their size, so outliers pull the line less.
+func huber(x, y []float64) (float64, float64) {
+	n := len(x)
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	var intercept, slope float64
+	for iter := 0; iter < 50; iter++ {
+		var sw, swx, swy float64
+		for i := range x {
+			sw += weights[i]
+			swx += weights[i] * x[i]
+			swy += weights[i] * y[i]
+		}
+		mx, my := swx/sw, swy/sw
+		var sxx, sxy float64
+		for i := range x {
+			sxx += weights[i] * (x[i] - mx) * (x[i] - mx)
+			sxy += weights[i] * (x[i] - mx) * (y[i] - my)
+		}
+		next := 0.0
+		if sxx > 0 {
+			next = sxy / sxx
+		}
+		converged := iter > 0 && math.Abs(next-slope) <= 1e-9*math.Max(1, math.Abs(slope))
+		slope, intercept = next, my-next*mx
+
+		residuals := make([]float64, n)
+		for i := range x {
+			residuals[i] = y[i] - intercept - slope*x[i]
+		}
+		scale := robustScale(residuals)
+		if converged || scale == 0 {
+			break
+		}
+		for i, r := range residuals {
+			weights[i] = 1
+			if a := math.Abs(r); a > huberK*scale {
+				weights[i] = huberK * scale / a
+			}
+		}
+	}
+	return intercept, slope
+}
+
+// robustScale estimates the standard deviation of x from its median absolute
+// deviation, scaled to agree with the standard deviation of normal data.
+func robustScale(x []float64) float64 {
+	med := median(x)
+	deviations := make([]float64, len(x))
+	for i, v := range x {
+		deviations[i] = math.Abs(v - med)
+	}
+	return 1.4826 * median(deviations)
+}
+
+// durbinWatson returns the Durbin-Watson statistic of a series of residuals,
+// or 2 when they are all zero.
+func durbinWatson(residuals []float64) float64 {
+	var num, den float64
+	for i, e := range residuals {
+		den += e * e
+		if i > 0 {
+			d := e - residuals[i-1]
+			num += d * d
+		}
+	}
+	if den == 0 {
+		return 2
+	}
+	return num / den
+}
+
+// breuschPagan returns the p-value of the studentized Breusch-Pagan test for
+// heteroscedasticity of residuals against the regressor x: n times the R² of
+// the squared residuals regressed on x is chi-squared with one degree of
+// freedom when their variance does not depend on x.
+func breuschPagan(x, residuals []float64) float64 {
+	n := len(x)
+	if n < 3 {
+		return 1
+	}
+	squared := make([]float64, n)
+	for i, e := range residuals {
+		squared[i] = e * e
+	}
+	varX, varSq := variance(x), variance(squared)
+	if varX == 0 || varSq == 0 {
+		return 1
+	}
+	c := cov(x, squared)
+	r2 := c * c / (varX * varSq)
+	lm := float64(n) * r2
+	return math.Erfc(math.Sqrt(lm / 2))
+}
+
+// fitTrend fits a straight line through the values of ts against their
+// timestamps with the given method, and diagnoses its residuals.
+func fitTrend(ts Measurements, method string) trendFit {
+	fit := trendFit{Method: method}
+	if len(ts) == 0 {
+		return fit
+	}
+	x := make([]float64, len(ts))
+	y := ts.values()
+	// Timestamps are taken relative to the first to keep the sums precise.
+	for i, m := range ts {
+		x[i] = float64(m.timestamp - ts[0].timestamp)
+	}
+	switch method {
+	case trendTheilSen:
+		fit.Intercept, fit.Slope = theilSen(x, y)
+	case trendHuber:
+		fit.Intercept, fit.Slope = huber(x, y)
+	default:
+		fit.Intercept, fit.Slope = linearRegressionLSE(ts)
+		fit.Intercept += fit.Slope * float64(ts[0].timestamp)
+	}
+	fit.Residuals = make([]float64, len(ts))
+	for i := range x {
+		fit.Residuals[i] = y[i] - fit.Intercept - fit.Slope*x[i]
+	}
+	if method == trendOLS {
+		fit.Scale = std(fit.Residuals)
+	} else {
+		fit.Scale = robustScale(fit.Residuals)
+	}
+	fit.Intercept -= fit.Slope * float64(ts[0].timestamp)
+	fit.DurbinWatson = durbinWatson(fit.Residuals)
+	fit.BreuschPagan = breuschPagan(x, fit.Residuals)
+	return fit
+}
+
+// wellSpecified reports whether the residuals of a trend line look
+// independent and of constant variance, as the three sigma test of
+// leastSquares assumes.
+func (fit trendFit) wellSpecified() bool {
+	return fit.DurbinWatson >= durbinWatsonLow && fit.BreuschPagan >= heteroscedasticityLevel
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// trendSeries returns n datapoints a minute apart on the line 10 + 0.01t with
+// normal noise of deviation 2, the last few of them replaced by outliers.
+func trendSeries(n, outliers int) Measurements {
+	rnd := rand.New(rand.NewSource(5))
+	var ts Measurements
+	for i := 0; i < n; i++ {
+		t := int64(1500000000 + i*60)
+		v := 10 + 0.01*float64(t-1500000000) + 2*rnd.NormFloat64()
+		if i >= n-outliers {
+			v += 100
+		}
+		ts = append(ts, Measurement{v, t})
+	}
+	return ts
+}
+
+func TestRobustTrend(t *testing.T) {
+	ts := trendSeries(200, 20)
+	for _, method := range []string{trendTheilSen, trendHuber} {
+		fit := fitTrend(ts, method)
+		if math.Abs(fit.Slope-0.01) > 0.001 {
+			t.Fatal(method, "should not be pulled by outliers but found slope", fit.Slope)
+		}
+		if math.Abs(fit.Scale-2) > 0.5 {
+			t.Fatal(method, "should estimate the noise deviation as 2 but found", fit.Scale)
+		}
+		at := fit.Intercept + fit.Slope*float64(ts[0].timestamp)
+		if math.Abs(at-10) > 2 {
+			t.Fatal(method, "should find the line at 10 at the start but found", at)
+		}
+	}
+	if fit := fitTrend(ts, trendOLS); math.Abs(fit.Slope-0.01) < 0.002 {
+		t.Fatal("ordinary least squares should be pulled by the outliers but found slope", fit.Slope)
+	}
+}
+
+func TestTrendDiagnostics(t *testing.T) {
+	if dw := durbinWatson([]float64{1, -1, 1, -1, 1, -1}); dw < 3 {
+		t.Fatal("durbinWatson() should be near 4 for alternating residuals but was", dw)
+	}
+	if dw := durbinWatson([]float64{1, 1, 1, -1, -1, -1}); dw > 1 {
+		t.Fatal("durbinWatson() should be near 0 for autocorrelated residuals but was", dw)
+	}
+	if !fitTrend(trendSeries(200, 0), trendHuber).wellSpecified() {
+		t.Fatal("a line with independent noise should be well specified")
+	}
+
+	// Noise that grows with time.
+	rnd := rand.New(rand.NewSource(6))
+	var ts Measurements
+	for i := 0; i < 300; i++ {
+		ts = append(ts, Measurement{float64(i) * rnd.NormFloat64(), int64(i)})
+	}
+	fit := fitTrend(ts, trendOLS)
+	if fit.BreuschPagan > heteroscedasticityLevel || fit.wellSpecified() {
+		t.Fatal("breuschPagan() should find growing noise heteroscedastic but returned", fit.BreuschPagan)
+	}
+}
+
+func TestLeastSquaresMethods(t *testing.T) {
+	ts := trendSeries(200, 1)
+	ts[len(ts)-1].value += 10000
+	defer func(method string) { trendMethod = method }(trendMethod)
+	for _, method := range []string{trendTheilSen, trendHuber} {
+		trendMethod = method
+		if !leastSquares(ts) {
+			t.Fatal("leastSquares() should flag an outlier with the", method, "trend")
+		}
+		if leastSquares(trendSeries(200, 0)) {
+			t.Fatal("leastSquares() should not flag a regular trend with the", method, "trend")
+		}
+	}
+	if validTrendMethod("lasso") == nil {
+		t.Fatal("validTrendMethod() should refuse an unknown method")
+	}
+}
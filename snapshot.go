@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Snapshots hold a set of stored series in one of three formats:
+//
+//	csv     a metric,timestamp,value header then one row per datapoint, in
+//	        any order
+//	jsonl   one {"metric": ..., "datapoints": [[timestamp, value], ...]} object
+//	        per line, with NaN and infinite values as the strings "NaN",
+//	        "+Inf" and "-Inf"
+//	binary  the magic "KAAS1" then, for each series, the uvarint length of its
+//	        name, the name, the uvarint number of datapoints and for each
+//	        datapoint the zigzag varint delta of its timestamp from the previous
+//	        one and the little endian IEEE 754 bits of its value
+
+const binaryMagic = "KAAS1"
+
+// maxNameLength bounds the metric names read from binary snapshots; received
+// names cannot be longer than the 512 byte datagrams they arrive in.
+const maxNameLength = 512
+
+type snapshotWriter interface {
+	write(name string, ts Measurements) error
+	close() error
+}
+
+type snapshotReader interface {
+	// next returns the next series, or io.EOF when there are no more.
+	next() (string, Measurements, error)
+}
+
+// snapshotFormat returns format, or the format implied by the extension of
+// path when format is empty.
+func snapshotFormat(format, path string) (string, error) {
+	if format == "" {
+		switch filepath.Ext(path) {
+		case ".csv":
+			format = "csv"
+		case ".jsonl":
+			format = "jsonl"
+		case ".bin", ".kaas":
+			format = "binary"
+		}
+	}
+	switch format {
+	case "csv", "jsonl", "binary":
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown snapshot format %q", format)
+}
+
+func newSnapshotWriter(format string, w io.Writer) snapshotWriter {
+	switch format {
+	case "csv":
+		return newCSVSnapshotWriter(w)
+	case "jsonl":
+		return &jsonSnapshotWriter{w: bufio.NewWriter(w)}
+	default:
+		return &binarySnapshotWriter{w: bufio.NewWriter(w)}
+	}
+}
+
+func newSnapshotReader(format string, r io.Reader) snapshotReader {
+	switch format {
+	case "csv":
+		return &csvSnapshotReader{r: csv.NewReader(r)}
+	case "jsonl":
+		return &jsonSnapshotReader{r: json.NewDecoder(r)}
+	default:
+		return &binarySnapshotReader{r: bufio.NewReader(r)}
+	}
+}
+
+type csvSnapshotWriter struct {
+	w *csv.Writer
+}
+
+func newCSVSnapshotWriter(w io.Writer) *csvSnapshotWriter {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"metric", "timestamp", "value"})
+	return &csvSnapshotWriter{w: cw}
+}
+
+func (s *csvSnapshotWriter) write(name string, ts Measurements) error {
+	for _, m := range ts {
+		err := s.w.Write([]string{name, strconv.FormatInt(m.timestamp, 10), strconv.FormatFloat(m.value, 'g', -1, 64)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *csvSnapshotWriter) close() error {
+	s.w.Flush()
+	return s.w.Error()
+}
+
+// csvSnapshotReader reads the whole file on the first call to next and groups
+// its rows by metric, so that the rows of a metric need not be contiguous.
+// Series are returned in the order their metrics first appear.
+type csvSnapshotReader struct {
+	r       *csv.Reader
+	started bool
+	names   []string
+	series  map[string]Measurements
+}
+
+func (s *csvSnapshotReader) next() (string, Measurements, error) {
+	if !s.started {
+		s.started = true
+		if err := s.readAll(); err != nil {
+			return "", nil, err
+		}
+	}
+	if len(s.names) == 0 {
+		return "", nil, io.EOF
+	}
+	name := s.names[0]
+	s.names = s.names[1:]
+	ts := s.series[name]
+	delete(s.series, name)
+	return name, ts, nil
+}
+
+func (s *csvSnapshotReader) readAll() error {
+	header, err := s.r.Read()
+	if err != nil {
+		return err
+	}
+	if len(header) != 3 || header[0] != "metric" {
+		return errors.New("csv snapshot has no metric,timestamp,value header")
+	}
+	s.series = make(map[string]Measurements)
+	for {
+		row, err := s.r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		timestamp, err := strconv.ParseInt(row[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		value, err := strconv.ParseFloat(row[2], 64)
+		if err != nil {
+			return err
+		}
+		name := row[0]
+		if _, ok := s.series[name]; !ok {
+			s.names = append(s.names, name)
+		}
+		s.series[name] = append(s.series[name], Measurement{value, timestamp})
+	}
+}
+
+type jsonSeries struct {
+	Metric     string         `json:"metric"`
+	Datapoints [][2]jsonValue `json:"datapoints"`
+}
+
+// jsonValue is a number in a JSON lines snapshot. JSON has no NaN or
+// infinities, so those are written as strings, as strconv formats them, and
+// read back from strings as well as numbers.
+type jsonValue float64
+
+func (v jsonValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return json.Marshal(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return json.Marshal(f)
+}
+
+func (v *jsonValue) UnmarshalJSON(b []byte) error {
+	var f float64
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		parsed, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f = parsed
+	} else if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	*v = jsonValue(f)
+	return nil
+}
+
+type jsonSnapshotWriter struct {
+	w *bufio.Writer
+}
+
+func (s *jsonSnapshotWriter) write(name string, ts Measurements) error {
+	js := jsonSeries{Metric: name, Datapoints: make([][2]jsonValue, len(ts))}
+	for i, m := range ts {
+		js.Datapoints[i] = [2]jsonValue{jsonValue(m.timestamp), jsonValue(m.value)}
+	}
+	line, err := json.Marshal(js)
+	if err != nil {
+		return err
+	}
+	s.w.Write(line)
+	return s.w.WriteByte('\n')
+}
+
+func (s *jsonSnapshotWriter) close() error {
+	return s.w.Flush()
+}
+
+type jsonSnapshotReader struct {
+	r *json.Decoder
+}
+
+func (s *jsonSnapshotReader) next() (string, Measurements, error) {
+	var js jsonSeries
+	if err := s.r.Decode(&js); err != nil {
+		return "", nil, err
+	}
+	ts := make(Measurements, len(js.Datapoints))
+	for i, dp := range js.Datapoints {
+		ts[i] = Measurement{float64(dp[1]), int64(dp[0])}
+	}
+	return js.Metric, ts, nil
+}
+
+type binarySnapshotWriter struct {
+	w       *bufio.Writer
+	started bool
+}
+
+func (s *binarySnapshotWriter) write(name string, ts Measurements) error {
+	if !s.started {
+		s.started = true
+		s.w.WriteString(binaryMagic)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	s.w.Write(buf[:binary.PutUvarint(buf, uint64(len(name)))])
+	s.w.WriteString(name)
+	s.w.Write(buf[:binary.PutUvarint(buf, uint64(len(ts)))])
+	var prev int64
+	for _, m := range ts {
+		s.w.Write(buf[:binary.PutVarint(buf, m.timestamp-prev)])
+		prev = m.timestamp
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(m.value))
+		if _, err := s.w.Write(buf[:8]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *binarySnapshotWriter) close() error {
+	if !s.started {
+		s.w.WriteString(binaryMagic)
+	}
+	return s.w.Flush()
+}
+
+type binarySnapshotReader struct {
+	r       *bufio.Reader
+	started bool
+}
+
+func (s *binarySnapshotReader) next() (string, Measurements, error) {
+	if !s.started {
+		s.started = true
+		magic := make([]byte, len(binaryMagic))
+		if _, err := io.ReadFull(s.r, magic); err != nil || string(magic) != binaryMagic {
+			return "", nil, errors.New("not a binary kaas snapshot")
+		}
+	}
+
+	n, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return "", nil, err
+	}
+	if n > maxNameLength {
+		return "", nil, fmt.Errorf("metric name of %d bytes in binary snapshot", n)
+	}
+	name := make([]byte, n)
+	if _, err := io.ReadFull(s.r, name); err != nil {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	count, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	if count > uint64(MAX_METRICS) {
+		return "", nil, fmt.Errorf("%d datapoints for %s in binary snapshot", count, name)
+	}
+	ts := make(Measurements, 0, count)
+	var timestamp int64
+	bits := make([]byte, 8)
+	for i := uint64(0); i < count; i++ {
+		delta, err := binary.ReadVarint(s.r)
+		if err != nil {
+			return "", nil, io.ErrUnexpectedEOF
+		}
+		if _, err := io.ReadFull(s.r, bits); err != nil {
+			return "", nil, io.ErrUnexpectedEOF
+		}
+		timestamp += delta
+		ts = append(ts, Measurement{math.Float64frombits(binary.LittleEndian.Uint64(bits)), timestamp})
+	}
+	return string(name), ts, nil
+}
+
+// exportSeries writes every stored series whose path matches glob (all of
+// them when glob is empty) to w and returns how many were written.
+func exportSeries(client redis.UniversalClient, glob string, w snapshotWriter) (int, error) {
+	index, err := loadMetricIndex(client)
+	if err != nil {
+		return 0, err
+	}
+	names, err := index.query(metricQuery{Glob: glob})
+	if err != nil {
+		return 0, err
+	}
+	for i, name := range names {
+		ts, err := fetchMeasurements(client, name)
+		if err != nil {
+			return i, err
+		}
+		if err := w.write(name, ts); err != nil {
+			return i, err
+		}
+	}
+	return len(names), w.close()
+}
+
+// importSeries appends every series read from r to the store and returns
+// how many were imported. Each series is sorted by timestamp first, and
+// datapoints at or before the last one already stored for a metric are
+// skipped, so importing into a live store, or the same snapshot twice, does
+// not duplicate them.
+func importSeries(client redis.UniversalClient, r snapshotReader) (int, error) {
+	const chunk = 1000
+	now := float64(time.Now().Unix())
+	count := 0
+	for {
+		name, ts, err := r.next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		sort.SliceStable(ts, func(i, j int) bool { return ts[i].timestamp < ts[j].timestamp })
+		tail, err := client.LIndex(ctx, metricKey(name), -1).Result()
+		if err != nil && err != redis.Nil {
+			return count, err
+		}
+		if last, err := parseMeasurement(tail); err == nil {
+			newer := ts[:0]
+			for _, m := range ts {
+				if m.timestamp > last.timestamp {
+					newer = append(newer, m)
+				}
+			}
+			ts = newer
+		}
+
+		pipe := client.Pipeline()
+		for start := 0; start < len(ts); start += chunk {
+			end := start + chunk
+			if end > len(ts) {
+				end = len(ts)
+			}
+			values := make([]interface{}, 0, end-start)
+			for _, m := range ts[start:end] {
+				values = append(values, strconv.FormatFloat(m.value, 'g', -1, 64)+","+strconv.FormatInt(m.timestamp, 10))
+			}
+			pipe.RPush(ctx, metricKey(name), values...)
+		}
+		pipe.LTrim(ctx, metricKey(name), -MAX_METRICS, -1)
+		pipe.SAdd(ctx, shardKey(metricNamesKey, name), name)
+		pipe.ZAdd(ctx, shardKey(lastSeenKey, name), redis.Z{Score: now, Member: name})
+		if _, err := pipe.Exec(ctx); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// runSnapshotCommand runs "kaas export" or "kaas import" with args.
+func runSnapshotCommand(command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	format := fs.String("format", "", "snapshot format: csv, jsonl or binary (default from the file extension)")
+	file := fs.String("file", "", "snapshot file (default standard output or input)")
+	glob := fs.String("glob", "", "only export metrics whose path matches this glob")
+	opt := redisFlags(fs)
+	fs.Parse(args)
+
+	f, err := snapshotFormat(*format, *file)
+	if err != nil {
+		return err
+	}
+	client := newRedisClient(opt())
+	defer client.Close()
+	if _, err := migrateStore(client); err != nil {
+		return err
+	}
+
+	if command == "export" {
+		out := os.Stdout
+		if *file != "" {
+			out, err = os.Create(*file)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		n, err := exportSeries(client, *glob, newSnapshotWriter(f, out))
+		fmt.Fprintln(os.Stderr, "exported", n, "series")
+		return err
+	}
+
+	in := os.Stdin
+	if *file != "" {
+		in, err = os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	n, err := importSeries(client, newSnapshotReader(f, in))
+	fmt.Fprintln(os.Stderr, "imported", n, "series")
+	return err
+}
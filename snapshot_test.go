@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	series := map[string]Measurements{
+		"web01.cpu;host=web01": {{0.5, 1400000000}, {-1.25e-7, 1400000010}, {math.MaxFloat64, 1399999990}},
+		"web,02.mem":           {{42, 1}},
+		"empty":                {},
+	}
+	order := []string{"web01.cpu;host=web01", "web,02.mem", "empty"}
+
+	for _, format := range []string{"csv", "jsonl", "binary"} {
+		var buf bytes.Buffer
+		w := newSnapshotWriter(format, &buf)
+		for _, name := range order {
+			if err := w.write(name, series[name]); err != nil {
+				t.Fatal(format, err)
+			}
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(format, err)
+		}
+
+		r := newSnapshotReader(format, &buf)
+		got := make(map[string]Measurements)
+		for {
+			name, ts, err := r.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(format, err)
+			}
+			got[name] = ts
+		}
+		for _, name := range order {
+			if len(series[name]) == 0 {
+				// csv has no rows to record an empty series with
+				continue
+			}
+			if !reflect.DeepEqual(got[name], series[name]) {
+				t.Fatal(format, "snapshot of", name, "should read back as", series[name], "but read", got[name])
+			}
+		}
+	}
+}
+
+func TestSnapshotNonFinite(t *testing.T) {
+	ts := Measurements{{math.NaN(), 1}, {math.Inf(1), 2}, {math.Inf(-1), 3}, {1.5, 4}}
+	for _, format := range []string{"csv", "jsonl", "binary"} {
+		var buf bytes.Buffer
+		w := newSnapshotWriter(format, &buf)
+		if err := w.write("errors", ts); err != nil {
+			t.Fatal(format, "snapshot should write non-finite values but failed with", err)
+		}
+		if err := w.close(); err != nil {
+			t.Fatal(format, err)
+		}
+		_, got, err := newSnapshotReader(format, &buf).next()
+		if err != nil || len(got) != len(ts) {
+			t.Fatal(format, "snapshot should read back", len(ts), "datapoints but read", got, err)
+		}
+		if !math.IsNaN(got[0].value) || !math.IsInf(got[1].value, 1) || !math.IsInf(got[2].value, -1) || got[3] != ts[3] {
+			t.Fatal(format, "snapshot should keep non-finite values but read", got)
+		}
+	}
+}
+
+func TestCSVSnapshotInterleaved(t *testing.T) {
+	csv := "metric,timestamp,value\na,1,1\nb,1,10\na,3,3\nb,2,20\na,2,2\n"
+	r := newSnapshotReader("csv", bytes.NewBufferString(csv))
+	got := make(map[string]Measurements)
+	var order []string
+	for {
+		name, ts, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		order = append(order, name)
+		got[name] = ts
+	}
+	if !reflect.DeepEqual(order, []string{"a", "b"}) || len(got["a"]) != 3 || len(got["b"]) != 2 {
+		t.Fatal("csv reader should group interleaved rows by metric but read", order, got)
+	}
+}
+
+func TestSnapshotFormat(t *testing.T) {
+	if f, _ := snapshotFormat("", "incident.jsonl"); f != "jsonl" {
+		t.Fatal("snapshotFormat() should infer jsonl from the extension but returned", f)
+	}
+	if f, _ := snapshotFormat("csv", "incident.bin"); f != "csv" {
+		t.Fatal("snapshotFormat() should prefer the given format but returned", f)
+	}
+	if _, err := snapshotFormat("", "incident.txt"); err == nil {
+		t.Fatal("snapshotFormat() should have rejected an unknown extension")
+	}
+}
+
+func TestBinarySnapshotRejectsGarbage(t *testing.T) {
+	r := newSnapshotReader("binary", bytes.NewBufferString("name,timestamp,value\n"))
+	if _, _, err := r.next(); err == nil || err == io.EOF {
+		t.Fatal("binary reader should have rejected a file without the magic header but returned", err)
+	}
+}
+
+func TestBinarySnapshotRejectsHugeLengths(t *testing.T) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	huge := binaryMagic + string(buf[:binary.PutUvarint(buf, 1<<40)])
+	if _, _, err := newSnapshotReader("binary", bytes.NewBufferString(huge)).next(); err == nil || err == io.EOF {
+		t.Fatal("binary reader should have rejected an oversized name but returned", err)
+	}
+
+	counted := binaryMagic + string(buf[:binary.PutUvarint(buf, 1)]) + "m" + string(buf[:binary.PutUvarint(buf, 1<<40)])
+	if _, _, err := newSnapshotReader("binary", bytes.NewBufferString(counted)).next(); err == nil || err == io.ErrUnexpectedEOF {
+		t.Fatal("binary reader should have rejected an oversized datapoint count but returned", err)
+	}
+}
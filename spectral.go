@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+const (
+	// spectralExtension is the number of datapoints extrapolated past the
+	// end of a series so that its latest datapoint is not at the edge of
+	// the transform.
+	spectralExtension = 5
+	// spectralFilter is the width of the moving average over the log
+	// amplitude spectrum, and spectralWindow the number of preceding
+	// saliencies a datapoint's saliency is compared with.
+	spectralFilter = 3
+	spectralWindow = 21
+	// spectralThreshold is the score above which a datapoint is anomalous.
+	spectralThreshold = 3.0
+)
+
+// extrapolate appends spectralExtension copies of an estimate of the next
+// datapoint. The estimate extends the average gradient between the datapoint
+// before the latest and each of the spectralExtension before it, so that an
+// anomalous latest datapoint does not carry into the extension and hide
+// itself.
+func extrapolate(x []float64) []float64 {
+	n := len(x)
+	m := spectralExtension
+	if n < m+2 {
+		return x
+	}
+	var gradient float64
+	for i := 1; i <= m; i++ {
+		gradient += (x[n-2] - x[n-2-i]) / float64(i)
+	}
+	next := x[n-1-m] + gradient
+	extended := append([]float64(nil), x...)
+	for i := 0; i < m; i++ {
+		extended = append(extended, next)
+	}
+	return extended
+}
+
+// centeredAverage returns the average of the width values of y centred on
+// each, or of as many as there are at its ends.
+func centeredAverage(y []float64, width int) []float64 {
+	out := make([]float64, len(y))
+	for i := range y {
+		lo, hi := i-width/2, i+width/2+1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(y) {
+			hi = len(y)
+		}
+		out[i] = mean(y[lo:hi])
+	}
+	return out
+}
+
+// saliencyMap returns the spectral residual saliency of each datapoint of x
+// (Hou & Zhang 2007): the log amplitude spectrum less its moving average,
+// the spectral residual, is transformed back with the original phase, so
+// that what stands out is whatever the spectrum does not explain.
+func saliencyMap(x []float64) []float64 {
+	n := len(x)
+	spectrum := fftReal(extrapolate(x))
+	logAmplitude := make([]float64, len(spectrum))
+	for i, c := range spectrum {
+		logAmplitude[i] = math.Log(cmplx.Abs(c) + 1e-8)
+	}
+	average := centeredAverage(logAmplitude, spectralFilter)
+	residual := make([]complex128, len(spectrum))
+	for i, c := range spectrum {
+		magnitude := math.Exp(logAmplitude[i] - average[i])
+		residual[i] = cmplx.Rect(magnitude, cmplx.Phase(c))
+	}
+	inverse := ifft(residual)
+	saliency := make([]float64, n)
+	for i := range saliency {
+		saliency[i] = cmplx.Abs(inverse[i])
+	}
+	return saliency
+}
+
+// spectralResidual returns the anomaly score of each datapoint of x, its
+// saliency relative to the average saliency of the spectralWindow
+// datapoints before it (Ren et al. 2019).
+func spectralResidual(x []float64) []float64 {
+	saliency := saliencyMap(x)
+	scores := make([]float64, len(x))
+	var sum float64
+	for i, s := range saliency {
+		if i > 0 {
+			count := i
+			if count > spectralWindow {
+				count = spectralWindow
+			}
+			if average := sum / float64(count); average > 0 {
+				scores[i] = (s - average) / average
+			}
+		}
+		sum += s
+		if i >= spectralWindow {
+			sum -= saliency[i-spectralWindow]
+		}
+	}
+	return scores
+}
+
+// SpectralResidual function
+// A timeseries is anomalous if the spectral residual score of its latest
+// datapoint, over the last day, exceeds spectralThreshold. It needs no
+// tuning to the level or variability of a series.
+func spectralResidualLatest(ts Measurements) bool {
+	x := lastDuration(ts, fullDuration).values()
+	if len(x) < 2*spectralWindow {
+		return false
+	}
+	scores := spectralResidual(x)
+	return scores[len(scores)-1] > spectralThreshold
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestSpectralResidual(t *testing.T) {
+	rnd := rand.New(rand.NewSource(10))
+	var ts Measurements
+	for i := 0; i < 500; i++ {
+		v := 20 + 5*math.Sin(2*math.Pi*float64(i)/50) + 0.5*rnd.NormFloat64()
+		ts = append(ts, Measurement{v, int64(i * 60)})
+	}
+	if spectralResidualLatest(ts) {
+		t.Fatal("spectralResidualLatest should not flag a regular series")
+	}
+	scores := spectralResidual(ts.values())
+	for i, s := range scores {
+		if s > spectralThreshold {
+			t.Fatal("spectralResidual should not score any regular datapoint above", spectralThreshold, "but scored", i, s)
+		}
+	}
+
+	ts[300].value += 15
+	scores = spectralResidual(ts.values())
+	if scores[300] < spectralThreshold {
+		t.Fatal("spectralResidual should score a spike above", spectralThreshold, "but scored", scores[300])
+	}
+	ts[len(ts)-1].value += 15
+	if !spectralResidualLatest(ts) {
+		t.Fatal("spectralResidualLatest should flag a spike in the latest datapoint")
+	}
+	if spectralResidualLatest(ts[:20]) {
+		t.Fatal("spectralResidualLatest should not flag a short series")
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"math"
+)
+
+// decomposition is the split of a series into trend, seasonal and residual
+// components that add up to the original series.
+type decomposition struct {
+	trend    []float64
+	seasonal []float64
+	residual []float64
+}
+
+// seasonalPeriods are the cycles, in seconds, that seasonalPeriod looks for,
+// longest first.
+var seasonalPeriods = []int64{7 * 86400, 86400}
+
+// samplingInterval returns the median spacing, in timestamp units, of the
+// datapoints in ts.
+func samplingInterval(ts Measurements) int64 {
+	if len(ts) < 2 {
+		return 0
+	}
+	var gaps []float64
+	for i := 1; i < len(ts); i++ {
+		gaps = append(gaps, float64(ts[i].timestamp-ts[i-1].timestamp))
+	}
+	return int64(median(gaps))
+}
+
+// seasonalPeriod returns the number of datapoints in one seasonal cycle of ts.
+// A given cycle length in seconds, configured or detected, is used as is;
+// otherwise the longest of seasonalPeriods of which ts holds at least three
+// cycles is chosen, falling back to daily when there are at least two. It
+// returns 0 when ts is too short for any of them, or when it was found to
+// have no cycle at all (noPeriod), so that the seasonal algorithms skip it.
+func seasonalPeriod(ts Measurements, configured int64) int {
+	interval := samplingInterval(ts)
+	if interval <= 0 || configured == noPeriod {
+		return 0
+	}
+	toPoints := func(seconds int64) int {
+		return int(math.Floor(float64(seconds)/float64(interval) + 0.5))
+	}
+	if configured > 0 {
+		return toPoints(configured)
+	}
+	for _, seconds := range seasonalPeriods {
+		if p := toPoints(seconds); p >= 2 && len(ts) >= 3*p {
+			return p
+		}
+	}
+	if p := toPoints(86400); p >= 2 && len(ts) >= 2*p {
+		return p
+	}
+	return 0
+}
+
+// STL function
+// Seasonal-trend decomposition using Loess (Cleveland et al. 1990) of a
+// series sampled at regular intervals with period datapoints per cycle. The
+// robust version downweights outliers so that the anomalies we look for end
+// up in the residual instead of distorting the trend and seasonal components.
+// The datapoints are taken to be evenly spaced; checkQuality keeps series
+// with large gaps from the algorithms.
+func stl(series []float64, period int, robust bool) decomposition {
+	n := len(series)
+	ns := 7
+	nl := nextOdd(float64(period))
+	nt := nextOdd(1.5 * float64(period) / (1 - 1.5/float64(ns)))
+	inner, outer := 2, 0
+	if robust {
+		inner, outer = 1, 15
+	}
+
+	trend := make([]float64, n)
+	seasonal := make([]float64, n)
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	detrended := make([]float64, n)
+	deseasonalized := make([]float64, n)
+
+	for o := 0; o <= outer; o++ {
+		for k := 0; k < inner; k++ {
+			for i := range series {
+				detrended[i] = series[i] - trend[i]
+			}
+			cycle := smoothCycleSubseries(detrended, weights, period, ns)
+			low := lowPass(cycle, period, nl)
+			for i := range seasonal {
+				seasonal[i] = cycle[period+i] - low[i]
+				deseasonalized[i] = series[i] - seasonal[i]
+			}
+			trend = loessSmooth(deseasonalized, weights, nt, 1, jump(nt))
+		}
+		if o < outer {
+			weights = robustnessWeights(series, trend, seasonal)
+		}
+	}
+
+	residual := make([]float64, n)
+	for i := range residual {
+		residual[i] = series[i] - trend[i] - seasonal[i]
+	}
+	return decomposition{trend: trend, seasonal: seasonal, residual: residual}
+}
+
+func nextOdd(f float64) int {
+	i := int(math.Ceil(f))
+	if i%2 == 0 {
+		i++
+	}
+	return i
+}
+
+// jump is how far apart loess is evaluated for a smoother of the given span,
+// the values in between being interpolated.
+func jump(span int) int {
+	return int(math.Ceil(float64(span) / 10))
+}
+
+// smoothCycleSubseries smooths each cycle-subseries (every period-th value)
+// of y and extends it by one value at each end, returning a series of
+// len(y)+2*period values which starts period values before y.
+func smoothCycleSubseries(y, weights []float64, period, span int) []float64 {
+	n := len(y)
+	cycle := make([]float64, n+2*period)
+	for k := 0; k < period; k++ {
+		var sub, subWeights []float64
+		for i := k; i < n; i += period {
+			sub = append(sub, y[i])
+			subWeights = append(subWeights, weights[i])
+		}
+		if len(sub) == 0 {
+			continue
+		}
+		for j := -1; j <= len(sub); j++ {
+			v, ok := loessAt(sub, subWeights, span, 0, float64(j))
+			if !ok {
+				v = mean(sub)
+			}
+			cycle[(j+1)*period+k] = v
+		}
+	}
+	return cycle
+}
+
+// lowPass applies moving averages of length period, period and 3 followed by
+// a loess smoother to the extended cycle-subseries, giving back len(cycle) -
+// 2*period values.
+func lowPass(cycle []float64, period, span int) []float64 {
+	smoothed := movingAverage(movingAverage(movingAverage(cycle, period), period), 3)
+	ones := make([]float64, len(smoothed))
+	for i := range ones {
+		ones[i] = 1
+	}
+	return loessSmooth(smoothed, ones, span, 1, jump(span))
+}
+
+func movingAverage(y []float64, length int) []float64 {
+	if len(y) < length {
+		return nil
+	}
+	out := make([]float64, len(y)-length+1)
+	var sum float64
+	for i := 0; i < length; i++ {
+		sum += y[i]
+	}
+	out[0] = sum / float64(length)
+	for i := 1; i < len(out); i++ {
+		sum += y[i+length-1] - y[i-1]
+		out[i] = sum / float64(length)
+	}
+	return out
+}
+
+// robustnessWeights downweights datapoints with large residuals using
+// bisquare weights on the residual scaled by six times its median absolute
+// value.
+func robustnessWeights(series, trend, seasonal []float64) []float64 {
+	n := len(series)
+	abs := make([]float64, n)
+	for i := range series {
+		abs[i] = math.Abs(series[i] - trend[i] - seasonal[i])
+	}
+	h := 6 * median(abs)
+	weights := make([]float64, n)
+	for i, r := range abs {
+		switch {
+		case h == 0:
+			weights[i] = 1
+		case r/h < 1:
+			u := 1 - (r/h)*(r/h)
+			weights[i] = u * u
+		}
+	}
+	return weights
+}
+
+// loessSmooth evaluates loessAt at every index of y, directly at every
+// step-th index and the last one and by linear interpolation in between.
+func loessSmooth(y, weights []float64, span, degree, step int) []float64 {
+	n := len(y)
+	out := make([]float64, n)
+	if n == 0 {
+		return out
+	}
+	if step < 1 {
+		step = 1
+	}
+	var points []int
+	for i := 0; i < n; i += step {
+		points = append(points, i)
+	}
+	if points[len(points)-1] != n-1 {
+		points = append(points, n-1)
+	}
+	for _, i := range points {
+		v, ok := loessAt(y, weights, span, degree, float64(i))
+		if !ok {
+			v = y[i]
+		}
+		out[i] = v
+	}
+	for p := 1; p < len(points); p++ {
+		left, right := points[p-1], points[p]
+		for i := left + 1; i < right; i++ {
+			frac := float64(i-left) / float64(right-left)
+			out[i] = out[left] + frac*(out[right]-out[left])
+		}
+	}
+	return out
+}
+
+// loessAt fits a locally weighted polynomial of degree 0 or 1 to the span
+// values of y nearest to x, with tricube neighbourhood weights multiplied by
+// the given weights, and returns its value at x. It reports false when every
+// neighbour has zero weight.
+func loessAt(y, weights []float64, span, degree int, x float64) (float64, bool) {
+	n := len(y)
+	left, right := 0, n-1
+	if span < n {
+		left = int(math.Floor(x - float64(span-1)/2))
+		if left < 0 {
+			left = 0
+		}
+		if left+span > n {
+			left = n - span
+		}
+		right = left + span - 1
+	}
+	h := math.Max(x-float64(left), float64(right)-x)
+	if span > n {
+		h += float64(span-n) / 2
+	}
+
+	w := make([]float64, right-left+1)
+	var total float64
+	for j := left; j <= right; j++ {
+		r := math.Abs(float64(j) - x)
+		switch {
+		case r <= 0.001*h:
+			w[j-left] = weights[j]
+		case r <= 0.999*h:
+			u := r / h
+			u = 1 - u*u*u
+			w[j-left] = u * u * u * weights[j]
+		}
+		total += w[j-left]
+	}
+	if total <= 0 {
+		return 0, false
+	}
+	for i := range w {
+		w[i] /= total
+	}
+
+	if degree > 0 && h > 0 {
+		var center float64
+		for j := left; j <= right; j++ {
+			center += w[j-left] * float64(j)
+		}
+		var spread float64
+		for j := left; j <= right; j++ {
+			d := float64(j) - center
+			spread += w[j-left] * d * d
+		}
+		if math.Sqrt(spread) > 0.001*float64(right-left) {
+			slope := (x - center) / spread
+			for j := left; j <= right; j++ {
+				w[j-left] *= slope*(float64(j)-center) + 1
+			}
+		}
+	}
+
+	var fit float64
+	for j := left; j <= right; j++ {
+		fit += w[j-left] * y[j]
+	}
+	return fit, true
+}
+
+const (
+	// stlCycles is how many of the latest seasonal cycles of a series
+	// decompose covers, and stlMinLength the fewest of its latest
+	// datapoints, enough for the windows of isolationForestLatest.
+	stlCycles    = 3
+	stlMinLength = isolationWindow + isolationHistory*isolationWindow/2
+)
+
+// seasonality is the robust STL decomposition of the latest datapoints of a
+// series, computed once per analysis pass by decompose and shared by the
+// seasonal algorithms.
+type seasonality struct {
+	period     int // datapoints per cycle, 0 when the series has no cycle to remove
+	from       int // index in the series of the first decomposed datapoint
+	components decomposition
+}
+
+// decompose returns the seasonality of ts, whose cycle is configuredPeriod
+// seconds long or detected by seasonalPeriod, over its latest stlCycles
+// cycles and at least stlMinLength datapoints. It has no cycle when ts does
+// not hold two full cycles.
+func decompose(ts Measurements, configuredPeriod int64) *seasonality {
+	period := seasonalPeriod(ts, configuredPeriod)
+	if period < 2 || len(ts) < 2*period {
+		return &seasonality{}
+	}
+	n := stlCycles * period
+	if n < stlMinLength {
+		n = stlMinLength
+	}
+	from := len(ts) - n
+	if from < 0 {
+		from = 0
+	}
+	return &seasonality{period: period, from: from, components: stl(ts[from:].values(), period, true)}
+}
+
+// residual returns the residual of the latest n datapoints of the series, or
+// nil when it has no cycle or fewer than n datapoints were decomposed.
+func (s *seasonality) residual(n int) []float64 {
+	r := s.components.residual
+	if s.period == 0 || n > len(r) {
+		return nil
+	}
+	return r[len(r)-n:]
+}
+
+// seasonalAt returns the seasonal component of the i-th datapoint of the
+// series, repeating the first decomposed cycle for datapoints before the
+// decomposition, and 0 when it has no cycle.
+func (s *seasonality) seasonalAt(i int) float64 {
+	if s.period == 0 {
+		return 0
+	}
+	j := i - s.from
+	if j < 0 {
+		j = (j%s.period + s.period) % s.period
+	}
+	return s.components.seasonal[j]
+}
+
+// StlMedianAbsoluteDeviation function
+// A timeseries is anomalous if, once its trend and seasonal cycle have been
+// removed, the latest residual is an outlier by the medianAbsoluteDeviation
+// test. Unlike the tests on the raw series this does not flag the regular
+// daily and weekly peaks.
+func stlMedianAbsoluteDeviation(_ Measurements, s *seasonality) bool {
+	if s.period == 0 {
+		return false
+	}
+	return medianAbsoluteDeviation(s.components.residual)
+}
+
+// StlStddev function
+// A timeseries is anomalous if the average of the last three residuals, once
+// its trend and seasonal cycle have been removed, is more than three standard
+// deviations from the mean residual.
+func stlStddev(_ Measurements, s *seasonality) bool {
+	if s.period == 0 {
+		return false
+	}
+	return simpleStddevFromMovingAverage(s.components.residual)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// seasonalSeries returns days of hourly datapoints following a daily sine
+// wave on a rising trend, with a little noise.
+func seasonalSeries(days int) Measurements {
+	rnd := rand.New(rand.NewSource(1))
+	var ts Measurements
+	for i := 0; i < days*24; i++ {
+		v := 100 + 0.1*float64(i) + 50*math.Sin(2*math.Pi*float64(i)/24) + rnd.NormFloat64()
+		ts = append(ts, Measurement{v, int64(i * 3600)})
+	}
+	return ts
+}
+
+func TestSeasonalPeriod(t *testing.T) {
+	if p := seasonalPeriod(seasonalSeries(5), 0); p != 24 {
+		t.Fatal("seasonalPeriod() should pick the daily cycle of 24 hourly datapoints but picked", p)
+	}
+	if p := seasonalPeriod(seasonalSeries(21), 0); p != 168 {
+		t.Fatal("seasonalPeriod() should pick the weekly cycle with three weeks of data but picked", p)
+	}
+	if p := seasonalPeriod(seasonalSeries(1), 0); p != 0 {
+		t.Fatal("seasonalPeriod() should find no cycle in a single day but picked", p)
+	}
+	if p := seasonalPeriod(seasonalSeries(1), 6*3600); p != 6 {
+		t.Fatal("seasonalPeriod() should use the configured period but picked", p)
+	}
+	if p := seasonalPeriod(seasonalSeries(5), noPeriod); p != 0 {
+		t.Fatal("seasonalPeriod() should not force a cycle onto a metric found to have none but picked", p)
+	}
+}
+
+func TestSTL(t *testing.T) {
+	ts := seasonalSeries(10)
+	d := stl(ts.values(), 24, true)
+	for i, v := range ts.values() {
+		if round(d.trend[i]+d.seasonal[i]+d.residual[i], 6) != round(v, 6) {
+			t.Fatal("stl() components should add up to the series at", i)
+		}
+	}
+	for i := 24; i < len(ts)-24; i++ {
+		want := 50 * math.Sin(2*math.Pi*float64(i)/24)
+		if math.Abs(d.seasonal[i]-want) > 5 {
+			t.Fatal("stl() seasonal component at", i, "should be near", want, "but was", d.seasonal[i])
+		}
+	}
+	if std(d.residual) > 2 {
+		t.Fatal("stl() residual should be close to the noise but has std", std(d.residual))
+	}
+}
+
+func TestDecompose(t *testing.T) {
+	ts := seasonalSeries(200)
+	season := decompose(ts, 0)
+	if season.period != 168 || len(season.components.residual) != stlMinLength || season.from != len(ts)-stlMinLength {
+		t.Fatal("decompose() should cover the latest", stlMinLength, "datapoints but covered", len(season.components.residual), "from", season.from)
+	}
+	if season.residual(100) == nil || season.residual(stlMinLength+1) != nil {
+		t.Fatal("decompose() residual should only cover the decomposed datapoints")
+	}
+	if season.seasonalAt(season.from-1) != season.components.seasonal[season.period-1] {
+		t.Fatal("decompose() should repeat the first decomposed cycle before the decomposition")
+	}
+	if none := decompose(ts, noPeriod); none.period != 0 || none.residual(1) != nil || none.seasonalAt(0) != 0 {
+		t.Fatal("decompose() should not decompose a metric without a cycle")
+	}
+}
+
+func TestSTLDetectors(t *testing.T) {
+	normal := seasonalSeries(10)
+	if season := decompose(normal, 0); stlMedianAbsoluteDeviation(normal, season) || stlStddev(normal, season) {
+		t.Fatal("seasonal detectors should not flag a regular daily peak")
+	}
+	if simpleStddevFromMovingAverage(normal.values()) {
+		t.Fatal("test series should not be anomalous to the non-seasonal detector either")
+	}
+
+	anomalous := seasonalSeries(10)
+	// A trough-sized value at the daily peak is within the overall range of
+	// the series but far from what the season predicts.
+	peak := len(anomalous) - 19
+	anomalous = anomalous[:peak+1]
+	anomalous[peak].value -= 100
+	if !stlMedianAbsoluteDeviation(anomalous, decompose(anomalous, 0)) {
+		t.Fatal("stlMedianAbsoluteDeviation() should flag a value far off the seasonal pattern")
+	}
+	if medianAbsoluteDeviation(anomalous.values()) {
+		t.Fatal("test anomaly should be within the raw range of the series")
+	}
+
+	short := seasonalSeries(1)
+	if stlMedianAbsoluteDeviation(short, decompose(short, 0)) {
+		t.Fatal("stlMedianAbsoluteDeviation() should not flag a series too short to decompose")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ctx = context.Background()
+
+// metricNamesKey is the set of every metric name in the store, split into
+// keyShards keys by shardKey.
+const metricNamesKey = "metricNames"
+
+// keyShards is the number of keys each store-wide index is split into. Each
+// shard has its own hash tag, so that in a Redis Cluster the writes to the
+// indexes are spread over as many slots rather than all landing on one.
+const keyShards = 16
+
+// shardKey returns the shard of the store-wide index base that holds name.
+func shardKey(base, name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return base + ":{" + strconv.Itoa(int(h.Sum32()%keyShards)) + "}"
+}
+
+// shardKeys returns every shard of the store-wide index base.
+func shardKeys(base string) []string {
+	keys := make([]string, keyShards)
+	for i := range keys {
+		keys[i] = base + ":{" + strconv.Itoa(i) + "}"
+	}
+	return keys
+}
+
+// setMembers returns the members of every shard of the set base.
+func setMembers(client redis.UniversalClient, base string) ([]string, error) {
+	pipe := client.Pipeline()
+	var cmds []*redis.StringSliceCmd
+	for _, key := range shardKeys(base) {
+		cmds = append(cmds, pipe.SMembers(ctx, key))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, cmd := range cmds {
+		names = append(names, cmd.Val()...)
+	}
+	return names, nil
+}
+
+// metricKey returns the key holding a metric's datapoints. The whole name is
+// the key's hash tag, and every other per-metric key is derived from it with
+// metricSubKey, so that in a Redis Cluster all of a metric's keys live in the
+// same slot and can be used together in multi-key commands.
+func metricKey(name string) string {
+	return "{" + name + "}"
+}
+
+// metricSubKey returns the key holding the named piece of per-metric state.
+func metricSubKey(name, kind string) string {
+	return metricKey(name) + ":" + kind
+}
+
+// redisOptions selects how to connect to Redis: a single server, a group of
+// servers monitored by Sentinel when masterName is set, or a Redis Cluster
+// seeded from addrs when cluster is set.
+type redisOptions struct {
+	addrs      []string
+	masterName string
+	cluster    bool
+	password   string
+}
+
+// redisFlags defines the flags selecting how to connect to Redis on fs and
+// returns a function giving their values once fs has been parsed.
+func redisFlags(fs *flag.FlagSet) func() redisOptions {
+	addrs := fs.String("redis", "localhost:6379", "comma separated Redis server, Sentinel or Cluster seed addresses")
+	masterName := fs.String("redis-master", "", "Sentinel master name; connects through the Sentinels given by -redis")
+	cluster := fs.Bool("redis-cluster", false, "treat -redis as Redis Cluster seed nodes")
+	password := fs.String("redis-password", "", "Redis password")
+	return func() redisOptions {
+		return redisOptions{
+			addrs:      strings.Split(*addrs, ","),
+			masterName: *masterName,
+			cluster:    *cluster,
+			password:   *password,
+		}
+	}
+}
+
+// newRedisClient connects to Redis as described by opt. Cluster clients follow
+// MOVED and ASK redirections and Sentinel clients follow master failover,
+// retrying commands and pipelines transparently in both cases.
+func newRedisClient(opt redisOptions) redis.UniversalClient {
+	switch {
+	case opt.cluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        opt.addrs,
+			Password:     opt.password,
+			MaxRedirects: 8,
+		})
+	case opt.masterName != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    opt.masterName,
+			SentinelAddrs: opt.addrs,
+			Password:      opt.password,
+		})
+	default:
+		return redis.NewClient(&redis.Options{
+			Network:  "tcp",
+			Addr:     opt.addrs[0],
+			Password: opt.password,
+		})
+	}
+}
+
+// members converts names to the argument type of the set commands.
+func members(names []string) []interface{} {
+	ms := make([]interface{}, len(names))
+	for i, name := range names {
+		ms[i] = name
+	}
+	return ms
+}
+
+// schemaVersionKey holds the version of the layout of the store's keys, so
+// that migrateStore only moves keys once.
+const schemaVersionKey = "kaasSchemaVersion"
+
+// schemaVersion is the current layout: each metric's datapoints under
+// metricKey and the store-wide indexes split by shardKey. Version 1 kept the
+// datapoints under the bare metric name and each index in a single key.
+const schemaVersion = 2
+
+// migrateStore moves a store written in the version 1 layout to the current
+// one and returns how many metrics' datapoints it moved. Datapoints are
+// copied rather than renamed, as in a Redis Cluster the old and new keys
+// live in different slots, and any already written under the new key are
+// kept after the old ones.
+func migrateStore(client redis.UniversalClient) (int, error) {
+	version, err := client.Get(ctx, schemaVersionKey).Int()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	if version >= schemaVersion {
+		return 0, nil
+	}
+
+	names, err := client.SMembers(ctx, metricNamesKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	lastSeen, err := client.ZRangeWithScores(ctx, lastSeenKey, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	stale, err := client.SMembers(ctx, staleMetricsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	pipe := client.Pipeline()
+	for _, name := range names {
+		pipe.SAdd(ctx, shardKey(metricNamesKey, name), name)
+	}
+	for _, z := range lastSeen {
+		name, _ := z.Member.(string)
+		pipe.ZAdd(ctx, shardKey(lastSeenKey, name), redis.Z{Score: z.Score, Member: name})
+	}
+	for _, name := range stale {
+		pipe.SAdd(ctx, shardKey(staleMetricsKey, name), name)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+
+	// Few metrics at a time, as each may hold MAX_METRICS datapoints.
+	const chunk = 100
+	moved := 0
+	for start := 0; start < len(names); start += chunk {
+		end := start + chunk
+		if end > len(names) {
+			end = len(names)
+		}
+		pipe := client.Pipeline()
+		oldCmds := make([]*redis.StringSliceCmd, end-start)
+		newCmds := make([]*redis.StringSliceCmd, end-start)
+		for i, name := range names[start:end] {
+			oldCmds[i] = pipe.LRange(ctx, name, 0, -1)
+			newCmds[i] = pipe.LRange(ctx, metricKey(name), 0, -1)
+		}
+		// Keys that are not lists fail on their own and are left alone.
+		pipe.Exec(ctx)
+
+		pipe = client.Pipeline()
+		for i, name := range names[start:end] {
+			old, err := oldCmds[i].Result()
+			if err != nil || len(old) == 0 {
+				continue
+			}
+			values := members(append(old, newCmds[i].Val()...))
+			pipe.Del(ctx, metricKey(name))
+			pipe.RPush(ctx, metricKey(name), values...)
+			pipe.LTrim(ctx, metricKey(name), -MAX_METRICS, -1)
+			pipe.Del(ctx, name)
+			moved++
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return moved, err
+		}
+	}
+
+	if err := client.Del(ctx, metricNamesKey, lastSeenKey, staleMetricsKey).Err(); err != nil {
+		return moved, err
+	}
+	return moved, client.Set(ctx, schemaVersionKey, schemaVersion, 0).Err()
+}
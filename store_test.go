@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestShardKey(t *testing.T) {
+	keys := make(map[string]bool)
+	for _, key := range shardKeys(metricNamesKey) {
+		keys[key] = true
+	}
+	if len(keys) != keyShards {
+		t.Fatal("shardKeys() should return", keyShards, "distinct keys but returned", len(keys))
+	}
+	used := make(map[string]bool)
+	for _, name := range []string{"web01.cpu", "web02.cpu", "db01.disk.used", "a", "b", "c", "d", "e"} {
+		key := shardKey(metricNamesKey, name)
+		if !keys[key] {
+			t.Fatal("shardKey() should return one of shardKeys() but returned", key)
+		}
+		if key != shardKey(metricNamesKey, name) {
+			t.Fatal("shardKey() should always put a name in the same shard")
+		}
+		used[key] = true
+	}
+	if len(used) < 3 {
+		t.Fatal("shardKey() should spread names over the shards but used", len(used))
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// streamingCom is the centre of mass of the exponentially weighted moments,
+// the same as stddevFromMovingAverage uses.
+const streamingCom = 50.0
+
+// p2Quantile estimates a quantile of a stream in constant space with the P²
+// algorithm (Jain & Chlamtac 1985): five markers track the minimum, the
+// maximum, the quantile and the quantiles half way to either side of it,
+// and are moved along a parabola through their neighbours as datapoints
+// arrive. The fields are exported for encoding.
+type p2Quantile struct {
+	P       float64
+	Count   int64
+	Heights [5]float64
+	Pos     [5]float64
+	Desired [5]float64
+}
+
+func newP2Quantile(p float64) p2Quantile {
+	return p2Quantile{
+		P:       p,
+		Pos:     [5]float64{1, 2, 3, 4, 5},
+		Desired: [5]float64{1, 1 + 2*p, 1 + 4*p, 3 + 2*p, 5},
+	}
+}
+
+func (q *p2Quantile) add(x float64) {
+	if q.Count < 5 {
+		q.Heights[q.Count] = x
+		q.Count++
+		if q.Count == 5 {
+			sort.Float64s(q.Heights[:])
+		}
+		return
+	}
+	q.Count++
+
+	var k int
+	switch {
+	case x < q.Heights[0]:
+		q.Heights[0] = x
+	case x >= q.Heights[4]:
+		q.Heights[4] = x
+		k = 3
+	default:
+		for k = 0; x >= q.Heights[k+1]; k++ {
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		q.Pos[i]++
+	}
+	increments := [5]float64{0, q.P / 2, q.P, (1 + q.P) / 2, 1}
+	for i := range q.Desired {
+		q.Desired[i] += increments[i]
+	}
+
+	for i := 1; i <= 3; i++ {
+		d := q.Desired[i] - q.Pos[i]
+		if (d >= 1 && q.Pos[i+1]-q.Pos[i] > 1) || (d <= -1 && q.Pos[i-1]-q.Pos[i] < -1) {
+			s := math.Copysign(1, d)
+			h := q.parabolic(i, s)
+			if h <= q.Heights[i-1] || h >= q.Heights[i+1] {
+				j := i + int(s)
+				h = q.Heights[i] + s*(q.Heights[j]-q.Heights[i])/(q.Pos[j]-q.Pos[i])
+			}
+			q.Heights[i] = h
+			q.Pos[i] += s
+		}
+	}
+}
+
+func (q *p2Quantile) parabolic(i int, s float64) float64 {
+	n, h := q.Pos, q.Heights
+	return h[i] + s/(n[i+1]-n[i-1])*((n[i]-n[i-1]+s)*(h[i+1]-h[i])/(n[i+1]-n[i])+(n[i+1]-n[i]-s)*(h[i]-h[i-1])/(n[i]-n[i-1]))
+}
+
+// value returns the estimate, which is exact until five datapoints have been
+// seen.
+func (q *p2Quantile) value() float64 {
+	if q.Count == 0 {
+		return 0
+	}
+	if q.Count < 5 {
+		s := sorted(q.Heights[:q.Count])
+		return s[int(q.P*float64(q.Count-1)+0.5)]
+	}
+	return q.Heights[2]
+}
+
+// streamingStats summarizes every datapoint a metric has received in
+// constant space, so that detectors can be evaluated in constant time per
+// new datapoint instead of over the whole stored series. It holds the mean
+// and variance (Welford), the exponentially weighted mean and variance with
+// centre of mass streamingCom, the median and the median absolute deviation
+// from it (P² estimates), and the last three values. The fields are
+// exported for encoding.
+type streamingStats struct {
+	Count         int64
+	Mean          float64
+	M2            float64
+	EWSum         float64
+	EWSumSq       float64
+	EWWeight      float64
+	Median        p2Quantile
+	Deviation     p2Quantile
+	Tail          [3]float64
+	LastTimestamp int64
+}
+
+func newStreamingStats() *streamingStats {
+	return &streamingStats{Median: newP2Quantile(0.5), Deviation: newP2Quantile(0.5)}
+}
+
+// add updates the statistics with a new datapoint. NaN and infinite values
+// are ignored, as a single one would poison the moments for good.
+func (s *streamingStats) add(m Measurement) {
+	x := m.value
+	if unDef(x) {
+		return
+	}
+	s.Count++
+	delta := x - s.Mean
+	s.Mean += delta / float64(s.Count)
+	s.M2 += delta * (x - s.Mean)
+
+	decay := streamingCom / (1 + streamingCom)
+	s.EWSum = decay*s.EWSum + x
+	s.EWSumSq = decay*s.EWSumSq + x*x
+	s.EWWeight = decay*s.EWWeight + 1
+
+	s.Median.add(x)
+	s.Deviation.add(math.Abs(x - s.Median.value()))
+
+	s.Tail[0], s.Tail[1], s.Tail[2] = s.Tail[1], s.Tail[2], x
+	s.LastTimestamp = m.timestamp
+}
+
+// last returns the latest value.
+func (s *streamingStats) last() float64 {
+	return s.Tail[2]
+}
+
+// std returns the sample standard deviation, as std does.
+func (s *streamingStats) std() float64 {
+	if s.Count < 2 {
+		return 0
+	}
+	return math.Sqrt(s.M2 / float64(s.Count-1))
+}
+
+// withoutLast returns the mean and sample standard deviation of every
+// datapoint but the latest, by reversing its Welford update.
+func (s *streamingStats) withoutLast() (float64, float64) {
+	if s.Count < 3 {
+		return 0, 0
+	}
+	x, n := s.last(), float64(s.Count-1)
+	m := (s.Mean*float64(s.Count) - x) / n
+	m2 := s.M2 - (x-m)*(x-s.Mean)
+	return m, math.Sqrt(math.Max(0, m2) / (n - 1))
+}
+
+// ewma returns the exponentially weighted mean, as the last value of ewma.
+func (s *streamingStats) ewma() float64 {
+	if s.EWWeight == 0 {
+		return 0
+	}
+	return s.EWSum / s.EWWeight
+}
+
+// ewmStd returns the exponentially weighted standard deviation, as the last
+// value of ewmStd.
+func (s *streamingStats) ewmStd() float64 {
+	if s.EWWeight == 0 {
+		return 0
+	}
+	m := s.ewma()
+	v := (s.EWSumSq/s.EWWeight - m*m) * (1 + 2*streamingCom) / (2 * streamingCom)
+	return math.Sqrt(math.Max(0, v))
+}
+
+// tailAvg returns the average of the last three values, as tailAvg does.
+func (s *streamingStats) tailAvg() float64 {
+	switch {
+	case s.Count == 0:
+		return 0
+	case s.Count < 3:
+		return s.last()
+	}
+	return (s.Tail[0] + s.Tail[1] + s.Tail[2]) / 3
+}
+
+func (s *streamingStats) marshal() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, s)
+	return buf.Bytes()
+}
+
+func unmarshalStreamingStats(b []byte) (*streamingStats, error) {
+	s := &streamingStats{}
+	if len(b) != binary.Size(s) {
+		return nil, fmt.Errorf("streaming stats of %d bytes, expected %d", len(b), binary.Size(s))
+	}
+	err := binary.Read(bytes.NewReader(b), binary.LittleEndian, s)
+	return s, err
+}
+
+// The streaming detectors mirror the algorithms of the same name, evaluated
+// over every datapoint the metric has received.
+
+func streamingMeanSubtractionCumulation(s *streamingStats) bool {
+	mean, stdDev := s.withoutLast()
+	return s.Count >= 3 && math.Abs(s.last()-mean) > 3*stdDev
+}
+
+func streamingSimpleStddevFromMovingAverage(s *streamingStats) bool {
+	return math.Abs(s.tailAvg()-s.Mean) > 3*s.std()
+}
+
+func streamingStddevFromMovingAverage(s *streamingStats) bool {
+	return s.Count > 0 && math.Abs(s.last()-s.ewma()) > 3*s.ewmStd()
+}
+
+// streamingMedianAbsoluteDeviation uses the P² estimates of the median and of
+// the median deviation from the median as it stood when each datapoint
+// arrived, so it only approximates medianAbsoluteDeviation.
+func streamingMedianAbsoluteDeviation(s *streamingStats) bool {
+	deviation := s.Deviation.value()
+	if s.Count == 0 || deviation == 0 {
+		return false
+	}
+	return math.Abs(s.last()-s.Median.value())/deviation > 6
+}
+
+// metricStream is the streaming state kept for each metric.
+type metricStream struct {
+	stats   *streamingStats
+	digests *digestSet
+}
+
+// streamSnapshot is a copy of a metric's streaming state for the detectors:
+// its statistics and a digest of its reference windows.
+type streamSnapshot struct {
+	stats     *streamingStats
+	reference *tdigest
+}
+
+// streamStore holds the streaming state of every metric, updated as
+// datapoints are ingested and persisted by persist to
+// metricSubKey(name, "stats") and metricSubKey(name, "digests"). The
+// digests, which are far larger, are only persisted once a window has
+// completed since they last were, and by persistAll.
+type streamStore struct {
+	client redis.UniversalClient
+
+	mu      sync.Mutex
+	streams map[string]*metricStream
+	dirty   map[string]bool
+	rolled  map[string]bool
+}
+
+func newStreamStore(client redis.UniversalClient) *streamStore {
+	return &streamStore{
+		client:  client,
+		streams: make(map[string]*metricStream),
+		dirty:   make(map[string]bool),
+		rolled:  make(map[string]bool),
+	}
+}
+
+// load reads the persisted state of names. Metrics whose state is missing or
+// unreadable start afresh.
+func (st *streamStore) load(names []string) error {
+	const chunk = 1000
+	for start := 0; start < len(names); start += chunk {
+		end := start + chunk
+		if end > len(names) {
+			end = len(names)
+		}
+		pipe := st.client.Pipeline()
+		statsCmds := make([]*redis.StringCmd, end-start)
+		digestCmds := make([]*redis.StringCmd, end-start)
+		for i, name := range names[start:end] {
+			statsCmds[i] = pipe.Get(ctx, metricSubKey(name, "stats"))
+			digestCmds[i] = pipe.Get(ctx, metricSubKey(name, "digests"))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return err
+		}
+
+		st.mu.Lock()
+		for i := range statsCmds {
+			b, err := statsCmds[i].Bytes()
+			if err != nil {
+				continue
+			}
+			stats, err := unmarshalStreamingStats(b)
+			if err != nil {
+				continue
+			}
+			digests := newDigestSet()
+			if b, err := digestCmds[i].Bytes(); err == nil {
+				if d, err := unmarshalDigestSet(b); err == nil {
+					digests = d
+				}
+			}
+			st.streams[names[start+i]] = &metricStream{stats, digests}
+		}
+		st.mu.Unlock()
+	}
+	return nil
+}
+
+// observe updates the state of a metric with a new datapoint.
+func (st *streamStore) observe(name string, m Measurement) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := st.streams[name]
+	if s == nil {
+		s = &metricStream{newStreamingStats(), newDigestSet()}
+		st.streams[name] = s
+	}
+	s.stats.add(m)
+	if s.digests.add(m) {
+		st.rolled[name] = true
+	}
+	st.dirty[name] = true
+}
+
+// get returns a snapshot of the state of a metric. When the state has seen
+// fewer datapoints than ts, the metric's stored series, holds, as for a
+// metric whose state was lost or started after its series, it is first
+// rebuilt from ts so that the streaming detectors see the same history as
+// the batch ones. The rebuild runs outside the lock so that it does not hold
+// up observe for other metrics.
+func (st *streamStore) get(name string, ts Measurements) *streamSnapshot {
+	st.mu.Lock()
+	s := st.streams[name]
+	stale := len(ts) > 0 && (s == nil || s.stats.Count < int64(len(ts)))
+	st.mu.Unlock()
+	if stale {
+		rebuilt := &metricStream{newStreamingStats(), newDigestSet()}
+		for _, m := range ts {
+			rebuilt.stats.add(m)
+			rebuilt.digests.add(m)
+		}
+		st.mu.Lock()
+		// observe may have caught the state up while it was rebuilt.
+		s = st.streams[name]
+		if s == nil || s.stats.Count < rebuilt.stats.Count {
+			s = rebuilt
+			st.streams[name] = s
+			st.dirty[name] = true
+			st.rolled[name] = true
+		}
+		st.mu.Unlock()
+	}
+	if s == nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stats := *s.stats
+	return &streamSnapshot{&stats, s.digests.reference()}
+}
+
+// digests returns a copy of the digests of a metric, or nil if it has none.
+func (st *streamStore) digests(name string) *digestSet {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := st.streams[name]
+	if s == nil {
+		return nil
+	}
+	return s.digests.clone()
+}
+
+// forget drops the state of a removed metric.
+func (st *streamStore) forget(name string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.streams, name)
+	delete(st.dirty, name)
+	delete(st.rolled, name)
+}
+
+// persist writes the statistics updated since the last call to the store,
+// and the digests of metrics that have completed a window since. State that
+// fails to be written is kept for the next call.
+func (st *streamStore) persist() error {
+	return st.write(false)
+}
+
+// persistAll is persist writing the digests of every updated metric, for
+// shutting down.
+func (st *streamStore) persistAll() error {
+	return st.write(true)
+}
+
+func (st *streamStore) write(allDigests bool) error {
+	st.mu.Lock()
+	stats := make(map[string][]byte, len(st.dirty))
+	digests := make(map[string][]byte, len(st.rolled))
+	for name := range st.dirty {
+		stats[name] = st.streams[name].stats.marshal()
+		if allDigests {
+			st.rolled[name] = true
+		}
+	}
+	for name := range st.rolled {
+		digests[name] = st.streams[name].digests.marshal()
+	}
+	st.dirty = make(map[string]bool)
+	st.rolled = make(map[string]bool)
+	st.mu.Unlock()
+	if len(stats) == 0 && len(digests) == 0 {
+		return nil
+	}
+
+	pipe := st.client.Pipeline()
+	for name := range stats {
+		pipe.Set(ctx, metricSubKey(name, "stats"), stats[name], 0)
+	}
+	for name := range digests {
+		pipe.Set(ctx, metricSubKey(name, "digests"), digests[name], 0)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		st.mu.Lock()
+		for name := range stats {
+			if st.streams[name] != nil {
+				st.dirty[name] = true
+			}
+		}
+		for name := range digests {
+			if st.streams[name] != nil {
+				st.rolled[name] = true
+			}
+		}
+		st.mu.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestStreamingStats(t *testing.T) {
+	rnd := rand.New(rand.NewSource(4))
+	var values []float64
+	s := newStreamingStats()
+	for i := 0; i < 2000; i++ {
+		v := 100 + 10*rnd.NormFloat64()
+		values = append(values, v)
+		s.add(Measurement{v, int64(i)})
+	}
+
+	if round(s.Mean, 6) != round(mean(values), 6) || round(s.std(), 6) != round(std(values), 6) {
+		t.Fatal("streamingStats should match mean and std but returned", s.Mean, s.std())
+	}
+	m, sd := s.withoutLast()
+	if round(m, 6) != round(mean(values[:1999]), 6) || round(sd, 6) != round(std(values[:1999]), 6) {
+		t.Fatal("streamingStats should match the mean and std without the latest datapoint but returned", m, sd)
+	}
+	ew, ewStd := ewma(values, 50), ewmStd(values, 50)
+	if round(s.ewma(), 6) != round(ew[len(ew)-1], 6) || round(s.ewmStd(), 6) != round(ewStd[len(ewStd)-1], 6) {
+		t.Fatal("streamingStats should match ewma and ewmStd but returned", s.ewma(), s.ewmStd())
+	}
+	if round(s.tailAvg(), 6) != round(tailAvg(values), 6) {
+		t.Fatal("streamingStats should match tailAvg but returned", s.tailAvg())
+	}
+	if math.Abs(s.Median.value()-median(values)) > 1 {
+		t.Fatal("streamingStats should estimate the median", median(values), "but returned", s.Median.value())
+	}
+	// The median absolute deviation of normal data is 0.6745 standard deviations.
+	if math.Abs(s.Deviation.value()-6.745) > 1 {
+		t.Fatal("streamingStats should estimate the median absolute deviation but returned", s.Deviation.value())
+	}
+
+	decoded, err := unmarshalStreamingStats(s.marshal())
+	if err != nil || *decoded != *s {
+		t.Fatal("streamingStats should survive encoding but returned", decoded, err)
+	}
+	if _, err := unmarshalStreamingStats([]byte("short")); err == nil {
+		t.Fatal("unmarshalStreamingStats should reject malformed input")
+	}
+}
+
+func TestStreamingDetectors(t *testing.T) {
+	s := newStreamingStats()
+	for i := 0; i < 100; i++ {
+		s.add(Measurement{10 + float64(i%5), int64(i)})
+	}
+	if streamingMeanSubtractionCumulation(s) || streamingStddevFromMovingAverage(s) || streamingMedianAbsoluteDeviation(s) {
+		t.Fatal("streaming detectors should not flag a regular series")
+	}
+	s.add(Measurement{100, 100})
+	if !streamingMeanSubtractionCumulation(s) || !streamingStddevFromMovingAverage(s) || !streamingMedianAbsoluteDeviation(s) {
+		t.Fatal("streaming detectors should flag a spike")
+	}
+	if streamingMeanSubtractionCumulation(newStreamingStats()) || streamingMedianAbsoluteDeviation(newStreamingStats()) {
+		t.Fatal("streaming detectors should not flag an empty series")
+	}
+}
+
+func TestP2Quantile(t *testing.T) {
+	q := newP2Quantile(0.9)
+	for _, v := range []float64{3, 1, 2} {
+		q.add(v)
+	}
+	if q.value() != 3 {
+		t.Fatal("p2Quantile should be exact for few datapoints but returned", q.value())
+	}
+	for i := 3; i < 10000; i++ {
+		q.add(float64(i % 1000))
+	}
+	if math.Abs(q.value()-900) > 10 {
+		t.Fatal("p2Quantile should estimate the 90th percentile as 900 but returned", q.value())
+	}
+}
+
+func TestStreamingStatsIgnoresNaN(t *testing.T) {
+	s := newStreamingStats()
+	for i, v := range []float64{1, math.NaN(), 2, math.Inf(1), 3} {
+		s.add(Measurement{v, int64(i)})
+	}
+	if s.Count != 3 || s.Mean != 2 || unDef(s.std()) || s.last() != 3 {
+		t.Fatal("streamingStats should skip NaN and infinite values but has count", s.Count, "and mean", s.Mean)
+	}
+}
+
+func TestStreamStoreSeeds(t *testing.T) {
+	st := newStreamStore(nil)
+	ts := seasonalSeries(2)
+	st.observe("m", ts[len(ts)-1])
+	snapshot := st.get("m", ts)
+	if snapshot == nil || snapshot.stats.Count != int64(len(ts)) || round(snapshot.stats.Mean, 6) != round(mean(ts.values()), 6) {
+		t.Fatal("get() should rebuild a state that missed the stored datapoints but returned", snapshot.stats)
+	}
+	st.observe("m", Measurement{1, ts[len(ts)-1].timestamp + 3600})
+	if snapshot := st.get("m", ts); snapshot.stats.Count != int64(len(ts))+1 {
+		t.Fatal("get() should keep a state that covers the stored datapoints but it has count", snapshot.stats.Count)
+	}
+	if st.get("other", nil) != nil {
+		t.Fatal("get() should return nil for a metric without datapoints")
+	}
+}
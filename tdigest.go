@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// digestCompression bounds the number of centroids in a tdigest to about
+// half of it.
+const digestCompression = 100
+
+// Rollup windows of the per-metric digests, in seconds and in number of
+// completed windows kept. The completed windows are the reference against
+// which the percentile rank of new datapoints is judged. They are set from
+// the command line. Each window costs a digest per metric, so they are few
+// and long.
+var (
+	digestWindow  int64 = 4 * 3600
+	digestWindows       = 6
+)
+
+// validDigestWindows returns an error unless the rollup windows are at
+// least a second long and at least one is kept.
+func validDigestWindows(window int64, windows int) error {
+	if window <= 0 {
+		return fmt.Errorf("digest window of %d seconds, want at least one", window)
+	}
+	if windows <= 0 {
+		return fmt.Errorf("%d digest windows, want at least one", windows)
+	}
+	return nil
+}
+
+// percentileRankQuantile is the quantile of the reference window above which
+// percentileRank flags a datapoint, and percentileRankMinimum the fewest
+// reference datapoints for the quantile to be trusted.
+const (
+	percentileRankQuantile = 0.999
+	percentileRankMinimum  = 1000
+)
+
+type centroid struct {
+	mean, count float64
+}
+
+// tdigest is a merging t-digest (Dunning 2019), a mergeable sketch of a
+// distribution from which quantiles and ranks can be estimated, most
+// accurately in the tails. Datapoints are buffered and merged into
+// centroids whose size is bounded by the arcsine scale function.
+type tdigest struct {
+	compression float64
+	centroids   []centroid // sorted by mean
+	buffer      []centroid
+	total       float64
+	min, max    float64
+}
+
+func newTDigest(compression float64) *tdigest {
+	return &tdigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (d *tdigest) add(x float64) {
+	d.addCentroid(centroid{x, 1})
+}
+
+func (d *tdigest) addCentroid(c centroid) {
+	d.buffer = append(d.buffer, c)
+	d.total += c.count
+	d.min = math.Min(d.min, c.mean)
+	d.max = math.Max(d.max, c.mean)
+	if len(d.buffer) >= 5*int(d.compression) {
+		d.compress()
+	}
+}
+
+// merge adds every datapoint summarized by other.
+func (d *tdigest) merge(other *tdigest) {
+	other.compress()
+	for _, c := range other.centroids {
+		d.addCentroid(c)
+	}
+	d.min = math.Min(d.min, other.min)
+	d.max = math.Max(d.max, other.max)
+}
+
+func (d *tdigest) scale(q float64) float64 {
+	return d.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (d *tdigest) inverseScale(k float64) float64 {
+	return (math.Sin(k*2*math.Pi/d.compression) + 1) / 2
+}
+
+// compress merges the buffered datapoints into the centroids.
+func (d *tdigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := append(d.centroids, d.buffer...)
+	d.buffer = nil
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, int(d.compression))
+	current := all[0]
+	var soFar float64
+	limit := d.total * d.inverseScale(d.scale(0)+1)
+	for _, c := range all[1:] {
+		if soFar+current.count+c.count <= limit {
+			current.count += c.count
+			current.mean += (c.mean - current.mean) * c.count / current.count
+			continue
+		}
+		merged = append(merged, current)
+		soFar += current.count
+		limit = d.total * d.inverseScale(d.scale(soFar/d.total)+1)
+		current = c
+	}
+	d.centroids = append(merged, current)
+}
+
+// quantile returns the estimated q quantile, interpolating between the
+// centres of the centroids and the extremes.
+func (d *tdigest) quantile(q float64) float64 {
+	d.compress()
+	if d.total == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return d.min
+	}
+	if len(d.centroids) == 1 {
+		return d.centroids[0].mean
+	}
+	if q >= 1 {
+		return d.max
+	}
+
+	target := q * d.total
+	prevCentre, prevMean := 0.0, d.min
+	var cumulative float64
+	for _, c := range d.centroids {
+		centre := cumulative + c.count/2
+		if target < centre {
+			return prevMean + (c.mean-prevMean)*(target-prevCentre)/(centre-prevCentre)
+		}
+		prevCentre, prevMean = centre, c.mean
+		cumulative += c.count
+	}
+	if d.total == prevCentre {
+		return d.max
+	}
+	return prevMean + (d.max-prevMean)*(target-prevCentre)/(d.total-prevCentre)
+}
+
+// rank returns the estimated fraction of the datapoints at or below x.
+func (d *tdigest) rank(x float64) float64 {
+	d.compress()
+	switch {
+	case d.total == 0:
+		return math.NaN()
+	case x < d.min:
+		return 0
+	case x >= d.max:
+		return 1
+	}
+
+	prevCentre, prevMean := 0.0, d.min
+	var cumulative float64
+	for _, c := range d.centroids {
+		centre := cumulative + c.count/2
+		if x < c.mean {
+			if c.mean == prevMean {
+				return prevCentre / d.total
+			}
+			return (prevCentre + (centre-prevCentre)*(x-prevMean)/(c.mean-prevMean)) / d.total
+		}
+		prevCentre, prevMean = centre, c.mean
+		cumulative += c.count
+	}
+	return (prevCentre + (d.total-prevCentre)*(x-prevMean)/(d.max-prevMean)) / d.total
+}
+
+func (d *tdigest) clone() *tdigest {
+	d.compress()
+	c := *d
+	c.centroids = append([]centroid(nil), d.centroids...)
+	return &c
+}
+
+func (d *tdigest) encode(w io.Writer) {
+	d.compress()
+	binary.Write(w, binary.LittleEndian, []float64{d.compression, d.min, d.max, float64(len(d.centroids))})
+	for _, c := range d.centroids {
+		binary.Write(w, binary.LittleEndian, []float64{c.mean, c.count})
+	}
+}
+
+func decodeTDigest(r io.Reader) (*tdigest, error) {
+	header := make([]float64, 4)
+	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	d := &tdigest{compression: header[0], min: header[1], max: header[2]}
+	n := int(header[3])
+	if d.compression <= 0 || n < 0 || n > 10*int(d.compression) {
+		return nil, fmt.Errorf("bad t-digest header %v", header)
+	}
+	values := make([]float64, 2*n)
+	if err := binary.Read(r, binary.LittleEndian, values); err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		c := centroid{values[2*i], values[2*i+1]}
+		d.centroids = append(d.centroids, c)
+		d.total += c.count
+	}
+	return d, nil
+}
+
+// windowDigest summarizes the datapoints timestamped within one rollup window.
+type windowDigest struct {
+	Start  int64
+	Digest *tdigest
+}
+
+// digestSet holds the t-digests of a metric: one of every datapoint it has
+// received, one of the current rollup window and those of the last
+// digestWindows completed windows.
+type digestSet struct {
+	total     *tdigest
+	current   windowDigest
+	completed []windowDigest // oldest first
+}
+
+func newDigestSet() *digestSet {
+	return &digestSet{total: newTDigest(digestCompression)}
+}
+
+// add adds a datapoint to the digests and reports whether it completed the
+// current window. NaN and infinite values are ignored.
+func (s *digestSet) add(m Measurement) bool {
+	if unDef(m.value) {
+		return false
+	}
+	start := m.timestamp - m.timestamp%digestWindow
+	completed := false
+	if s.current.Digest == nil {
+		s.current = windowDigest{start, newTDigest(digestCompression)}
+	} else if start > s.current.Start {
+		completed = true
+		s.current.Digest.compress()
+		s.completed = append(s.completed, s.current)
+		if over := len(s.completed) - digestWindows; over > 0 {
+			s.completed = s.completed[over:]
+		}
+		s.current = windowDigest{start, newTDigest(digestCompression)}
+	}
+	// Late datapoints are counted in the current window.
+	s.current.Digest.add(m.value)
+	s.total.add(m.value)
+	return completed
+}
+
+func (s *digestSet) clone() *digestSet {
+	c := &digestSet{total: s.total.clone(), current: s.current}
+	if s.current.Digest != nil {
+		c.current.Digest = s.current.Digest.clone()
+	}
+	for _, w := range s.completed {
+		c.completed = append(c.completed, windowDigest{w.Start, w.Digest.clone()})
+	}
+	return c
+}
+
+// reference returns a digest of the completed windows.
+func (s *digestSet) reference() *tdigest {
+	ref := newTDigest(digestCompression)
+	for _, w := range s.completed {
+		ref.merge(w.Digest)
+	}
+	return ref
+}
+
+func (s *digestSet) marshal() []byte {
+	var buf bytes.Buffer
+	s.total.encode(&buf)
+	windows := s.completed
+	if s.current.Digest != nil {
+		windows = append(windows[:len(windows):len(windows)], s.current)
+	}
+	binary.Write(&buf, binary.LittleEndian, int64(len(windows)))
+	for _, w := range windows {
+		binary.Write(&buf, binary.LittleEndian, w.Start)
+		w.Digest.encode(&buf)
+	}
+	return buf.Bytes()
+}
+
+func unmarshalDigestSet(b []byte) (*digestSet, error) {
+	r := bytes.NewReader(b)
+	total, err := decodeTDigest(r)
+	if err != nil {
+		return nil, err
+	}
+	s := &digestSet{total: total}
+	var n int64
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < n; i++ {
+		var w windowDigest
+		if err := binary.Read(r, binary.LittleEndian, &w.Start); err != nil {
+			return nil, err
+		}
+		if w.Digest, err = decodeTDigest(r); err != nil {
+			return nil, err
+		}
+		s.completed = append(s.completed, w)
+	}
+	if len(s.completed) > 0 {
+		s.current = s.completed[len(s.completed)-1]
+		s.completed = s.completed[:len(s.completed)-1]
+	}
+	return s, nil
+}
+
+// PercentileRank function
+// A timeseries is anomalous if its latest datapoint is above the 99.9th
+// percentile of the reference, the datapoints of the last day before the
+// current rollup window, as estimated by a t-digest.
+func percentileRank(ts Measurements) bool {
+	if len(ts) == 0 {
+		return false
+	}
+	latest := ts[len(ts)-1]
+	windowStart := latest.timestamp - latest.timestamp%digestWindow
+	ref := newTDigest(digestCompression)
+	for _, m := range lastDuration(ts, fullDuration) {
+		if m.timestamp < windowStart {
+			ref.add(m.value)
+		}
+	}
+	return percentileRankAbove(ref, latest.value)
+}
+
+// streamingPercentileRank is percentileRank against the completed windows of
+// the metric's digests.
+func streamingPercentileRank(s *streamSnapshot) bool {
+	return s.stats.Count > 0 && percentileRankAbove(s.reference, s.stats.last())
+}
+
+func percentileRankAbove(ref *tdigest, x float64) bool {
+	if ref == nil || ref.total < percentileRankMinimum {
+		return false
+	}
+	return x > ref.quantile(percentileRankQuantile)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestTDigest(t *testing.T) {
+	rnd := rand.New(rand.NewSource(5))
+	d := newTDigest(digestCompression)
+	var values []float64
+	for i := 0; i < 100000; i++ {
+		v := rnd.NormFloat64()
+		values = append(values, v)
+		d.add(v)
+	}
+	exact := sorted(values)
+	// The error in rank is smallest in the tails.
+	for _, q := range []float64{0.001, 0.01, 0.5, 0.99, 0.999} {
+		got := d.quantile(q)
+		r := float64(sort.SearchFloat64s(exact, got)) / float64(len(exact))
+		if math.Abs(r-q) > 0.0005+0.01*q*(1-q) {
+			t.Fatal("tdigest should estimate the", q, "quantile but returned", got, "which is the", r, "quantile")
+		}
+	}
+	if r := d.rank(exact[99900]); math.Abs(r-0.999) > 0.0005 {
+		t.Fatal("tdigest should rank the 99.9th percentile at 0.999 but returned", r)
+	}
+	if d.rank(-100) != 0 || d.rank(100) != 1 {
+		t.Fatal("tdigest should rank values beyond the extremes at 0 and 1")
+	}
+	if n := len(d.centroids); n > digestCompression {
+		t.Fatal("tdigest should keep about half its compression in centroids but kept", n)
+	}
+
+	// Merged digests summarize the union.
+	a, b := newTDigest(digestCompression), newTDigest(digestCompression)
+	for i := 0; i < 1000; i++ {
+		a.add(float64(i))
+		b.add(float64(1000 + i))
+	}
+	a.merge(b)
+	if a.total != 2000 || math.Abs(a.quantile(0.5)-1000) > 10 || a.quantile(1) != 1999 {
+		t.Fatal("tdigest should merge into the union but returned", a.total, a.quantile(0.5), a.quantile(1))
+	}
+
+	var buf bytes.Buffer
+	a.encode(&buf)
+	decoded, err := decodeTDigest(&buf)
+	if err != nil || decoded.total != a.total || decoded.quantile(0.9) != a.quantile(0.9) {
+		t.Fatal("tdigest should survive encoding but returned", decoded, err)
+	}
+	if _, err := decodeTDigest(bytes.NewReader([]byte("short"))); err == nil {
+		t.Fatal("decodeTDigest should reject malformed input")
+	}
+}
+
+func TestDigestSet(t *testing.T) {
+	defer func(window int64, windows int) { digestWindow, digestWindows = window, windows }(digestWindow, digestWindows)
+	digestWindow, digestWindows = 3600, 24
+	s := newDigestSet()
+	completed := 0
+	for i := 0; i < 30*60; i++ {
+		if s.add(Measurement{float64(i % 60), int64(i * 60)}) {
+			completed++
+		}
+	}
+	if s.add(Measurement{math.NaN(), 29*3600 + 1}) || s.total.total != 30*60 {
+		t.Fatal("digestSet should ignore NaN but has", s.total.total, "datapoints")
+	}
+	if completed != 29 {
+		t.Fatal("add() should report each of the 29 completed windows but reported", completed)
+	}
+	if len(s.completed) != digestWindows || s.current.Start != 29*3600 {
+		t.Fatal("digestSet should keep", digestWindows, "completed windows but kept", len(s.completed), "and current", s.current.Start)
+	}
+	if s.completed[0].Start != 5*3600 || s.reference().total != float64(digestWindows*60) || s.total.total != 30*60 {
+		t.Fatal("digestSet should drop the oldest windows but kept", s.completed[0].Start, s.reference().total, s.total.total)
+	}
+
+	decoded, err := unmarshalDigestSet(s.marshal())
+	if err != nil || len(decoded.completed) != digestWindows || decoded.current.Start != s.current.Start || decoded.reference().total != s.reference().total {
+		t.Fatal("digestSet should survive encoding but returned", decoded, err)
+	}
+}
+
+func TestPercentileRank(t *testing.T) {
+	rnd := rand.New(rand.NewSource(6))
+	var ts Measurements
+	for i := 0; i < 1440; i++ {
+		ts = append(ts, Measurement{10 + rnd.NormFloat64(), int64(i * 60)})
+	}
+	if percentileRank(ts) {
+		t.Fatal("percentileRank should not flag a typical datapoint")
+	}
+	ts[len(ts)-1].value = 20
+	if !percentileRank(ts) {
+		t.Fatal("percentileRank should flag a datapoint beyond the reference's 99.9th percentile")
+	}
+	if percentileRank(ts[len(ts)-100:]) {
+		t.Fatal("percentileRank should not flag anything without enough reference datapoints")
+	}
+}
+
+func TestValidDigestWindows(t *testing.T) {
+	if validDigestWindows(3600, 6) != nil {
+		t.Fatal("validDigestWindows() should accept hourly windows")
+	}
+	if validDigestWindows(0, 6) == nil || validDigestWindows(3600, 0) == nil {
+		t.Fatal("validDigestWindows() should refuse empty windows")
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MAX_METRICS is the number of datapoints kept for each metric.
+const MAX_METRICS int64 = 500000
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+	// closeAttempts is how many times a closing writer retries its
+	// remaining datapoints before spooling or dropping them.
+	closeAttempts = 5
+)
+
+// datapoint is a received datapoint waiting to be written to the store.
+type datapoint struct {
+	name        string
+	value       string // "value,timestamp" as stored
+	seen        int64  // unix time at which it was received
+	measurement Measurement
+	stored      bool // written to the store but not yet to the indexes
+}
+
+// parseDatapoint parses a "name value timestamp" line.
+func parseDatapoint(msg []byte, seen int64) (datapoint, error) {
+	fields := strings.Fields(string(msg))
+	if len(fields) < 3 {
+		return datapoint{}, fmt.Errorf("malformed datapoint %q", msg)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return datapoint{}, fmt.Errorf("malformed value in %q", msg)
+	}
+	timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return datapoint{}, fmt.Errorf("malformed timestamp in %q", msg)
+	}
+	return datapoint{
+		name:        fields[0],
+		value:       fields[1] + "," + fields[2],
+		seen:        seen,
+		measurement: Measurement{value, timestamp},
+	}, nil
+}
+
+// writeStats counts what happened to received datapoints. It is shared by
+// every writer and updated atomically.
+type writeStats struct {
+	received  uint64
+	malformed uint64
+	written   uint64
+	spooled   uint64
+	dropped   uint64
+	failures  uint64
+}
+
+func (s *writeStats) snapshot() map[string]uint64 {
+	return map[string]uint64{
+		"received":  atomic.LoadUint64(&s.received),
+		"malformed": atomic.LoadUint64(&s.malformed),
+		"written":   atomic.LoadUint64(&s.written),
+		"spooled":   atomic.LoadUint64(&s.spooled),
+		"dropped":   atomic.LoadUint64(&s.dropped),
+		"failures":  atomic.LoadUint64(&s.failures),
+	}
+}
+
+// batchWriter writes datapoints to the store in pipelined batches from its
+// own goroutine, so that a slow or unavailable store never holds up the
+// ingestion worker sending to it. When a write fails the datapoints that
+// were not written are kept, in order, in a bounded in-memory buffer and
+// optionally a disk spool behind it, and retried with exponential backoff
+// while new datapoints keep being accepted. Each ingestion worker owns its
+// own batchWriter; the stats and spool are shared.
+type batchWriter struct {
+	client      redis.UniversalClient
+	stats       *writeStats
+	spool       *spool
+	logger      *log.Logger
+	batchSize   int
+	maxBuffered int
+	in          chan datapoint
+
+	batch     []datapoint
+	pending   []datapoint
+	replaying bool
+	backoff   time.Duration
+	retryAt   time.Time
+}
+
+// send hands dp to the writer's goroutine without blocking. When the writer
+// is so far behind that w.in is full, dp is counted as dropped instead.
+func (w *batchWriter) send(dp datapoint) {
+	select {
+	case w.in <- dp:
+	default:
+		atomic.AddUint64(&w.stats.received, 1)
+		atomic.AddUint64(&w.stats.dropped, 1)
+	}
+}
+
+// run writes the datapoints sent to w until w.in is closed, flushing every
+// flushInterval, then writes out what it still holds.
+func (w *batchWriter) run(flushInterval time.Duration, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case dp, ok := <-w.in:
+			if !ok {
+				w.close()
+				return
+			}
+			w.add(dp)
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+// add queues dp and flushes once a full batch has been collected.
+func (w *batchWriter) add(dp datapoint) {
+	atomic.AddUint64(&w.stats.received, 1)
+	w.batch = append(w.batch, dp)
+	if len(w.batch) >= w.batchSize {
+		w.flush()
+	}
+}
+
+// exec writes dps to the store in one pipeline and returns how many were
+// stored and those that were not fully written. A pipeline can fail part
+// way through, as when one node of a Redis Cluster is down, so each result
+// is checked: a datapoint whose index entries failed but which was stored
+// is returned marked as stored, so that retrying it does not store it
+// twice.
+func (w *batchWriter) exec(dps []datapoint) (int, []datapoint, error) {
+	pipe := w.client.Pipeline()
+	pushes := make([]*redis.IntCmd, len(dps))
+	names := make([]*redis.IntCmd, len(dps))
+	seen := make([]*redis.IntCmd, len(dps))
+	for i, dp := range dps {
+		if !dp.stored {
+			pushes[i] = pipe.RPush(ctx, metricKey(dp.name), dp.value)
+			pipe.LTrim(ctx, metricKey(dp.name), -MAX_METRICS, -1)
+		}
+		names[i] = pipe.SAdd(ctx, shardKey(metricNamesKey, dp.name), dp.name)
+		seen[i] = pipe.ZAdd(ctx, shardKey(lastSeenKey, dp.name), redis.Z{Score: float64(dp.seen), Member: dp.name})
+	}
+	_, err := pipe.Exec(ctx)
+
+	stored := 0
+	var failed []datapoint
+	for i, dp := range dps {
+		if pushes[i] != nil {
+			if pushes[i].Err() != nil {
+				failed = append(failed, dp)
+				continue
+			}
+			stored++
+		}
+		if names[i].Err() != nil || seen[i].Err() != nil {
+			dp.stored = true
+			failed = append(failed, dp)
+		}
+	}
+	return stored, failed, err
+}
+
+// enqueue appends dps to the datapoints waiting to be written. Once the
+// in-memory buffer is full the rest go to the spool, and everything after
+// them too until it has drained, so that datapoints are written in the
+// order they were received. Without a spool the oldest datapoints are
+// dropped instead.
+func (w *batchWriter) enqueue(dps []datapoint) {
+	if w.spool == nil {
+		w.pending = append(w.pending, dps...)
+		if over := len(w.pending) - w.maxBuffered; over > 0 {
+			w.pending = w.pending[over:]
+			atomic.AddUint64(&w.stats.dropped, uint64(over))
+		}
+		return
+	}
+
+	if !w.spool.active() {
+		room := w.maxBuffered - len(w.pending)
+		if room >= len(dps) {
+			w.pending = append(w.pending, dps...)
+			return
+		}
+		if room > 0 {
+			w.pending = append(w.pending, dps[:room]...)
+			dps = dps[room:]
+		}
+	}
+	n, err := w.spool.write(dps)
+	atomic.AddUint64(&w.stats.spooled, uint64(n))
+	if n < len(dps) {
+		atomic.AddUint64(&w.stats.dropped, uint64(len(dps)-n))
+	}
+	if err != nil {
+		w.logger.Println("spooling datapoints failed:", err)
+	}
+}
+
+// flush writes the current batch along with anything buffered before it,
+// unless a previous failure is still backing off.
+func (w *batchWriter) flush() {
+	if len(w.batch) > 0 {
+		w.enqueue(w.batch)
+		w.batch = nil
+	}
+	if time.Now().Before(w.retryAt) {
+		return
+	}
+
+	for {
+		if len(w.pending) == 0 && w.spool != nil {
+			if w.replaying {
+				w.spool.release()
+				w.replaying = false
+			}
+			if w.spool.claim() {
+				w.replaying = true
+				dps, err := w.spool.take(w.maxBuffered)
+				if err != nil {
+					w.logger.Println("reading spooled datapoints failed:", err)
+					return
+				}
+				w.pending = dps
+			}
+		}
+		if len(w.pending) == 0 {
+			return
+		}
+
+		n := len(w.pending)
+		if n > w.batchSize {
+			n = w.batchSize
+		}
+		stored, failed, err := w.exec(w.pending[:n])
+		atomic.AddUint64(&w.stats.written, uint64(stored))
+		if err != nil {
+			w.pending = append(failed, w.pending[n:]...)
+			w.fail(err)
+			return
+		}
+		w.pending = w.pending[n:]
+		w.backoff = 0
+	}
+}
+
+func (w *batchWriter) fail(err error) {
+	atomic.AddUint64(&w.stats.failures, 1)
+	if w.backoff == 0 {
+		w.backoff = minBackoff
+	} else if w.backoff *= 2; w.backoff > maxBackoff {
+		w.backoff = maxBackoff
+	}
+	w.retryAt = time.Now().Add(w.backoff)
+	w.logger.Println("writing datapoints failed, retrying in", w.backoff, "-", err)
+}
+
+// close flushes everything still buffered, retrying a few times if the store
+// is unavailable. Datapoints that still cannot be written are left in the
+// spool for the next run, or dropped when there is none.
+func (w *batchWriter) close() {
+	for i := 0; i < closeAttempts; i++ {
+		time.Sleep(time.Until(w.retryAt))
+		w.flush()
+		if len(w.pending) == 0 && (w.spool == nil || w.spool.len() == 0) {
+			return
+		}
+	}
+
+	if w.spool != nil {
+		if w.replaying {
+			w.spool.release()
+			w.replaying = false
+		}
+		n, err := w.spool.write(w.pending)
+		atomic.AddUint64(&w.stats.spooled, uint64(n))
+		atomic.AddUint64(&w.stats.dropped, uint64(len(w.pending)-n))
+		if err != nil {
+			w.logger.Println("spooling datapoints failed:", err)
+		}
+	} else {
+		atomic.AddUint64(&w.stats.dropped, uint64(len(w.pending)))
+	}
+	w.pending = nil
+}
+
+// spool is an append-only file of datapoints that could not be held in
+// memory while the store was unavailable, shared by all writers. It is read
+// sequentially from an offset kept next to it, and removed once it has been
+// drained, so it survives restarts. Only one writer replays it at a time so
+// that the spooled datapoints of a metric are written in the order they
+// were received.
+type spool struct {
+	mu        sync.Mutex
+	path      string
+	maxBytes  int64
+	size      int64
+	offset    int64
+	count     int
+	replaying bool
+}
+
+func openSpool(dir string, maxBytes int64) (*spool, error) {
+	s := &spool{path: filepath.Join(dir, "kaas.spool"), maxBytes: maxBytes}
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if b, err := os.ReadFile(s.offsetPath()); err == nil {
+		s.offset, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s.size = info.Size()
+	if s.offset < 0 || s.offset > s.size {
+		s.offset = 0
+	}
+	if _, err := f.Seek(s.offset, 0); err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s.count++
+	}
+	return s, scanner.Err()
+}
+
+func (s *spool) offsetPath() string {
+	return s.path + ".offset"
+}
+
+func (s *spool) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// active reports whether the spool holds datapoints or a writer is still
+// replaying ones taken from it, in which case new datapoints have to queue
+// behind them.
+func (s *spool) active() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count > 0 || s.replaying
+}
+
+// claim makes the caller the spool's only replaying writer, reporting false
+// when another writer already is or there is nothing to replay.
+func (s *spool) claim() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replaying || s.count == 0 {
+		return false
+	}
+	s.replaying = true
+	return true
+}
+
+// release ends a claim once the replaying writer has written everything it
+// took.
+func (s *spool) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaying = false
+}
+
+// write appends dps to the spool until it reaches its size limit and returns
+// how many were written. The limit covers datapoints already replayed until
+// the spool has drained and is removed.
+func (s *spool) write(dps []datapoint) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	buf := bufio.NewWriter(f)
+	n := 0
+	for _, dp := range dps {
+		line := dp.name + " " + dp.value + " " + strconv.FormatInt(dp.seen, 10) + "\n"
+		if s.size+int64(len(line)) > s.maxBytes {
+			break
+		}
+		buf.WriteString(line)
+		s.size += int64(len(line))
+		n++
+	}
+	s.count += n
+	return n, buf.Flush()
+}
+
+// take returns up to n datapoints from the head of the spool and advances
+// its offset past them.
+func (s *spool) take(n int) ([]datapoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(s.offset, 0); err != nil {
+		return nil, err
+	}
+
+	var dps []datapoint
+	read := int64(0)
+	lines := 0
+	r := bufio.NewReader(f)
+	for len(dps) < n {
+		line, err := r.ReadString('\n')
+		if len(line) == 0 {
+			break
+		}
+		read += int64(len(line))
+		lines++
+		if fields := strings.Fields(line); len(fields) == 3 {
+			seen, serr := strconv.ParseInt(fields[2], 10, 64)
+			m, merr := parseMeasurement(fields[1])
+			if serr == nil && merr == nil {
+				dps = append(dps, datapoint{name: fields[0], value: fields[1], seen: seen, measurement: m})
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	s.offset += read
+	if s.count -= lines; s.count <= 0 || s.offset >= s.size {
+		s.count, s.size, s.offset = 0, 0, 0
+		os.Remove(s.offsetPath())
+		return dps, os.Remove(s.path)
+	}
+	return dps, os.WriteFile(s.offsetPath(), []byte(strconv.FormatInt(s.offset, 10)), 0600)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestParseDatapoint(t *testing.T) {
+	dp, err := parseDatapoint([]byte("web01.cpu 0.5 1400000000 \n"), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dp.name != "web01.cpu" || dp.value != "0.5,1400000000" || dp.seen != 42 || dp.measurement != (Measurement{0.5, 1400000000}) {
+		t.Fatal("parseDatapoint() returned the wrong datapoint", dp)
+	}
+	for _, msg := range []string{"", "web01.cpu 0.5", "web01.cpu x 1400000000", "web01.cpu 0.5 x"} {
+		if _, err := parseDatapoint([]byte(msg), 0); err == nil {
+			t.Fatal("parseDatapoint() should have rejected", msg)
+		}
+	}
+}
+
+func testDatapoints(n int) []datapoint {
+	var dps []datapoint
+	for i := 0; i < n; i++ {
+		dps = append(dps, datapoint{name: "m", value: "1," + strconv.Itoa(100+i), seen: int64(i)})
+	}
+	return dps
+}
+
+func TestEnqueueDropsOldest(t *testing.T) {
+	w := &batchWriter{stats: &writeStats{}, maxBuffered: 3}
+	w.enqueue(testDatapoints(5))
+	if len(w.pending) != 3 || w.pending[0].seen != 2 {
+		t.Fatal("enqueue() should keep the newest 3 datapoints but kept", w.pending)
+	}
+	if w.stats.dropped != 2 {
+		t.Fatal("enqueue() should have counted 2 dropped datapoints but counted", w.stats.dropped)
+	}
+}
+
+func TestSendDropsWhenBehind(t *testing.T) {
+	w := &batchWriter{stats: &writeStats{}, in: make(chan datapoint, 2)}
+	for _, dp := range testDatapoints(3) {
+		w.send(dp)
+	}
+	if len(w.in) != 2 || w.stats.received != 1 || w.stats.dropped != 1 {
+		t.Fatal("send() should queue 2 datapoints and drop 1 without blocking but queued", len(w.in), "and dropped", w.stats.dropped)
+	}
+}
+
+func TestEnqueueSpools(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kaas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp, err := openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &batchWriter{stats: &writeStats{}, spool: sp, logger: log.New(os.Stderr, "", 0), maxBuffered: 2}
+	w.enqueue(testDatapoints(5))
+	if len(w.pending) != 2 || sp.len() != 3 || w.stats.spooled != 3 {
+		t.Fatal("enqueue() should buffer 2 datapoints and spool 3 but buffered", len(w.pending), "and spooled", sp.len())
+	}
+
+	reopened, err := openSpool(dir, 1<<20)
+	if err != nil || reopened.len() != 3 {
+		t.Fatal("openSpool() should find 3 spooled datapoints but found", reopened.len(), err)
+	}
+	dps, err := reopened.take(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dps) != 2 || dps[0].seen != 2 || dps[1].seen != 3 || reopened.len() != 1 {
+		t.Fatal("take(2) should return the 2 oldest spooled datapoints but returned", dps)
+	}
+	if dps[0].value != "1,102" || dps[0].measurement != (Measurement{1, 102}) {
+		t.Fatal("take() should restore the stored value but returned", dps[0].value)
+	}
+}
+
+func TestSpoolLimit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kaas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp, _ := openSpool(dir, 20)
+	n, err := sp.write(testDatapoints(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatal("write() should stop at the size limit after 2 datapoints but wrote", n)
+	}
+}
+
+func TestSpoolReadsFromOffset(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kaas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp, _ := openSpool(dir, 1<<20)
+	sp.write(testDatapoints(5))
+	if _, err := sp.take(2); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openSpool(dir, 1<<20)
+	if err != nil || reopened.len() != 3 {
+		t.Fatal("openSpool() should resume after the 2 taken datapoints but found", reopened.len(), err)
+	}
+	dps, err := reopened.take(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dps) != 3 || dps[0].seen != 2 {
+		t.Fatal("take() should continue from the stored offset but returned", dps)
+	}
+	if _, err := os.Stat(reopened.path); !os.IsNotExist(err) {
+		t.Fatal("take() should remove the drained spool but it is still there", err)
+	}
+	if reopened.write(testDatapoints(1)); reopened.len() != 1 {
+		t.Fatal("write() should start a new spool after draining but it holds", reopened.len())
+	}
+}
+
+func TestSpoolClaim(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kaas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp, _ := openSpool(dir, 1<<20)
+	if sp.claim() {
+		t.Fatal("claim() should fail on an empty spool but succeeded")
+	}
+	sp.write(testDatapoints(1))
+	if !sp.claim() || sp.claim() {
+		t.Fatal("claim() should succeed exactly once until released")
+	}
+	sp.take(1)
+	if !sp.active() {
+		t.Fatal("active() should hold new datapoints back while the taken ones are replayed")
+	}
+	sp.release()
+	if sp.active() {
+		t.Fatal("active() should report false once the spool has drained and been released")
+	}
+}